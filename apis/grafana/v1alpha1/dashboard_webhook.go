@@ -0,0 +1,273 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	// maxDashboardSize bounds the size of a single dashboard in bytes.
+	maxDashboardSize = 512 * 1024
+	// minDashboardSchemaVersion is the first schema with the panels layout,
+	// older dashboards use rows.
+	minDashboardSchemaVersion = 16
+)
+
+// log is for logging in this package.
+var dashboardlog = logf.Log.WithName("dashboard-resource")
+
+// DashboardValidator validates the dashboards of the ConfigMaps labeled
+// grafana.snappcloud.io/dashboard before they are imported into Grafana.
+// +kubebuilder:object:generate=false
+type DashboardValidator struct {
+	Client client.Reader
+}
+
+func (v *DashboardValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&corev1.ConfigMap{}).
+		WithValidator(v).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate--v1-configmap,mutating=false,failurePolicy=fail,sideEffects=None,groups="",resources=configmaps,verbs=create;update,versions=v1,name=vdashboard.kb.io,admissionReviewVersions=v1
+
+var _ webhook.CustomValidator = &DashboardValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *DashboardValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return nil, fmt.Errorf("expected a ConfigMap but got a %T", obj)
+	}
+	return v.validate(ctx, cm)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *DashboardValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	cm, ok := newObj.(*corev1.ConfigMap)
+	if !ok {
+		return nil, fmt.Errorf("expected a ConfigMap but got a %T", newObj)
+	}
+	return v.validate(ctx, cm)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *DashboardValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *DashboardValidator) validate(ctx context.Context, cm *corev1.ConfigMap) (admission.Warnings, error) {
+	if _, ok := cm.Labels[grafana.DashboardLabel]; !ok {
+		return nil, nil
+	}
+	dashboardlog.Info("validate", "namespace", cm.Namespace, "name", cm.Name)
+
+	ns := &corev1.Namespace{}
+	err := v.Client.Get(ctx, client.ObjectKey{Name: cm.Namespace}, ns)
+	if err != nil {
+		return nil, err
+	}
+	var warnings admission.Warnings
+	_, monitored := ns.Labels[grafana.NamespaceMonitoringLabel]
+	_, hasTeam := ns.Labels[grafana.TeamLabel]
+	if !monitored || !hasTeam {
+		warnings = append(warnings, fmt.Sprintf("namespace %s lacks the %s or %s label, its dashboards are not imported until it has both",
+			ns.Name, grafana.NamespaceMonitoringLabel, grafana.TeamLabel))
+	}
+
+	refs := datasourceRefs{namespace: ns.Name, uid: ns.Annotations[grafana.DatasourceUIDAnnotation]}
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		if strings.HasSuffix(key, ".json") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var errs field.ErrorList
+	for _, key := range keys {
+		errs = append(errs, validateDashboard(field.NewPath("data").Key(key), cm.Data[key], refs)...)
+	}
+	if len(errs) > 0 {
+		return warnings, apierrors.NewInvalid(corev1.SchemeGroupVersion.WithKind("ConfigMap").GroupKind(), cm.Name, errs)
+	}
+	return warnings, nil
+}
+
+// datasourceRefs tells apart the datasource references of a namespace.
+// +kubebuilder:object:generate=false
+type datasourceRefs struct {
+	namespace string
+	// uid is the UID of the namespace datasource in Grafana, recorded on the
+	// namespace for every datasource backend once it is in Grafana.
+	uid string
+}
+
+// allowed reports whether ref, a name or an object with a UID, points to the
+// namespace datasource. Template variables and missing references are
+// pointed to it on import.
+func (d datasourceRefs) allowed(ref interface{}) bool {
+	var name string
+	switch r := ref.(type) {
+	case nil:
+		return true
+	case string:
+		name = r
+	case map[string]interface{}:
+		name, _ = r["uid"].(string)
+	default:
+		return false
+	}
+	return name == "" || grafana.IsBuiltinDatasource(name) || strings.HasPrefix(name, "$") ||
+		name == d.namespace || d.uid != "" && name == d.uid
+}
+
+// validateDashboard checks a dashboard is a JSON object Grafana can import,
+// and its queries only read the namespace datasource.
+func validateDashboard(path *field.Path, raw string, refs datasourceRefs) field.ErrorList {
+	if len(raw) > maxDashboardSize {
+		return field.ErrorList{field.TooLong(path, "", maxDashboardSize)}
+	}
+	model := map[string]interface{}{}
+	err := json.Unmarshal([]byte(raw), &model)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, "", jsonErrorMessage(raw, err))}
+	}
+
+	var errs field.ErrorList
+	if title, _ := model["title"].(string); strings.TrimSpace(title) == "" {
+		errs = append(errs, field.Required(path.Child("title"), "dashboard title must be a non-empty string"))
+	}
+	switch version := model["schemaVersion"].(type) {
+	case nil:
+		errs = append(errs, field.Required(path.Child("schemaVersion"), ""))
+	case float64:
+		if version != math.Trunc(version) || version < minDashboardSchemaVersion {
+			errs = append(errs, field.Invalid(path.Child("schemaVersion"), version,
+				fmt.Sprintf("must be an integer of at least %d, re-export older dashboards from Grafana", minDashboardSchemaVersion)))
+		}
+	default:
+		errs = append(errs, field.Invalid(path.Child("schemaVersion"), version, "must be a number"))
+	}
+
+	panels, ok := model["panels"].([]interface{})
+	if !ok {
+		errs = append(errs, field.Required(path.Child("panels"), "dashboard panels must be a list"))
+	}
+	errs = append(errs, validatePanels(path.Child("panels"), panels, refs)...)
+
+	for _, section := range []string{"templating", "annotations"} {
+		obj, _ := model[section].(map[string]interface{})
+		list, _ := obj["list"].([]interface{})
+		for i, item := range list {
+			item, _ := item.(map[string]interface{})
+			name, _ := item["name"].(string)
+			if ref, ok := item["datasource"]; ok && !refs.allowed(ref) {
+				errs = append(errs, field.Invalid(path.Child(section, "list").Index(i).Child("datasource"), ref,
+					fmt.Sprintf("%s %q references a datasource outside namespace %s", strings.TrimSuffix(section, "s"), name, refs.namespace)))
+			}
+		}
+	}
+	return errs
+}
+
+// validatePanels checks the panels, and the panels of collapsed rows.
+func validatePanels(path *field.Path, panels []interface{}, refs datasourceRefs) field.ErrorList {
+	var errs field.ErrorList
+	for i, item := range panels {
+		panelPath := path.Index(i)
+		panel, ok := item.(map[string]interface{})
+		if !ok {
+			errs = append(errs, field.Invalid(panelPath, item, "panel must be an object"))
+			continue
+		}
+		title, _ := panel["title"].(string)
+		desc := fmt.Sprintf("panel %q", title)
+
+		if _, ok := panel["gridPos"].(map[string]interface{}); !ok {
+			errs = append(errs, field.Required(panelPath.Child("gridPos"), desc+" has no position"))
+		}
+		// Library panels get their type and queries from the library
+		if _, ok := panel["libraryPanel"]; ok {
+			continue
+		}
+		typ, _ := panel["type"].(string)
+		if typ == "" {
+			errs = append(errs, field.Required(panelPath.Child("type"), desc+" has no type"))
+		}
+		if typ == "row" {
+			rowPanels, _ := panel["panels"].([]interface{})
+			errs = append(errs, validatePanels(panelPath.Child("panels"), rowPanels, refs)...)
+			continue
+		}
+
+		if ref, ok := panel["datasource"]; ok && !refs.allowed(ref) {
+			errs = append(errs, field.Invalid(panelPath.Child("datasource"), ref,
+				fmt.Sprintf("%s references a datasource outside namespace %s", desc, refs.namespace)))
+		}
+		targets, _ := panel["targets"].([]interface{})
+		for j, item := range targets {
+			target, _ := item.(map[string]interface{})
+			if ref, ok := target["datasource"]; ok && !refs.allowed(ref) {
+				refID, _ := target["refId"].(string)
+				errs = append(errs, field.Invalid(panelPath.Child("targets").Index(j).Child("datasource"), ref,
+					fmt.Sprintf("query %s of %s references a datasource outside namespace %s", refID, desc, refs.namespace)))
+			}
+		}
+	}
+	return errs
+}
+
+// jsonErrorMessage locates a JSON error in raw by line and column.
+func jsonErrorMessage(raw string, err error) string {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		return "dashboard must be a JSON object"
+	default:
+		return "invalid JSON: " + err.Error()
+	}
+	// The offset is past the offending byte
+	before := []byte(raw[:offset])
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n') - 1
+	return fmt.Sprintf("invalid JSON at line %d, column %d: %v", line, column, err)
+}
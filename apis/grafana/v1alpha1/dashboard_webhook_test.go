@@ -0,0 +1,123 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// errorTypes lists the types of errs, in order.
+func errorTypes(errs field.ErrorList) []field.ErrorType {
+	var types []field.ErrorType
+	for _, err := range errs {
+		types = append(types, err.Type)
+	}
+	return types
+}
+
+// dashboardCase is a dashboard and the errors expected for it.
+type dashboardCase struct {
+	raw       string
+	wantTypes []field.ErrorType
+	// wantField is the field of the first error, below the dashboard
+	wantField string
+}
+
+var _ = Describe("validateDashboard", func() {
+	refs := datasourceRefs{namespace: "team-a-prod", uid: "ds-uid"}
+	panel := func(fields string) string {
+		return `{"title": "p", "type": "timeseries", "gridPos": {"x": 0}` + fields + `}`
+	}
+	dashboard := func(fields string) string {
+		return `{"title": "Dashboard", "schemaVersion": 36` + fields + `}`
+	}
+	path := field.NewPath("data").Key("dashboard.json")
+
+	DescribeTable("reports the invalid fields",
+		func(tt dashboardCase) {
+			errs := validateDashboard(path, tt.raw, refs)
+			Expect(errorTypes(errs)).To(Equal(tt.wantTypes), "%v", errs)
+			if tt.wantField != "" {
+				Expect(errs[0].Field).To(Equal(path.String() + "." + tt.wantField))
+			}
+		},
+		Entry("valid", dashboardCase{raw: dashboard(`, "panels": [` + panel("") + `]`)}),
+		Entry("no panels", dashboardCase{raw: dashboard(``), wantTypes: []field.ErrorType{field.ErrorTypeRequired}, wantField: "panels"}),
+		Entry("too large", dashboardCase{raw: strings.Repeat(" ", maxDashboardSize+1), wantTypes: []field.ErrorType{field.ErrorTypeTooLong}}),
+		Entry("invalid JSON", dashboardCase{raw: "{\n  \"title\": }", wantTypes: []field.ErrorType{field.ErrorTypeInvalid}}),
+		Entry("not an object", dashboardCase{raw: `[]`, wantTypes: []field.ErrorType{field.ErrorTypeInvalid}}),
+		Entry("no title", dashboardCase{
+			raw:       `{"title": " ", "schemaVersion": 36, "panels": []}`,
+			wantTypes: []field.ErrorType{field.ErrorTypeRequired},
+			wantField: "title",
+		}),
+		Entry("old schema", dashboardCase{
+			raw:       `{"title": "Dashboard", "schemaVersion": 14, "panels": []}`,
+			wantTypes: []field.ErrorType{field.ErrorTypeInvalid},
+			wantField: "schemaVersion",
+		}),
+		Entry("schema as a string", dashboardCase{
+			raw:       `{"title": "Dashboard", "schemaVersion": "36", "panels": []}`,
+			wantTypes: []field.ErrorType{field.ErrorTypeInvalid},
+			wantField: "schemaVersion",
+		}),
+		Entry("panel without position and type", dashboardCase{
+			raw:       dashboard(`, "panels": [{"title": "p"}]`),
+			wantTypes: []field.ErrorType{field.ErrorTypeRequired, field.ErrorTypeRequired},
+		}),
+		Entry("namespace datasources", dashboardCase{
+			raw: dashboard(`, "panels": [` +
+				panel(`, "datasource": "team-a-prod"`) + `,` +
+				panel(`, "datasource": {"type": "prometheus", "uid": "ds-uid"}`) + `,` +
+				panel(`, "datasource": "$datasource", "targets": [{"refId": "A", "datasource": {"uid": "__expr__"}}]`) + `,` +
+				panel(`, "datasource": null`) + `]`),
+		}),
+		Entry("other datasource", dashboardCase{
+			raw:       dashboard(`, "panels": [` + panel(`, "datasource": "team-b-prod"`) + `]`),
+			wantTypes: []field.ErrorType{field.ErrorTypeInvalid},
+			wantField: "panels[0].datasource",
+		}),
+		Entry("other datasource of a query", dashboardCase{
+			raw:       dashboard(`, "panels": [` + panel(`, "targets": [{"refId": "A", "datasource": {"uid": "other"}}]`) + `]`),
+			wantTypes: []field.ErrorType{field.ErrorTypeInvalid},
+			wantField: "panels[0].targets[0].datasource",
+		}),
+		Entry("other datasource in a collapsed row", dashboardCase{
+			raw:       dashboard(`, "panels": [{"type": "row", "gridPos": {}, "panels": [` + panel(`, "datasource": "other"`) + `]}]`),
+			wantTypes: []field.ErrorType{field.ErrorTypeInvalid},
+			wantField: "panels[0].panels[0].datasource",
+		}),
+		Entry("library panel", dashboardCase{raw: dashboard(`, "panels": [{"gridPos": {}, "libraryPanel": {"uid": "lib"}, "datasource": "other"}]`)}),
+		Entry("other datasource of a variable", dashboardCase{
+			raw:       dashboard(`, "panels": [], "templating": {"list": [{"name": "pod", "datasource": "other"}]}`),
+			wantTypes: []field.ErrorType{field.ErrorTypeInvalid},
+			wantField: "templating.list[0].datasource",
+		}),
+		Entry("builtin annotation datasource", dashboardCase{raw: dashboard(`, "panels": [], "annotations": {"list": [{"name": "Annotations", "datasource": "-- Grafana --"}]}`)}),
+	)
+
+	It("locates invalid JSON", func() {
+		errs := validateDashboard(field.NewPath("data"), "{\n  \"title\": }", datasourceRefs{})
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Detail).To(ContainSubstring("line 2, column 12"))
+	})
+})
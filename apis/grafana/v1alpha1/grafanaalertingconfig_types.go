@@ -0,0 +1,165 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GrafanaAlertingConfigSpec defines the contact points and the notification
+// policy of a namespace in its team org.
+type GrafanaAlertingConfigSpec struct {
+	// ContactPoints are provisioned in the team org as <namespace>-<name>.
+	// +optional
+	ContactPoints []ContactPoint `json:"contactPoints,omitempty"`
+
+	// Route is the notification policy of the alerts of the namespace. It is
+	// added to the team policy tree matching the namespace label.
+	// +optional
+	Route *NotificationRoute `json:"route,omitempty"`
+}
+
+// ContactPoint is a Grafana contact point. Exactly one of slack, webhook and
+// email is set.
+type ContactPoint struct {
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// +optional
+	Slack *SlackContactPoint `json:"slack,omitempty"`
+	// +optional
+	Webhook *WebhookContactPoint `json:"webhook,omitempty"`
+	// +optional
+	Email *EmailContactPoint `json:"email,omitempty"`
+
+	// DisableResolveMessage stops the notification sent when an alert resolves.
+	// +optional
+	DisableResolveMessage bool `json:"disableResolveMessage,omitempty"`
+}
+
+// SlackContactPoint posts to Slack with either an incoming webhook URL or a
+// bot token, both read from a Secret of the namespace.
+type SlackContactPoint struct {
+	// Recipient is the channel or user, required with a token.
+	// +optional
+	Recipient string `json:"recipient,omitempty"`
+	// URLSecretRef selects the incoming webhook URL.
+	// +optional
+	URLSecretRef *corev1.SecretKeySelector `json:"urlSecretRef,omitempty"`
+	// TokenSecretRef selects the bot token.
+	// +optional
+	TokenSecretRef *corev1.SecretKeySelector `json:"tokenSecretRef,omitempty"`
+	// +optional
+	Title string `json:"title,omitempty"`
+	// +optional
+	Text string `json:"text,omitempty"`
+}
+
+// WebhookContactPoint posts the alerts to an HTTP endpoint.
+type WebhookContactPoint struct {
+	URL string `json:"url"`
+	// +kubebuilder:validation:Enum=POST;PUT
+	// +optional
+	HTTPMethod string `json:"httpMethod,omitempty"`
+	// AuthorizationSecretRef selects the credentials sent in the
+	// Authorization header with the Bearer scheme.
+	// +optional
+	AuthorizationSecretRef *corev1.SecretKeySelector `json:"authorizationSecretRef,omitempty"`
+}
+
+// EmailContactPoint mails the alerts through the SMTP server of Grafana.
+type EmailContactPoint struct {
+	// +kubebuilder:validation:MinItems=1
+	Addresses []string `json:"addresses"`
+	// SingleEmail sends one email to all addresses.
+	// +optional
+	SingleEmail bool `json:"singleEmail,omitempty"`
+}
+
+// NotificationRoute is a node of the notification policy tree.
+type NotificationRoute struct {
+	// Receiver is the name of a contact point of this GrafanaAlertingConfig.
+	// +optional
+	Receiver string `json:"receiver,omitempty"`
+	// Matchers select the alerts of a nested route, the namespace matcher is
+	// added to the route of the namespace.
+	// +optional
+	Matchers []RouteMatcher `json:"matchers,omitempty"`
+	// +optional
+	GroupBy []string `json:"groupBy,omitempty"`
+	// +optional
+	GroupWait string `json:"groupWait,omitempty"`
+	// +optional
+	GroupInterval string `json:"groupInterval,omitempty"`
+	// +optional
+	RepeatInterval string `json:"repeatInterval,omitempty"`
+	// Continue matching the sibling routes after this one matched.
+	// +optional
+	Continue bool `json:"continue,omitempty"`
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +optional
+	Routes []NotificationRoute `json:"routes,omitempty"`
+}
+
+// RouteMatcher matches an alert label.
+type RouteMatcher struct {
+	Label string `json:"label"`
+	// +kubebuilder:validation:Enum="=";"!=";"=~";"!~"
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// GrafanaAlertingConfigStatus defines the observed state of GrafanaAlertingConfig
+type GrafanaAlertingConfigStatus struct {
+	// ContactPoints are the UIDs of the contact points provisioned in Grafana.
+	// +optional
+	ContactPoints []string `json:"contactPoints,omitempty"`
+	// OrgID is the team org the contact points are provisioned in.
+	// +optional
+	OrgID int64 `json:"orgID,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// GrafanaAlertingConfig is the Schema for the grafanaalertingconfigs API
+type GrafanaAlertingConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GrafanaAlertingConfigSpec   `json:"spec,omitempty"`
+	Status GrafanaAlertingConfigStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GrafanaAlertingConfigList contains a list of GrafanaAlertingConfig
+type GrafanaAlertingConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GrafanaAlertingConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GrafanaAlertingConfig{}, &GrafanaAlertingConfigList{})
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GrafanaInstanceSpec locates a Grafana and the credentials of the operator
+// in it.
+type GrafanaInstanceSpec struct {
+	// URL of the Grafana, e.g. https://grafana.example.com.
+	// +kubebuilder:validation:Pattern=`^https?://`
+	URL string `json:"url"`
+
+	// CredentialsSecretRef is a Secret with the keys of the operator
+	// credentials Secret: grafana-username and grafana-password, or
+	// grafana-token and grafana-token-org-<org ID>.
+	CredentialsSecretRef SecretReference `json:"credentialsSecretRef"`
+
+	// +optional
+	TLS *InstanceTLS `json:"tls,omitempty"`
+
+	// Default marks the instance used by namespaces selecting none, instead
+	// of the Grafana of the operator configuration.
+	// +optional
+	Default bool `json:"default,omitempty"`
+}
+
+// SecretReference points to a Secret, or a key of it.
+type SecretReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Key of the Secret, where a single value is read.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// InstanceTLS configures the TLS connections to the Grafana.
+type InstanceTLS struct {
+	// CASecretRef is a PEM CA bundle verifying the Grafana certificate, the
+	// key defaults to ca.crt.
+	// +optional
+	CASecretRef *SecretReference `json:"caSecretRef,omitempty"`
+	// InsecureSkipVerify disables the verification of the Grafana certificate.
+	// +optional
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// GrafanaInstanceStatus defines the observed state of GrafanaInstance
+type GrafanaInstanceStatus struct {
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="URL",type="string",JSONPath=".spec.url"
+//+kubebuilder:printcolumn:name="Default",type="boolean",JSONPath=".spec.default"
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// GrafanaInstance is a Grafana the operator manages, selected by namespaces
+// and GrafanaUsers with the grafana.snappcloud.io/instance label or annotation.
+type GrafanaInstance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GrafanaInstanceSpec   `json:"spec,omitempty"`
+	Status GrafanaInstanceStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GrafanaInstanceList contains a list of GrafanaInstance
+type GrafanaInstanceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GrafanaInstance `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GrafanaInstance{}, &GrafanaInstanceList{})
+}
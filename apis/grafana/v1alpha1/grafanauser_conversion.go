@@ -0,0 +1,150 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+)
+
+// v1beta1SpecAnnotation keeps the v1beta1 fields v1alpha1 cannot hold, the
+// member options and groups, so objects survive a round trip through v1alpha1.
+const v1beta1SpecAnnotation = "grafana.snappcloud.io/v1beta1-spec"
+
+var _ conversion.Convertible = &GrafanaUser{}
+
+// ConvertTo converts this GrafanaUser to the v1beta1 hub version.
+func (src *GrafanaUser) ConvertTo(dstRaw conversion.Hub) error {
+	dst, ok := dstRaw.(*v1beta1.GrafanaUser)
+	if !ok {
+		return fmt.Errorf("expected a v1beta1 GrafanaUser but got a %T", dstRaw)
+	}
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Status.Pending = append([]string(nil), src.Status.Pending...)
+
+	saved, err := src.savedSpec()
+	if err != nil {
+		return err
+	}
+	if _, ok := dst.Annotations[v1beta1SpecAnnotation]; ok {
+		delete(dst.Annotations, v1beta1SpecAnnotation)
+		if len(dst.Annotations) == 0 {
+			dst.Annotations = nil
+		}
+	}
+	options := map[string]v1beta1.Member{}
+	for _, member := range saved.Members {
+		options[NormalizeUser(member.Name())] = member
+	}
+
+	dst.Spec = v1beta1.GrafanaUserSpec{Groups: saved.Groups}
+	for _, list := range []struct {
+		users []string
+		role  v1beta1.Role
+	}{
+		{src.Spec.Admin, v1beta1.RoleAdmin},
+		{src.Spec.Edit, v1beta1.RoleEditor},
+		{src.Spec.View, v1beta1.RoleViewer},
+	} {
+		for _, user := range list.users {
+			member := v1beta1.Member{Role: list.role}
+			if strings.Contains(user, "@") {
+				member.Email = user
+			} else {
+				member.Login = user
+			}
+			if saved, ok := options[NormalizeUser(user)]; ok {
+				// v1alpha1 holds normalized emails, the saved one keeps the
+				// casing of the v1beta1 object and the login next to it
+				if saved.Email != "" && NormalizeUser(saved.Email) == NormalizeUser(user) {
+					member.Email = saved.Email
+					if saved.Login != "" {
+						member.Login = saved.Login
+					}
+				}
+				member.ExpiresAt = saved.ExpiresAt
+				member.Reason = saved.Reason
+			}
+			dst.Spec.Members = append(dst.Spec.Members, member)
+		}
+	}
+	return nil
+}
+
+// ConvertFrom converts from the v1beta1 hub version to this version.
+func (dst *GrafanaUser) ConvertFrom(srcRaw conversion.Hub) error {
+	src, ok := srcRaw.(*v1beta1.GrafanaUser)
+	if !ok {
+		return fmt.Errorf("expected a v1beta1 GrafanaUser but got a %T", srcRaw)
+	}
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Status.Pending = append([]string(nil), src.Status.Pending...)
+
+	dst.Spec = GrafanaUserSpec{}
+	saved := v1beta1.GrafanaUserSpec{Groups: src.Spec.Groups}
+	for _, member := range src.Spec.Members {
+		switch member.Role {
+		case v1beta1.RoleAdmin:
+			dst.Spec.Admin = append(dst.Spec.Admin, member.Name())
+		case v1beta1.RoleEditor:
+			dst.Spec.Edit = append(dst.Spec.Edit, member.Name())
+		default:
+			dst.Spec.View = append(dst.Spec.View, member.Name())
+		}
+		// A login next to an email only fits in the annotation
+		if member.ExpiresAt != nil || member.Reason != "" || member.Email != "" && member.Login != "" {
+			saved.Members = append(saved.Members, v1beta1.Member{
+				Email:     member.Email,
+				Login:     member.Login,
+				Role:      member.Role,
+				ExpiresAt: member.ExpiresAt,
+				Reason:    member.Reason,
+			})
+		}
+	}
+	delete(dst.Annotations, v1beta1SpecAnnotation)
+	if len(saved.Members) == 0 && len(saved.Groups) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	dst.Annotations[v1beta1SpecAnnotation] = string(raw)
+	return nil
+}
+
+// savedSpec returns the v1beta1 fields kept in the annotation of r.
+func (r *GrafanaUser) savedSpec() (v1beta1.GrafanaUserSpec, error) {
+	saved := v1beta1.GrafanaUserSpec{}
+	raw, ok := r.Annotations[v1beta1SpecAnnotation]
+	if !ok {
+		return saved, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &saved); err != nil {
+		return saved, fmt.Errorf("decoding %s: %w", v1beta1SpecAnnotation, err)
+	}
+	return saved, nil
+}
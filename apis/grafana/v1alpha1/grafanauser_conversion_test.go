@@ -0,0 +1,138 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+)
+
+var _ = Describe("GrafanaUser conversion", func() {
+	// The annotation keeps the expiry as decoded by metav1.Time, in local time
+	expiresAt := metav1.NewTime(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC).Local())
+
+	DescribeTable("round trips through v1alpha1",
+		func(spec v1beta1.GrafanaUserSpec) {
+			hub := &v1beta1.GrafanaUser{
+				ObjectMeta: metav1.ObjectMeta{Name: "users", Namespace: "team-a", Labels: map[string]string{"app": "a"}},
+				Spec:       spec,
+				Status:     v1beta1.GrafanaUserStatus{Pending: []string{"viewer@snapp.cab"}},
+			}
+			spoke := &GrafanaUser{}
+			Expect(spoke.ConvertFrom(hub)).To(Succeed())
+			got := &v1beta1.GrafanaUser{}
+			Expect(spoke.ConvertTo(got)).To(Succeed())
+			Expect(got.ObjectMeta).To(Equal(hub.ObjectMeta))
+			Expect(got.Spec).To(Equal(hub.Spec))
+			Expect(got.Status).To(Equal(hub.Status))
+		},
+		Entry("empty", v1beta1.GrafanaUserSpec{}),
+		Entry("emails and logins", v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{
+			{Email: "admin@snapp.cab", Role: v1beta1.RoleAdmin},
+			{Login: "editor", Role: v1beta1.RoleEditor},
+			{Email: "viewer@snapp.cab", Role: v1beta1.RoleViewer},
+		}}),
+		Entry("email and login", v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{
+			{Email: "jane@snapp.cab", Login: "jane", Role: v1beta1.RoleEditor},
+		}}),
+		Entry("email casing", v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{
+			{Email: "Jane@Snapp.Cab", Role: v1beta1.RoleAdmin, ExpiresAt: &expiresAt},
+		}}),
+		Entry("member options", v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{
+			{Login: "oncall", Role: v1beta1.RoleAdmin, ExpiresAt: &expiresAt, Reason: "incident"},
+			{Email: "viewer@snapp.cab", Role: v1beta1.RoleViewer},
+		}}),
+		Entry("groups", v1beta1.GrafanaUserSpec{
+			Members: []v1beta1.Member{{Email: "admin@snapp.cab", Role: v1beta1.RoleAdmin}},
+			Groups:  []v1beta1.GroupRef{{Name: "sre", Role: v1beta1.RoleAdmin}, {Name: "dev", Role: v1beta1.RoleViewer}},
+		}),
+	)
+
+	DescribeTable("ConvertFrom saves what v1alpha1 cannot hold in an annotation",
+		func(spec v1beta1.GrafanaUserSpec, want GrafanaUserSpec, wantAnnotation bool) {
+			hub := &v1beta1.GrafanaUser{
+				// A stale annotation is replaced
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{v1beta1SpecAnnotation: "{}"}},
+				Spec:       spec,
+			}
+			spoke := &GrafanaUser{}
+			Expect(spoke.ConvertFrom(hub)).To(Succeed())
+			Expect(spoke.Spec).To(Equal(want))
+			_, saved := spoke.Annotations[v1beta1SpecAnnotation]
+			Expect(saved).To(Equal(wantAnnotation))
+		},
+		Entry("roles",
+			v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{
+				{Email: "admin@snapp.cab", Role: v1beta1.RoleAdmin},
+				{Login: "editor", Role: v1beta1.RoleEditor},
+				{Email: "viewer@snapp.cab", Role: v1beta1.RoleViewer},
+			}},
+			GrafanaUserSpec{Admin: []string{"admin@snapp.cab"}, Edit: []string{"editor"}, View: []string{"viewer@snapp.cab"}},
+			false),
+		Entry("email wins over login",
+			v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{{Email: "jane@snapp.cab", Login: "jane", Role: v1beta1.RoleViewer}}},
+			GrafanaUserSpec{View: []string{"jane@snapp.cab"}},
+			true),
+		Entry("groups",
+			v1beta1.GrafanaUserSpec{Groups: []v1beta1.GroupRef{{Name: "sre", Role: v1beta1.RoleEditor}}},
+			GrafanaUserSpec{},
+			true),
+	)
+
+	DescribeTable("ConvertTo restores the saved member options",
+		func(annotation string, spec GrafanaUserSpec, want v1beta1.GrafanaUserSpec) {
+			spoke := &GrafanaUser{Spec: spec}
+			if annotation != "" {
+				spoke.Annotations = map[string]string{v1beta1SpecAnnotation: annotation}
+			}
+			hub := &v1beta1.GrafanaUser{}
+			Expect(spoke.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec).To(Equal(want))
+			Expect(hub.Annotations).To(BeNil())
+		},
+		Entry("emails and logins", "",
+			GrafanaUserSpec{Admin: []string{"admin@snapp.cab"}, Edit: []string{"editor"}, View: []string{"viewer"}},
+			v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{
+				{Email: "admin@snapp.cab", Role: v1beta1.RoleAdmin},
+				{Login: "editor", Role: v1beta1.RoleEditor},
+				{Login: "viewer", Role: v1beta1.RoleViewer},
+			}}),
+		Entry("options of a moved member", `{"members":[{"login":"oncall","role":"Admin","reason":"incident"}]}`,
+			GrafanaUserSpec{View: []string{"OnCall"}},
+			v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{{Login: "OnCall", Role: v1beta1.RoleViewer, Reason: "incident"}}}),
+		Entry("saved email casing", `{"members":[{"email":"Jane@Snapp.Cab","role":"Admin","reason":"incident"}]}`,
+			GrafanaUserSpec{Admin: []string{"jane@snapp.cab"}},
+			v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{{Email: "Jane@Snapp.Cab", Role: v1beta1.RoleAdmin, Reason: "incident"}}}),
+		Entry("saved email and login", `{"members":[{"email":"Jane@Snapp.Cab","login":"jane","role":"Editor"}]}`,
+			GrafanaUserSpec{View: []string{"jane@snapp.cab"}},
+			v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{{Email: "Jane@Snapp.Cab", Login: "jane", Role: v1beta1.RoleViewer}}}),
+		Entry("options of a removed member", `{"members":[{"login":"oncall","role":"Admin","reason":"incident"}]}`,
+			GrafanaUserSpec{View: []string{"viewer"}},
+			v1beta1.GrafanaUserSpec{Members: []v1beta1.Member{{Login: "viewer", Role: v1beta1.RoleViewer}}}),
+	)
+
+	It("refuses an invalid saved spec", func() {
+		spoke := &GrafanaUser{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{v1beta1SpecAnnotation: "{"}}}
+		Expect(spoke.ConvertTo(&v1beta1.GrafanaUser{})).NotTo(Succeed())
+	})
+})
@@ -33,6 +33,13 @@ type GrafanaUserSpec struct {
 	View  []string `json:"view,omitempty"`
 }
 
+// GrafanaUserStatus defines the observed state of GrafanaUser
+type GrafanaUserStatus struct {
+	// Pending lists the users which do not exist in Grafana yet, they are
+	// added to the team org once they log in to Grafana.
+	Pending []string `json:"pending,omitempty"`
+}
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 
@@ -40,7 +47,8 @@ type GrafanaUserSpec struct {
 type GrafanaUser struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
-	Spec              GrafanaUserSpec `json:"spec,omitempty"`
+	Spec              GrafanaUserSpec   `json:"spec,omitempty"`
+	Status            GrafanaUserStatus `json:"status,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -19,108 +19,468 @@ package v1alpha1
 import (
 	"context"
 	"fmt"
+	"net/mail"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/grafana-tools/sdk"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/env"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
 )
 
 // log is for logging in this package.
 var grafanauserlog = logf.Log.WithName("grafanauser-resource")
 
-// Get Grafana URL and PassWord as a env.
-var grafanaPassword = os.Getenv("GRAFANA_PASSWORD")
-var grafanaUsername = os.Getenv("GRAFANA_USERNAME")
-var grafanaURL = os.Getenv("GRAFANA_URL")
+// Get the email domains allowed in GrafanaUsers as a env, comma separated.
+// Any domain is allowed when it is empty.
+var allowedDomains = env.List("GRAFANAUSER_ALLOWED_DOMAINS")
+
+// Get the maximum number of users of each GrafanaUser list as a env.
+var maxUsersPerList = env.Int("GRAFANAUSER_MAX_USERS", 100)
+
+// loginPattern matches the Grafana logins accepted in place of an email.
+var loginPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,189}$`)
+
+// Get the permission needed to change the admin list of a GrafanaUser as a
+// env: a verb on a resource, in kubectl auth can-i form. The default is granted
+// to namespace admins by the grafanauser-admin ClusterRole.
+var adminVerb = env.String("GRAFANAUSER_ADMIN_VERB", "admin")
+var adminResource = env.String("GRAFANAUSER_ADMIN_RESOURCE", "grafanausers.grafana.snappcloud.io")
+
+// Get whether GrafanaUsers listing users unknown to Grafana are rejected as a
+// env, instead of admitted with warnings. Namespaces override it with the
+// grafana.snappcloud.io/strict-users label.
+var strictUsers, _ = strconv.ParseBool(os.Getenv("GRAFANAUSER_STRICT"))
+
+// strictUsersLabel overrides GRAFANAUSER_STRICT for a namespace, "true" or "false".
+const strictUsersLabel = "grafana.snappcloud.io/strict-users"
 
-// Get Grafana URL and PassWord as a env.
+// Get how the Grafana users are looked up as a env: how long the user
+// directory is cached, how long a listing may take, which has to fit in the
+// admission timeout, and what to do with GrafanaUsers when Grafana is
+// unreachable: reject them, allow them with a warning, or allow them.
+var grafanaUsersCacheTTL = env.Duration("GRAFANA_USERS_CACHE_TTL", 5*time.Minute)
+var grafanaLookupTimeout = env.Duration("GRAFANA_LOOKUP_TIMEOUT", 5*time.Second)
+var grafanaUnreachablePolicy = env.String("GRAFANA_UNREACHABLE_POLICY", unreachablePolicyReject)
+
+const (
+	unreachablePolicyReject = "reject"
+	unreachablePolicyWarn   = "warn"
+	unreachablePolicyAllow  = "allow"
+)
 
 func (r *GrafanaUser) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	switch grafanaUnreachablePolicy {
+	case unreachablePolicyReject, unreachablePolicyWarn, unreachablePolicyAllow:
+	default:
+		return fmt.Errorf("unknown GRAFANA_UNREACHABLE_POLICY %q, expected %s, %s or %s",
+			grafanaUnreachablePolicy, unreachablePolicyReject, unreachablePolicyWarn, unreachablePolicyAllow)
+	}
+	users := grafana.NewUserDirectory(grafana.Instances, grafanaUsersCacheTTL, grafanaLookupTimeout)
+	if err := mgr.Add(users); err != nil {
+		return err
+	}
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
+		WithValidator(&GrafanaUserValidator{Client: mgr.GetClient(), Users: users}).
 		Complete()
 }
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
+//+kubebuilder:webhook:path=/mutate-grafana-snappcloud-io-v1alpha1-grafanauser,mutating=true,failurePolicy=fail,sideEffects=None,groups=grafana.snappcloud.io,resources=grafanausers,verbs=create;update,versions=v1alpha1,name=mgrafana.kb.io,admissionReviewVersions={v1,v1beta1}
 
 var _ webhook.Defaulter = &GrafanaUser{}
 
-// Default implements webhook.Defaulter so a webhook will be registered for the type
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// It lowercases and trims the users, keeps a user listed more than once only
+// in the highest role and sorts the lists.
 func (r *GrafanaUser) Default() {
 	grafanauserlog.Info("default", "name", r.Name)
 
-	// TODO(user): fill in your defaulting logic.
+	seen := map[string]bool{}
+	normalize := func(users []string) []string {
+		var normalized []string
+		for _, user := range users {
+			user = NormalizeUser(user)
+			if user == "" || seen[user] {
+				continue
+			}
+			seen[user] = true
+			normalized = append(normalized, user)
+		}
+		sort.Strings(normalized)
+		return normalized
+	}
+	r.Spec.Admin = normalize(r.Spec.Admin)
+	r.Spec.Edit = normalize(r.Spec.Edit)
+	r.Spec.View = normalize(r.Spec.View)
+}
+
+// NormalizeUser returns the canonical form of a GrafanaUser entry, Grafana
+// matches emails and logins case-insensitively.
+func NormalizeUser(user string) string {
+	return strings.ToLower(strings.TrimSpace(user))
 }
 
-// TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 //+kubebuilder:webhook:path=/validate-grafana-snappcloud-io-v1alpha1-grafanauser,mutating=false,failurePolicy=fail,sideEffects=None,groups=grafana.snappcloud.io,resources=grafanausers,verbs=create;update,versions=v1alpha1,name=vgrafana.kb.io,admissionReviewVersions={v1,v1beta1}
 
-var _ webhook.Validator = &GrafanaUser{}
+// GrafanaUserValidator validates GrafanaUsers with the requester at hand, so
+// the admin list is only changed by users allowed to grant Grafana Admin.
+// +kubebuilder:object:generate=false
+type GrafanaUserValidator struct {
+	Client client.Client
+	Users  *grafana.UserDirectory
+}
+
+var _ webhook.CustomValidator = &GrafanaUserValidator{}
 
-// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
-func (r *GrafanaUser) ValidateCreate() error {
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaUserValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	r, ok := obj.(*GrafanaUser)
+	if !ok {
+		return nil, fmt.Errorf("expected a GrafanaUser but got a %T", obj)
+	}
 	grafanauserlog.Info("validate create", "name", r.Name)
-	// TODO(user): fill in your validation logic upon object creation.
-	var emaillist []string
-	emaillist = append(r.Spec.Admin, r.Spec.Edit...)
-	emaillist = append(emaillist, r.Spec.View...)
-	str2 := strings.Join(emaillist, ", ")
-	grafanauserlog.Info(str2)
-	err := r.ValidateEmailExist(context.Background(), emaillist)
+	return v.validateGrafanaUser(ctx, r, &GrafanaUser{})
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaUserValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	r, ok := newObj.(*GrafanaUser)
+	if !ok {
+		return nil, fmt.Errorf("expected a GrafanaUser but got a %T", newObj)
+	}
+	old, ok := oldObj.(*GrafanaUser)
+	if !ok {
+		return nil, fmt.Errorf("expected a GrafanaUser but got a %T", oldObj)
+	}
+	grafanauserlog.Info("validate update", "name", r.Name)
+	return v.validateGrafanaUser(ctx, r, old)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaUserValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// userEntry is a user of one of the lists with its path in the object.
+// +kubebuilder:object:generate=false
+type userEntry struct {
+	path  *field.Path
+	value string
+}
+
+// userList is one of the user lists of the spec.
+// +kubebuilder:object:generate=false
+type userList struct {
+	name  string
+	users []string
+}
+
+// lists returns the admin, edit and view lists, highest role first.
+func (r *GrafanaUser) lists() []userList {
+	return []userList{{"admin", r.Spec.Admin}, {"edit", r.Spec.Edit}, {"view", r.Spec.View}}
+}
+
+// entries returns the users of the admin, edit and view lists.
+func (r *GrafanaUser) entries() []userEntry {
+	var entries []userEntry
+	specPath := field.NewPath("spec")
+	for _, list := range r.lists() {
+		for i, user := range list.users {
+			entries = append(entries, userEntry{path: specPath.Child(list.name).Index(i), value: user})
+		}
+	}
+	return entries
+}
+
+// validateGrafanaUser checks the requester may change the admins, and
+// returns every violation of the GrafanaUser as a field error: list sizes,
+// email and login syntax, allowed domains, duplicates, the v1beta1 fields,
+// the team label of the namespace and users missing from Grafana.
+func (v *GrafanaUserValidator) validateGrafanaUser(ctx context.Context, r, old *GrafanaUser) (admission.Warnings, error) {
+	errs := validateSavedSpec(ctx, r, old)
+	if len(errs) > 0 {
+		return nil, apierrors.NewInvalid(GroupVersion.WithKind("GrafanaUser").GroupKind(), r.Name, errs)
+	}
+	err := v.authorizeAdminChanges(ctx, r, old)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	specPath := field.NewPath("spec")
+	for _, list := range r.lists() {
+		if len(list.users) > maxUsersPerList {
+			errs = append(errs, field.TooMany(specPath.Child(list.name), len(list.users), maxUsersPerList))
+		}
+	}
+
+	var valid []userEntry
+	seen := map[string]*field.Path{}
+	for _, entry := range r.entries() {
+		if err := validateUser(entry); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if first, ok := seen[NormalizeUser(entry.value)]; ok {
+			errs = append(errs, field.Invalid(entry.path, entry.value, "duplicate of "+first.String()))
+			continue
+		}
+		seen[NormalizeUser(entry.value)] = entry.path
+		valid = append(valid, entry)
+	}
+
+	strict, instance, nsErrs := v.validateNamespace(ctx, r)
+	errs = append(errs, nsErrs...)
+	var warnings admission.Warnings
+	if len(errs) == 0 {
+		var existErrs field.ErrorList
+		warnings, existErrs = v.validateUsersExist(ctx, instance, valid, strict)
+		errs = append(errs, existErrs...)
 	}
-	return nil
+	if len(errs) > 0 {
+		return warnings, apierrors.NewInvalid(GroupVersion.WithKind("GrafanaUser").GroupKind(), r.Name, errs)
+	}
+	return warnings, nil
 }
 
-// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
-func (r *GrafanaUser) ValidateUpdate(old runtime.Object) error {
-	grafanauserlog.Info("validate update", "name", r.Name)
-	var emaillist []string
-	emaillist = append(r.Spec.Admin, r.Spec.Edit...)
-	emaillist = append(emaillist, r.Spec.View...)
-	err := r.ValidateEmailExist(context.Background(), emaillist)
+// validateSavedSpec checks the v1beta1 fields kept in the annotation of r:
+// only the API server may change it, when converting a v1beta1 request, and
+// its groups must name distinct Grafana teams with a known role.
+func validateSavedSpec(ctx context.Context, r, old *GrafanaUser) field.ErrorList {
+	path := field.NewPath("metadata", "annotations").Key(v1beta1SpecAnnotation)
+	raw := r.Annotations[v1beta1SpecAnnotation]
+	if req, err := admission.RequestFromContext(ctx); err == nil && fromV1alpha1(req) && raw != old.Annotations[v1beta1SpecAnnotation] {
+		return field.ErrorList{field.Forbidden(path, "is written when v1beta1 GrafanaUsers are converted, edit the object as v1beta1 instead")}
+	}
+	saved, err := r.savedSpec()
 	if err != nil {
-		return err
+		return field.ErrorList{field.Invalid(path, raw, err.Error())}
+	}
+
+	var errs field.ErrorList
+	groupsPath := field.NewPath("spec", "groups")
+	if len(saved.Groups) > maxUsersPerList {
+		errs = append(errs, field.TooMany(groupsPath, len(saved.Groups), maxUsersPerList))
+	}
+	seen := map[string]*field.Path{}
+	for i, group := range saved.Groups {
+		groupPath := groupsPath.Index(i)
+		name := strings.TrimSpace(group.Name)
+		if name == "" {
+			errs = append(errs, field.Required(groupPath.Child("name"), "the name of a Grafana team of the team org"))
+		} else if first, ok := seen[strings.ToLower(name)]; ok {
+			errs = append(errs, field.Invalid(groupPath.Child("name"), group.Name, "duplicate of "+first.String()))
+		} else {
+			seen[strings.ToLower(name)] = groupPath
+		}
+		switch group.Role {
+		case v1beta1.RoleAdmin, v1beta1.RoleEditor, v1beta1.RoleViewer:
+		default:
+			errs = append(errs, field.NotSupported(groupPath.Child("role"), group.Role,
+				[]string{string(v1beta1.RoleAdmin), string(v1beta1.RoleEditor), string(v1beta1.RoleViewer)}))
+		}
+	}
+	return errs
+}
+
+// fromV1alpha1 reports whether the request was made against v1alpha1 rather
+// than converted from v1beta1 by the API server.
+func fromV1alpha1(req admission.Request) bool {
+	return req.RequestKind == nil || req.RequestKind.Version == GroupVersion.Version
+}
+
+// validateUser checks an entry is an email of an allowed domain or a login.
+func validateUser(entry userEntry) *field.Error {
+	if !strings.Contains(entry.value, "@") {
+		if !loginPattern.MatchString(entry.value) {
+			return field.Invalid(entry.path, entry.value, "must be an email or a Grafana login of letters, digits, '.', '_' and '-'")
+		}
+		return nil
+	}
+	addr, err := mail.ParseAddress(entry.value)
+	if err != nil || addr.Address != entry.value {
+		return field.Invalid(entry.path, entry.value, "must be a bare email address")
+	}
+	if len(allowedDomains) == 0 {
+		return nil
+	}
+	domain := strings.ToLower(entry.value[strings.LastIndex(entry.value, "@")+1:])
+	for _, allowed := range allowedDomains {
+		if domain == strings.ToLower(allowed) {
+			return nil
+		}
+	}
+	return field.NotSupported(entry.path, entry.value, allowedDomains)
+}
+
+// validateNamespace checks the namespace has a team, the team org is where
+// the users are added, and the Grafana instance of the GrafanaUser exists.
+// It also reports whether unknown users are rejected in the namespace and the
+// instance.
+func (v *GrafanaUserValidator) validateNamespace(ctx context.Context, r *GrafanaUser) (bool, string, field.ErrorList) {
+	path := field.NewPath("metadata", "namespace")
+	ns := &corev1.Namespace{}
+	err := v.Client.Get(ctx, client.ObjectKey{Name: r.Namespace}, ns)
+	if err != nil {
+		return false, "", field.ErrorList{field.InternalError(path, err)}
+	}
+	strict := strictUsers
+	if value, ok := ns.Labels[strictUsersLabel]; ok {
+		strict, _ = strconv.ParseBool(value)
 	}
-	// TODO(user): fill in your validation logic upon object update.
-	return nil
+	instance := grafana.InstanceOf(r, ns)
+	if _, ok := ns.Labels[grafana.TeamLabel]; !ok {
+		return strict, instance, field.ErrorList{field.Invalid(path, r.Namespace, "namespace has no "+grafana.TeamLabel+" label, ask the cluster admins to onboard it")}
+	}
+	if _, err := grafana.Instances.Get(instance); err != nil {
+		instancePath := path
+		if _, ok := r.Labels[grafana.InstanceLabel]; ok {
+			instancePath = field.NewPath("metadata", "labels").Key(grafana.InstanceLabel)
+		} else if _, ok := r.Annotations[grafana.InstanceLabel]; ok {
+			instancePath = field.NewPath("metadata", "annotations").Key(grafana.InstanceLabel)
+		}
+		return strict, instance, field.ErrorList{field.Invalid(instancePath, instance, "no GrafanaInstance of this name is loaded")}
+	}
+	return strict, instance, nil
+}
+
+// authorizeAdminChanges refuses the admins added or removed by a requester
+// lacking the admin permission in the namespace.
+func (v *GrafanaUserValidator) authorizeAdminChanges(ctx context.Context, r, old *GrafanaUser) error {
+	changed := changedUsers(old.admins(), r.admins())
+	if len(changed) == 0 {
+		return nil
+	}
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	resource := schema.ParseGroupResource(adminResource)
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: r.Namespace,
+				Verb:      adminVerb,
+				Group:     resource.Group,
+				Resource:  resource.Resource,
+				Name:      r.Name,
+			},
+			User:   req.UserInfo.Username,
+			Groups: req.UserInfo.Groups,
+			UID:    req.UserInfo.UID,
+			Extra:  map[string]authorizationv1.ExtraValue{},
+		},
+	}
+	for key, value := range req.UserInfo.Extra {
+		sar.Spec.Extra[key] = authorizationv1.ExtraValue(value)
+	}
+	err = v.Client.Create(ctx, sar)
+	if err != nil {
+		return apierrors.NewInternalError(fmt.Errorf("reviewing access of %s: %w", req.UserInfo.Username, err))
+	}
+	if sar.Status.Allowed {
+		return nil
+	}
+	grafanauserlog.Info("admin change refused", "namespace", r.Namespace, "name", r.Name, "user", req.UserInfo.Username, "entries", changed)
+	return apierrors.NewForbidden(GroupVersion.WithResource("grafanausers").GroupResource(), r.Name,
+		fmt.Errorf("%s may not grant or revoke Grafana Admin in namespace %s, refused admins: %s; this needs %q on %q",
+			req.UserInfo.Username, r.Namespace, strings.Join(changed, ", "), adminVerb, adminResource))
 }
 
-// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
-func (r *GrafanaUser) ValidateDelete() error {
-	grafanauserlog.Info("validate delete", "name", r.Name)
-	// TODO(user): fill in your validation logic upon object deletion.
-	return nil
+// admins returns the effective admins of r: the admin entries, which hold
+// the Admin members of v1beta1, and the groups granted Admin as group:<name>.
+func (r *GrafanaUser) admins() []string {
+	admins := append([]string(nil), r.Spec.Admin...)
+	// An annotation which does not decode is refused before
+	saved, _ := r.savedSpec()
+	for _, group := range saved.Groups {
+		if group.Role == v1beta1.RoleAdmin {
+			admins = append(admins, "group:"+group.Name)
+		}
+	}
+	return admins
 }
 
-func Find(slice []sdk.User, val string) bool {
-	for _, item := range slice {
-		if item.Email == val {
-			return true
+// changedUsers returns the users of after not in before and the users of
+// before not in after, sorted.
+func changedUsers(before, after []string) []string {
+	count := map[string]int{}
+	for _, user := range before {
+		count[NormalizeUser(user)] |= 1
+	}
+	for _, user := range after {
+		count[NormalizeUser(user)] |= 2
+	}
+	var changed []string
+	for user, in := range count {
+		if in != 3 {
+			changed = append(changed, user)
 		}
 	}
-	return false
+	sort.Strings(changed)
+	return changed
 }
 
-func (r *GrafanaUser) ValidateEmailExist(ctx context.Context, emails []string) error {
-	client, _ := sdk.NewClient(grafanaURL, fmt.Sprintf("%s:%s", grafanaUsername, grafanaPassword), sdk.DefaultHTTPClient)
-	grafanalUsers, _ := client.GetAllUsers(ctx)
-	var Users []string
-	for _, email := range emails {
-		found := Find(grafanalUsers, email)
-		if !found {
-			Users = append(Users, email)
+// validateUsersExist checks the users have an account in the Grafana of
+// instance, matching either the email or the login. Unknown users are pending
+// until their first login and only reported as warnings, unless strict. When Grafana cannot be
+// reached the users are handled by the unreachable policy.
+func (v *GrafanaUserValidator) validateUsersExist(ctx context.Context, instance string, entries []userEntry, strict bool) (admission.Warnings, field.ErrorList) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	values := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		values = append(values, entry.value)
+	}
+	missing, err := v.Users.Missing(ctx, instance, values)
+	if err != nil {
+		grafanauserlog.Error(err, "Unable to look up Grafana users", "policy", grafanaUnreachablePolicy, "users", missing)
+		// Strictness is about users known not to exist, the unreachable
+		// policy alone decides when they could not be checked
+		switch grafanaUnreachablePolicy {
+		case unreachablePolicyAllow:
+			return nil, nil
+		case unreachablePolicyWarn:
+			return admission.Warnings{fmt.Sprintf("Grafana is unreachable, %s could not be checked and are added once they exist in Grafana", strings.Join(missing, ", "))}, nil
+		default:
+			return nil, field.ErrorList{field.InternalError(field.NewPath("spec"), fmt.Errorf("Grafana is unreachable, %s could not be checked: %w", strings.Join(missing, ", "), err))}
 		}
 	}
-	userlist := strings.Join(Users, ", ")
-	if len(Users) > 0 {
-		return fmt.Errorf("%q do NOT exist in grafana, please make sure the user name is correct, or they have login at least one time in grafana and then try again", userlist)
 
+	isMissing := map[string]bool{}
+	for _, user := range missing {
+		isMissing[user] = true
+	}
+	var warnings admission.Warnings
+	var errs field.ErrorList
+	for _, entry := range entries {
+		if !isMissing[entry.value] {
+			continue
+		}
+		if strict {
+			errs = append(errs, field.Invalid(entry.path, entry.value, "user does NOT exist in Grafana, make sure it is correct or that they logged in to Grafana at least once"))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("%s: %s does not exist in Grafana yet, they are added once they log in to Grafana", entry.path, entry.value))
+		}
 	}
-	return nil
+	return warnings, errs
 }
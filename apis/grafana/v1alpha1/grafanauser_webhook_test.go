@@ -0,0 +1,288 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ = Describe("GrafanaUser defaulting", func() {
+	DescribeTable("NormalizeUser",
+		func(user, want string) {
+			Expect(NormalizeUser(user)).To(Equal(want))
+		},
+		Entry("email", "jane@snapp.cab", "jane@snapp.cab"),
+		Entry("case and spaces", "  Jane@Snapp.Cab ", "jane@snapp.cab"),
+		Entry("login", "John.Doe", "john.doe"),
+		Entry("blank", " ", ""),
+	)
+
+	DescribeTable("Default",
+		func(spec, want GrafanaUserSpec) {
+			r := &GrafanaUser{Spec: spec}
+			r.Default()
+			Expect(r.Spec).To(Equal(want))
+		},
+		Entry("empty", GrafanaUserSpec{}, GrafanaUserSpec{}),
+		Entry("normalized and sorted",
+			GrafanaUserSpec{Admin: []string{"Zed@snapp.cab", " amy "}, View: []string{"bob", "Al"}},
+			GrafanaUserSpec{Admin: []string{"amy", "zed@snapp.cab"}, View: []string{"al", "bob"}}),
+		Entry("duplicates kept once",
+			GrafanaUserSpec{Edit: []string{"bob", "BOB", " bob"}},
+			GrafanaUserSpec{Edit: []string{"bob"}}),
+		Entry("highest role wins",
+			GrafanaUserSpec{Admin: []string{"jane"}, Edit: []string{"Jane", "bob"}, View: []string{"bob", "al"}},
+			GrafanaUserSpec{Admin: []string{"jane"}, Edit: []string{"bob"}, View: []string{"al"}}),
+		Entry("blank entries dropped",
+			GrafanaUserSpec{View: []string{"", "  "}},
+			GrafanaUserSpec{}),
+	)
+})
+
+// adminChangeCase is an update of a GrafanaUser and how its admin changes
+// are authorized.
+type adminChangeCase struct {
+	old        GrafanaUserSpec
+	spec       GrafanaUserSpec
+	noRequest  bool
+	allowed    bool
+	reviewErr  error
+	wantReview bool
+	wantErr    func(error) bool
+}
+
+var _ = Describe("GrafanaUser admin changes", func() {
+	DescribeTable("changedUsers",
+		func(before, after, want []string) {
+			Expect(changedUsers(before, after)).To(Equal(want))
+		},
+		Entry("none", nil, nil, []string(nil)),
+		Entry("unchanged", []string{"jane", "bob"}, []string{"bob", "jane"}, []string(nil)),
+		Entry("case and spaces", []string{"Jane@snapp.cab"}, []string{" jane@snapp.cab"}, []string(nil)),
+		Entry("added", []string{"jane"}, []string{"jane", "Bob"}, []string{"bob"}),
+		Entry("removed", []string{"jane", "bob"}, []string{"jane"}, []string{"bob"}),
+		Entry("replaced", []string{"jane"}, []string{"bob"}, []string{"bob", "jane"}),
+	)
+
+	request := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UserInfo: authenticationv1.UserInfo{Username: "jane", Groups: []string{"team-a"}},
+	}}
+
+	DescribeTable("authorizeAdminChanges",
+		func(tt adminChangeCase) {
+			var review *authorizationv1.SubjectAccessReview
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithInterceptorFuncs(interceptor.Funcs{
+				Create: func(_ context.Context, _ client.WithWatch, obj client.Object, _ ...client.CreateOption) error {
+					review = obj.(*authorizationv1.SubjectAccessReview)
+					review.Status.Allowed = tt.allowed
+					return tt.reviewErr
+				},
+			}).Build()
+			v := &GrafanaUserValidator{Client: c}
+			ctx := context.Background()
+			if !tt.noRequest {
+				ctx = admission.NewContextWithRequest(ctx, request)
+			}
+			old := &GrafanaUser{Spec: tt.old}
+			r := &GrafanaUser{ObjectMeta: metav1.ObjectMeta{Name: "users", Namespace: "team-a"}, Spec: tt.spec}
+
+			err := v.authorizeAdminChanges(ctx, r, old)
+			if tt.wantErr == nil {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(tt.wantErr(err)).To(BeTrue(), "unexpected error %v", err)
+			}
+			if !tt.wantReview {
+				Expect(review).To(BeNil())
+				return
+			}
+			Expect(review).NotTo(BeNil())
+			Expect(review.Spec.User).To(Equal("jane"))
+			attributes := review.Spec.ResourceAttributes
+			Expect(attributes.Namespace).To(Equal("team-a"))
+			Expect(attributes.Name).To(Equal("users"))
+			Expect(attributes.Verb).To(Equal(adminVerb))
+		},
+		Entry("admins unchanged", adminChangeCase{
+			old:  GrafanaUserSpec{Admin: []string{"jane"}, View: []string{"bob"}},
+			spec: GrafanaUserSpec{Admin: []string{"jane"}, Edit: []string{"bob"}},
+		}),
+		Entry("admin added and allowed", adminChangeCase{
+			spec:       GrafanaUserSpec{Admin: []string{"jane"}},
+			allowed:    true,
+			wantReview: true,
+		}),
+		Entry("admin removed and refused", adminChangeCase{
+			old:        GrafanaUserSpec{Admin: []string{"jane"}},
+			wantReview: true,
+			wantErr:    apierrors.IsForbidden,
+		}),
+		Entry("review failed", adminChangeCase{
+			spec:       GrafanaUserSpec{Admin: []string{"jane"}},
+			reviewErr:  errors.New("unavailable"),
+			wantReview: true,
+			wantErr:    apierrors.IsInternalError,
+		}),
+		Entry("no admission request", adminChangeCase{
+			spec:      GrafanaUserSpec{Admin: []string{"jane"}},
+			noRequest: true,
+			wantErr:   apierrors.IsInternalError,
+		}),
+	)
+})
+
+var _ = Describe("GrafanaUser saved v1beta1 spec", func() {
+	DescribeTable("admins include the admin groups",
+		func(annotation string, spec GrafanaUserSpec, want []string) {
+			r := &GrafanaUser{Spec: spec}
+			if annotation != "" {
+				r.Annotations = map[string]string{v1beta1SpecAnnotation: annotation}
+			}
+			Expect(r.admins()).To(Equal(want))
+		},
+		Entry("none", "", GrafanaUserSpec{}, []string(nil)),
+		Entry("admin entries", "", GrafanaUserSpec{Admin: []string{"jane"}, Edit: []string{"bob"}}, []string{"jane"}),
+		Entry("admin groups", `{"groups":[{"name":"sre","role":"Admin"},{"name":"dev","role":"Editor"}]}`,
+			GrafanaUserSpec{Admin: []string{"jane"}}, []string{"jane", "group:sre"}),
+		Entry("invalid annotation", "{", GrafanaUserSpec{Admin: []string{"jane"}}, []string{"jane"}),
+	)
+
+	requestOf := func(version string) *admission.Request {
+		return &admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			RequestKind: &metav1.GroupVersionKind{Group: GroupVersion.Group, Version: version, Kind: "GrafanaUser"},
+		}}
+	}
+	const groups = `{"groups":[{"name":"sre","role":"Admin"}]}`
+
+	DescribeTable("validateSavedSpec",
+		func(request *admission.Request, old, saved string, wantTypes []field.ErrorType) {
+			ctx := context.Background()
+			if request != nil {
+				ctx = admission.NewContextWithRequest(ctx, *request)
+			}
+			annotated := func(saved string) *GrafanaUser {
+				r := &GrafanaUser{}
+				if saved != "" {
+					r.Annotations = map[string]string{v1beta1SpecAnnotation: saved}
+				}
+				return r
+			}
+			errs := validateSavedSpec(ctx, annotated(saved), annotated(old))
+			Expect(errorTypes(errs)).To(Equal(wantTypes), "%v", errs)
+		},
+		Entry("no annotation", requestOf("v1alpha1"), "", "", []field.ErrorType(nil)),
+		Entry("unchanged on v1alpha1", requestOf("v1alpha1"), groups, groups, []field.ErrorType(nil)),
+		Entry("changed on v1alpha1", requestOf("v1alpha1"), "", groups, []field.ErrorType{field.ErrorTypeForbidden}),
+		Entry("removed on v1alpha1", requestOf("v1alpha1"), groups, "", []field.ErrorType{field.ErrorTypeForbidden}),
+		Entry("changed on v1beta1", requestOf("v1beta1"), "", groups, []field.ErrorType(nil)),
+		Entry("changed without request", nil, "", groups, []field.ErrorType(nil)),
+		Entry("invalid", requestOf("v1beta1"), "", "{", []field.ErrorType{field.ErrorTypeInvalid}),
+		Entry("group without name", requestOf("v1beta1"), "", `{"groups":[{"name":" ","role":"Admin"}]}`,
+			[]field.ErrorType{field.ErrorTypeRequired}),
+		Entry("duplicate groups", requestOf("v1beta1"), "", `{"groups":[{"name":"sre","role":"Admin"},{"name":"SRE","role":"Viewer"}]}`,
+			[]field.ErrorType{field.ErrorTypeInvalid}),
+		Entry("unknown role", requestOf("v1beta1"), "", `{"groups":[{"name":"sre","role":"Owner"}]}`,
+			[]field.ErrorType{field.ErrorTypeNotSupported}),
+	)
+})
+
+// causesOf returns the type and field of the causes of an Invalid error.
+func causesOf(err error) []string {
+	var status apierrors.APIStatus
+	Expect(errors.As(err, &status)).To(BeTrue(), "unexpected error %v", err)
+	var causes []string
+	for _, cause := range status.Status().Details.Causes {
+		causes = append(causes, string(cause.Type)+" "+cause.Field)
+	}
+	return causes
+}
+
+var _ = Describe("GrafanaUser users", func() {
+	var previousDomains []string
+	var previousMax int
+	BeforeEach(func() {
+		previousDomains, previousMax = allowedDomains, maxUsersPerList
+		allowedDomains, maxUsersPerList = []string{"snapp.cab"}, 3
+	})
+	AfterEach(func() {
+		allowedDomains, maxUsersPerList = previousDomains, previousMax
+	})
+
+	// The namespace has no team, so the users are never looked up in Grafana
+	notOnboarded := "FieldValueInvalid metadata.namespace"
+
+	// validate validates r as a requester allowed to change the admins.
+	validate := func(r *GrafanaUser) error {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(ns).WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(_ context.Context, _ client.WithWatch, obj client.Object, _ ...client.CreateOption) error {
+				obj.(*authorizationv1.SubjectAccessReview).Status.Allowed = true
+				return nil
+			},
+		}).Build()
+		ctx := admission.NewContextWithRequest(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			UserInfo: authenticationv1.UserInfo{Username: "jane"},
+		}})
+		_, err := (&GrafanaUserValidator{Client: c}).validateGrafanaUser(ctx, r, &GrafanaUser{})
+		return err
+	}
+
+	DescribeTable("validateGrafanaUser reports every invalid user at its path",
+		func(spec GrafanaUserSpec, want []string) {
+			err := validate(&GrafanaUser{ObjectMeta: metav1.ObjectMeta{Name: "users", Namespace: "team-a"}, Spec: spec})
+			Expect(causesOf(err)).To(Equal(append(want, notOnboarded)))
+		},
+		Entry("valid", GrafanaUserSpec{Admin: []string{"jane@snapp.cab"}, View: []string{"john.doe"}}, []string(nil)),
+		Entry("invalid login", GrafanaUserSpec{Edit: []string{"jane", "jane doe"}},
+			[]string{"FieldValueInvalid spec.edit[1]"}),
+		Entry("display name", GrafanaUserSpec{View: []string{"Jane <jane@snapp.cab>"}},
+			[]string{"FieldValueInvalid spec.view[0]"}),
+		Entry("other domain", GrafanaUserSpec{Admin: []string{"jane@snapp.cab", "jane@example.com"}},
+			[]string{"FieldValueNotSupported spec.admin[1]"}),
+		Entry("duplicate in a list", GrafanaUserSpec{Edit: []string{"jane@snapp.cab", "Jane@Snapp.Cab"}},
+			[]string{"FieldValueInvalid spec.edit[1]"}),
+		Entry("duplicate across lists", GrafanaUserSpec{Admin: []string{"jane"}, View: []string{"bob", " JANE"}},
+			[]string{"FieldValueInvalid spec.view[1]"}),
+		Entry("too many", GrafanaUserSpec{View: []string{"a", "b", "c", "d"}},
+			[]string{"FieldValueTooMany spec.view"}),
+	)
+
+	It("validateGrafanaUser names the first entry of a duplicate", func() {
+		err := validate(&GrafanaUser{
+			ObjectMeta: metav1.ObjectMeta{Name: "users", Namespace: "team-a"},
+			Spec:       GrafanaUserSpec{Admin: []string{"jane"}, Edit: []string{"Jane"}},
+		})
+		Expect(err).To(MatchError(ContainSubstring("spec.edit[0]: Invalid value: \"Jane\": duplicate of spec.admin[0]")))
+	})
+})
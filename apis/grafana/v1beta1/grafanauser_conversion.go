@@ -0,0 +1,34 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// Hub marks v1beta1 as the version GrafanaUsers are converted through.
+func (*GrafanaUser) Hub() {}
+
+// SetupWebhookWithManager serves the conversion of GrafanaUsers on /convert
+// and the checks of the members v1alpha1 cannot hold, admission of both
+// versions is otherwise handled by the v1alpha1 webhooks.
+func (r *GrafanaUser) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithValidator(&GrafanaUserValidator{}).
+		Complete()
+}
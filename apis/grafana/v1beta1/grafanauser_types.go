@@ -0,0 +1,112 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Role is the Grafana org role granted to a member or group.
+// +kubebuilder:validation:Enum=Admin;Editor;Viewer
+type Role string
+
+const (
+	RoleAdmin  Role = "Admin"
+	RoleEditor Role = "Editor"
+	RoleViewer Role = "Viewer"
+)
+
+// Member is a Grafana user granted a role in the team org and on the
+// namespace folder.
+type Member struct {
+	// Email of the Grafana user, either email or login is set.
+	// +optional
+	Email string `json:"email,omitempty"`
+	// Login of the Grafana user, either email or login is set.
+	// +optional
+	Login string `json:"login,omitempty"`
+	Role  Role   `json:"role"`
+	// ExpiresAt is when the member loses its access, it is kept forever when unset.
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// Reason records why the member was granted access.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// GroupRef grants a role to every member of a Grafana team of the team org,
+// such as a team synced from the identity provider.
+type GroupRef struct {
+	// Name of the Grafana team.
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+// GrafanaUserSpec defines the desired state of GrafanaUser
+type GrafanaUserSpec struct {
+	// +optional
+	Members []Member `json:"members,omitempty"`
+	// +optional
+	Groups []GroupRef `json:"groups,omitempty"`
+}
+
+// GrafanaUserStatus defines the observed state of GrafanaUser
+type GrafanaUserStatus struct {
+	// Pending lists the users which do not exist in Grafana yet, they are
+	// added to the team org once they log in to Grafana.
+	Pending []string `json:"pending,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+
+// GrafanaUser is the Schema for the grafanausers API
+type GrafanaUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              GrafanaUserSpec   `json:"spec,omitempty"`
+	Status            GrafanaUserStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GrafanaUserList contains a list of GrafanaUser
+type GrafanaUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GrafanaUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GrafanaUser{}, &GrafanaUserList{})
+}
+
+// Name returns the email of the member, or its login.
+func (m Member) Name() string {
+	if m.Email != "" {
+		return m.Email
+	}
+	return m.Login
+}
+
+// Expired reports whether the member has lost its access at now.
+func (m Member) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(m.ExpiresAt.Time)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// GrafanaUserValidator rejects the members naming no user, which v1alpha1
+// would silently drop as blank entries.
+// +kubebuilder:object:generate=false
+type GrafanaUserValidator struct{}
+
+//+kubebuilder:webhook:path=/validate-grafana-snappcloud-io-v1beta1-grafanauser,mutating=false,failurePolicy=fail,sideEffects=None,groups=grafana.snappcloud.io,resources=grafanausers,verbs=create;update,versions=v1beta1,name=vgrafana-v1beta1.kb.io,admissionReviewVersions=v1
+
+var _ webhook.CustomValidator = &GrafanaUserValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaUserValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	r, ok := obj.(*GrafanaUser)
+	if !ok {
+		return nil, fmt.Errorf("expected a GrafanaUser but got a %T", obj)
+	}
+	return nil, validateMembers(r)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaUserValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	r, ok := newObj.(*GrafanaUser)
+	if !ok {
+		return nil, fmt.Errorf("expected a GrafanaUser but got a %T", newObj)
+	}
+	return nil, validateMembers(r)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaUserValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validateMembers checks every member has an email or a login.
+func validateMembers(r *GrafanaUser) error {
+	var errs field.ErrorList
+	membersPath := field.NewPath("spec", "members")
+	for i, member := range r.Spec.Members {
+		if strings.TrimSpace(member.Email) == "" && strings.TrimSpace(member.Login) == "" {
+			errs = append(errs, field.Required(membersPath.Index(i), "either email or login must be set"))
+		}
+	}
+	if len(errs) > 0 {
+		return apierrors.NewInvalid(GroupVersion.WithKind("GrafanaUser").GroupKind(), r.Name, errs)
+	}
+	return nil
+}
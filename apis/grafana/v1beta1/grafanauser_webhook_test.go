@@ -0,0 +1,79 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("GrafanaUser validator", func() {
+	type testCase struct {
+		members []Member
+		causes  []string
+	}
+
+	DescribeTable("members",
+		func(tc testCase) {
+			user := &GrafanaUser{
+				ObjectMeta: metav1.ObjectMeta{Name: "users", Namespace: "team-a"},
+				Spec:       GrafanaUserSpec{Members: tc.members},
+			}
+			v := &GrafanaUserValidator{}
+
+			_, createErr := v.ValidateCreate(context.Background(), user)
+			_, updateErr := v.ValidateUpdate(context.Background(), user.DeepCopy(), user)
+			for _, err := range []error{createErr, updateErr} {
+				if tc.causes == nil {
+					Expect(err).NotTo(HaveOccurred())
+					continue
+				}
+				Expect(apierrors.IsInvalid(err)).To(BeTrue())
+				var fields []string
+				for _, cause := range err.(apierrors.APIStatus).Status().Details.Causes {
+					fields = append(fields, cause.Field)
+				}
+				Expect(fields).To(Equal(tc.causes))
+			}
+		},
+		Entry("email", testCase{
+			members: []Member{{Email: "user1@snapp.cab", Role: RoleViewer}},
+		}),
+		Entry("login", testCase{
+			members: []Member{{Login: "user2", Role: RoleEditor}},
+		}),
+		Entry("neither", testCase{
+			members: []Member{{Email: "user1@snapp.cab", Role: RoleViewer}, {Role: RoleAdmin}},
+			causes:  []string{"spec.members[1]"},
+		}),
+		Entry("blank", testCase{
+			members: []Member{{Email: " ", Login: "\t", Role: RoleViewer}, {Login: "user2", Role: RoleEditor}},
+			causes:  []string{"spec.members[0]"},
+		}),
+	)
+
+	It("allows deletes", func() {
+		user := &GrafanaUser{Spec: GrafanaUserSpec{Members: []Member{{Role: RoleAdmin}}}}
+		_, err := (&GrafanaUserValidator{}).ValidateDelete(context.Background(), user)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
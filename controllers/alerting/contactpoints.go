@@ -0,0 +1,185 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	grafanav1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// secureSettingsHashKey keeps the hash of the secure settings of a contact
+// point, Grafana returns them redacted.
+const secureSettingsHashKey = "snappcloudSecureSettingsHash"
+
+// contactPointName is the name of a contact point in the team org, contact
+// point names are unique per org.
+func contactPointName(namespace, name string) string {
+	return namespace + "-" + name
+}
+
+// contactPointUID derives a stable contact point UID from its namespace and name.
+func contactPointUID(namespace, name string) string {
+	hash := sha256.Sum256([]byte(namespace + "/" + name))
+	return "cp-" + hex.EncodeToString(hash[:])[:24]
+}
+
+// renderContactPoint builds the Grafana contact point of cp, reading its
+// secrets from the namespace of the config. It also returns the keys of the
+// secure settings.
+func (r *GrafanaAlertingConfigReconciler) renderContactPoint(ctx context.Context, namespace string, cp grafanav1alpha1.ContactPoint) (grafana.ContactPoint, []string, error) {
+	out := grafana.ContactPoint{
+		UID:                   contactPointUID(namespace, cp.Name),
+		Name:                  contactPointName(namespace, cp.Name),
+		Settings:              map[string]interface{}{},
+		DisableResolveMessage: cp.DisableResolveMessage,
+	}
+	secure := map[string]string{}
+
+	switch {
+	case cp.Slack != nil:
+		out.Type = "slack"
+		setIfNotEmpty(out.Settings, "recipient", cp.Slack.Recipient)
+		setIfNotEmpty(out.Settings, "title", cp.Slack.Title)
+		setIfNotEmpty(out.Settings, "text", cp.Slack.Text)
+		if cp.Slack.URLSecretRef == nil && cp.Slack.TokenSecretRef == nil {
+			return out, nil, fmt.Errorf("contact point %s: slack needs urlSecretRef or tokenSecretRef", cp.Name)
+		}
+		if cp.Slack.URLSecretRef != nil {
+			value, err := r.secretValue(ctx, namespace, cp.Slack.URLSecretRef)
+			if err != nil {
+				return out, nil, err
+			}
+			secure["url"] = value
+		}
+		if cp.Slack.TokenSecretRef != nil {
+			value, err := r.secretValue(ctx, namespace, cp.Slack.TokenSecretRef)
+			if err != nil {
+				return out, nil, err
+			}
+			secure["token"] = value
+		}
+	case cp.Webhook != nil:
+		out.Type = "webhook"
+		out.Settings["url"] = cp.Webhook.URL
+		setIfNotEmpty(out.Settings, "httpMethod", cp.Webhook.HTTPMethod)
+		if cp.Webhook.AuthorizationSecretRef != nil {
+			value, err := r.secretValue(ctx, namespace, cp.Webhook.AuthorizationSecretRef)
+			if err != nil {
+				return out, nil, err
+			}
+			out.Settings["authorization_scheme"] = "Bearer"
+			secure["authorization_credentials"] = value
+		}
+	case cp.Email != nil:
+		out.Type = "email"
+		out.Settings["addresses"] = strings.Join(cp.Email.Addresses, ";")
+		out.Settings["singleEmail"] = cp.Email.SingleEmail
+	default:
+		return out, nil, fmt.Errorf("contact point %s: one of slack, webhook or email is required", cp.Name)
+	}
+
+	var secureKeys []string
+	if len(secure) > 0 {
+		raw, err := json.Marshal(secure)
+		if err != nil {
+			return out, nil, err
+		}
+		sum := sha256.Sum256(raw)
+		out.Settings[secureSettingsHashKey] = hex.EncodeToString(sum[:])
+		for key, value := range secure {
+			out.Settings[key] = value
+			secureKeys = append(secureKeys, key)
+		}
+	}
+	return out, secureKeys, nil
+}
+
+// contactPointInSync compares the contact point in Grafana with the desired
+// one. Secure settings are compared through their hash.
+func contactPointInSync(desired, current grafana.ContactPoint, secureKeys []string) bool {
+	if desired.Name != current.Name || desired.Type != current.Type || desired.DisableResolveMessage != current.DisableResolveMessage {
+		return false
+	}
+	for key, value := range desired.Settings {
+		if contains(secureKeys, key) {
+			continue
+		}
+		if !reflect.DeepEqual(value, current.Settings[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// secretValue reads the key of a Secret in namespace.
+func (r *GrafanaAlertingConfigReconciler) secretValue(ctx context.Context, namespace string, ref *corev1.SecretKeySelector) (string, error) {
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: namespace}, secret)
+	if err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %s", namespace, ref.Name, ref.Key)
+	}
+	return string(value), nil
+}
+
+// referencesSecret reports whether a contact point of config reads the Secret.
+func referencesSecret(config *grafanav1alpha1.GrafanaAlertingConfig, name string) bool {
+	for _, cp := range config.Spec.ContactPoints {
+		var refs []*corev1.SecretKeySelector
+		if cp.Slack != nil {
+			refs = append(refs, cp.Slack.URLSecretRef, cp.Slack.TokenSecretRef)
+		}
+		if cp.Webhook != nil {
+			refs = append(refs, cp.Webhook.AuthorizationSecretRef)
+		}
+		for _, ref := range refs {
+			if ref != nil && ref.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func setIfNotEmpty(settings map[string]interface{}, key, value string) {
+	if value != "" {
+		settings[key] = value
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	grafanav1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	teamLabel = "snappcloud.io/team"
+	// alertingFinalizer keeps the config until its contact points and routes
+	// are removed from Grafana.
+	alertingFinalizer = "grafana.snappcloud.io/alerting-config"
+	// resyncPeriod bounds how long drift in Grafana can last.
+	resyncPeriod = 10 * time.Minute
+	// orgRequeueDelay is how often a config waits for the team org to be
+	// created by the namespace controller.
+	orgRequeueDelay = time.Minute
+
+	conditionReady = "Ready"
+)
+
+// GrafanaAlertingConfigReconciler provisions the contact points and the
+// notification policies of a namespace into its team org.
+type GrafanaAlertingConfigReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=grafana.snappcloud.io,resources=grafanaalertingconfigs,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=grafana.snappcloud.io,resources=grafanaalertingconfigs/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=grafana.snappcloud.io,resources=grafanaalertingconfigs/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+// Reconcile writes the contact points of the config to the team org, then
+// rebuilds the team policy tree and removes contact points no longer listed.
+func (r *GrafanaAlertingConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	config := &grafanav1alpha1.GrafanaAlertingConfig{}
+	err := r.Get(ctx, req.NamespacedName, config)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get GrafanaAlertingConfig")
+		return ctrl.Result{}, err
+	}
+
+	ns := &corev1.Namespace{}
+	err = r.Get(ctx, client.ObjectKey{Name: req.Namespace}, ns)
+	if err != nil {
+		logger.Error(err, "Failed to get namespace")
+		return ctrl.Result{}, err
+	}
+	team, ok := ns.Labels[teamLabel]
+	deleting := !config.DeletionTimestamp.IsZero()
+
+	var orgID int64
+	if ok && !deleting {
+		orgID, err = teamOrgID(ctx, team)
+		if grafana.IsNotFound(err) {
+			// The namespace controller creates the team org
+			logger.Info("Waiting for team organization to be created", "team", team)
+			return ctrl.Result{RequeueAfter: orgRequeueDelay}, r.setReady(ctx, config, metav1.ConditionFalse, "OrgNotFound", err.Error())
+		}
+		if err != nil {
+			logger.Error(err, "Unable to get organization", "team", team)
+			return ctrl.Result{}, r.setFailed(ctx, config, "OrgLookupFailed", err)
+		}
+	}
+
+	// Remove the config from the org it was provisioned in when it is deleted
+	// or its namespace moved to another team
+	if config.Status.OrgID != 0 && config.Status.OrgID != orgID {
+		err = r.releaseOrg(ctx, config)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		config.Status.ContactPoints = nil
+		config.Status.OrgID = 0
+		if !deleting {
+			err = r.Status().Update(ctx, config)
+			if err != nil {
+				logger.Error(err, "Unable to update GrafanaAlertingConfig status")
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	if deleting {
+		patch := client.MergeFrom(config.DeepCopy())
+		controllerutil.RemoveFinalizer(config, alertingFinalizer)
+		return ctrl.Result{}, r.Patch(ctx, config, patch)
+	}
+	if !ok {
+		logger.Info("Namespace does not have team label. Ignoring", "namespace", ns.Name)
+		return ctrl.Result{}, r.setReady(ctx, config, metav1.ConditionFalse, "MissingTeamLabel", "namespace has no "+teamLabel+" label")
+	}
+
+	if !controllerutil.ContainsFinalizer(config, alertingFinalizer) {
+		patch := client.MergeFrom(config.DeepCopy())
+		controllerutil.AddFinalizer(config, alertingFinalizer)
+		err = r.Patch(ctx, config, patch)
+		if err != nil {
+			logger.Error(err, "Unable to add finalizer")
+			return ctrl.Result{}, err
+		}
+	}
+
+	alerting, err := grafana.FromContext(ctx).NewAlertingClient(uint(orgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana alerting client")
+		return ctrl.Result{}, err
+	}
+	uids, err := r.ensureContactPoints(ctx, alerting, config)
+	if err != nil {
+		return ctrl.Result{}, r.setFailed(ctx, config, "ContactPointFailed", err)
+	}
+
+	// Record the contact points before the stale ones are deleted
+	previous := config.Status.ContactPoints
+	config.Status.ContactPoints = uids
+	config.Status.OrgID = orgID
+	err = r.Status().Update(ctx, config)
+	if err != nil {
+		logger.Error(err, "Unable to update GrafanaAlertingConfig status")
+		return ctrl.Result{}, err
+	}
+
+	// Validated after the contact points, the route may only reference them once they exist
+	if config.Spec.Route != nil {
+		if _, err := namespaceRoute(config); err != nil {
+			return ctrl.Result{}, r.setReady(ctx, config, metav1.ConditionFalse, "InvalidRoute", err.Error())
+		}
+	}
+	err = r.ensurePolicyTree(ctx, alerting, team, client.ObjectKey{})
+	if err != nil {
+		logger.Error(err, "Unable to update notification policy tree")
+		return ctrl.Result{}, r.setFailed(ctx, config, "PolicyTreeFailed", err)
+	}
+
+	// Stale contact points can only be deleted once no route uses them
+	err = r.removeContactPoints(ctx, alerting, previous, uids)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: resyncPeriod}, r.setReady(ctx, config, metav1.ConditionTrue, "Provisioned", fmt.Sprintf("%d contact points provisioned", len(uids)))
+}
+
+// ensureContactPoints creates or repairs the contact points of config and
+// returns their UIDs.
+func (r *GrafanaAlertingConfigReconciler) ensureContactPoints(ctx context.Context, alerting *grafana.AlertingClient, config *grafanav1alpha1.GrafanaAlertingConfig) ([]string, error) {
+	logger := log.FromContext(ctx)
+
+	existing, err := alerting.GetContactPoints(ctx)
+	if err != nil {
+		logger.Error(err, "Unable to list contact points")
+		return nil, err
+	}
+	current := map[string]grafana.ContactPoint{}
+	for _, cp := range existing {
+		current[cp.UID] = cp
+	}
+
+	uids := make([]string, 0, len(config.Spec.ContactPoints))
+	for _, spec := range config.Spec.ContactPoints {
+		desired, secureKeys, err := r.renderContactPoint(ctx, config.Namespace, spec)
+		if err != nil {
+			logger.Error(err, "Unable to render contact point", "contactPoint", spec.Name)
+			return nil, err
+		}
+		uids = append(uids, desired.UID)
+
+		found, ok := current[desired.UID]
+		switch {
+		case !ok:
+			logger.Info("Creating contact point", "contactPoint", desired.Name)
+			err = alerting.CreateContactPoint(ctx, desired)
+		case !contactPointInSync(desired, found, secureKeys):
+			logger.Info("Updating contact point", "contactPoint", desired.Name)
+			err = alerting.UpdateContactPoint(ctx, desired)
+		}
+		if err != nil {
+			logger.Error(err, "Unable to write contact point", "contactPoint", desired.Name)
+			return nil, err
+		}
+	}
+	return uids, nil
+}
+
+// releaseOrg removes the routes and then the contact points of config from
+// the org recorded in its status.
+func (r *GrafanaAlertingConfigReconciler) releaseOrg(ctx context.Context, config *grafanav1alpha1.GrafanaAlertingConfig) error {
+	logger := log.FromContext(ctx)
+
+	grafanaClient, err := grafana.FromContext(ctx).NewClient(0)
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return err
+	}
+	org, err := grafanaClient.GetOrgById(ctx, uint(config.Status.OrgID))
+	if grafana.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "Unable to get organization", "orgID", config.Status.OrgID)
+		return err
+	}
+
+	logger.Info("Removing alerting config from organization", "orgID", org.ID, "team", org.Name)
+	alerting, err := grafana.FromContext(ctx).NewAlertingClient(uint(config.Status.OrgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana alerting client")
+		return err
+	}
+	err = r.ensurePolicyTree(ctx, alerting, org.Name, client.ObjectKeyFromObject(config))
+	if err != nil {
+		logger.Error(err, "Unable to update notification policy tree")
+		return err
+	}
+	return r.removeContactPoints(ctx, alerting, config.Status.ContactPoints, nil)
+}
+
+// removeContactPoints deletes the contact points with the given UIDs, except
+// the ones to keep.
+func (r *GrafanaAlertingConfigReconciler) removeContactPoints(ctx context.Context, alerting *grafana.AlertingClient, uids, keep []string) error {
+	for _, uid := range uids {
+		if contains(keep, uid) {
+			continue
+		}
+		log.FromContext(ctx).Info("Removing contact point", "contactPoint.UID", uid)
+		err := alerting.DeleteContactPoint(ctx, uid)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Unable to delete contact point", "contactPoint.UID", uid)
+			return err
+		}
+	}
+	return nil
+}
+
+// setReady records the Ready condition.
+func (r *GrafanaAlertingConfigReconciler) setReady(ctx context.Context, config *grafanav1alpha1.GrafanaAlertingConfig, status metav1.ConditionStatus, reason, message string) error {
+	meta.SetStatusCondition(&config.Status.Conditions, metav1.Condition{
+		Type:               conditionReady,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: config.Generation,
+	})
+	err := r.Status().Update(ctx, config)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Unable to update GrafanaAlertingConfig status")
+		return err
+	}
+	return nil
+}
+
+// setFailed records the Ready condition of a failed step and returns err, so
+// the config is retried when err is transient. Grafana errors are recorded
+// with their kind as reason, e.g. GrafanaConflict.
+func (r *GrafanaAlertingConfigReconciler) setFailed(ctx context.Context, config *grafanav1alpha1.GrafanaAlertingConfig, reason string, err error) error {
+	if grafanaReason := grafana.Reason(err); grafanaReason != "" {
+		reason = grafanaReason
+	}
+	if statusErr := r.setReady(ctx, config, metav1.ConditionFalse, reason, err.Error()); statusErr != nil {
+		return statusErr
+	}
+	return err
+}
+
+// teamOrgID returns the ID of the Grafana org of team, which is created by
+// the namespace controller.
+func teamOrgID(ctx context.Context, team string) (int64, error) {
+	client, err := grafana.FromContext(ctx).NewClient(0)
+	if err != nil {
+		return 0, err
+	}
+	org, err := client.GetOrgByOrgName(ctx, team)
+	if err != nil {
+		return 0, err
+	}
+	return int64(org.ID), nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *GrafanaAlertingConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	newObject := func() client.Object { return &grafanav1alpha1.GrafanaAlertingConfig{} }
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&grafanav1alpha1.GrafanaAlertingConfig{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.secretToConfigs), builder.OnlyMetadata).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.namespaceToConfigs)).
+		Complete(grafana.HandleErrors(mgr, grafana.SelectInstance(mgr, r, newObject), newObject))
+}
+
+// secretToConfigs enqueues the configs of the namespace reading the Secret.
+func (r *GrafanaAlertingConfigReconciler) secretToConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	list := &grafanav1alpha1.GrafanaAlertingConfigList{}
+	err := r.List(ctx, list, client.InNamespace(obj.GetNamespace()))
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GrafanaAlertingConfigs")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, config := range list.Items {
+		if referencesSecret(&config, obj.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&config)})
+		}
+	}
+	return requests
+}
+
+// namespaceToConfigs enqueues the configs of a namespace, so they follow the
+// team label.
+func (r *GrafanaAlertingConfigReconciler) namespaceToConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	list := &grafanav1alpha1.GrafanaAlertingConfigList{}
+	err := r.List(ctx, list, client.InNamespace(obj.GetName()))
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GrafanaAlertingConfigs")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, config := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&config)})
+	}
+	return requests
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	grafanav1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// namespaceAlertLabel is the alert label the namespace routes match on.
+const namespaceAlertLabel = "namespace"
+
+// managedRouteMatcher marks the routes written by the operator. Alerts carry
+// no such label, so it matches every alert.
+var managedRouteMatcher = [3]string{"snappcloud_route", "!=", "unmanaged"}
+
+// ensurePolicyTree replaces the routes the operator wrote to the team org
+// policy tree with the routes of the GrafanaAlertingConfigs of the team
+// namespaces, in namespace and name order. They take the place of the first
+// route the operator wrote, or go first. The root policy and the routes made
+// in Grafana are left as they are. The config named by exclude is left out,
+// it is being removed.
+func (r *GrafanaAlertingConfigReconciler) ensurePolicyTree(ctx context.Context, alerting *grafana.AlertingClient, team string, exclude client.ObjectKey) error {
+	logger := log.FromContext(ctx)
+
+	namespaces := &corev1.NamespaceList{}
+	err := r.List(ctx, namespaces, client.MatchingLabels{teamLabel: team})
+	if err != nil {
+		return err
+	}
+	var configs []grafanav1alpha1.GrafanaAlertingConfig
+	for _, ns := range namespaces.Items {
+		list := &grafanav1alpha1.GrafanaAlertingConfigList{}
+		err = r.List(ctx, list, client.InNamespace(ns.Name))
+		if err != nil {
+			return err
+		}
+		for _, config := range list.Items {
+			if client.ObjectKeyFromObject(&config) == exclude || !config.DeletionTimestamp.IsZero() {
+				continue
+			}
+			configs = append(configs, config)
+		}
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		if configs[i].Namespace != configs[j].Namespace {
+			return configs[i].Namespace < configs[j].Namespace
+		}
+		return configs[i].Name < configs[j].Name
+	})
+
+	var routes []grafana.Route
+	for _, config := range configs {
+		if config.Spec.Route == nil {
+			continue
+		}
+		// An invalid route is reported on its own config and left out
+		route, err := namespaceRoute(&config)
+		if err != nil {
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	tree, err := alerting.GetPolicyTree(ctx)
+	if err != nil {
+		return err
+	}
+	teamNamespaces := map[string]bool{}
+	for _, ns := range namespaces.Items {
+		teamNamespaces[ns.Name] = true
+	}
+	merged := mergeRoutes(tree.Routes, routes, teamNamespaces)
+	if reflect.DeepEqual(tree.Routes, merged) {
+		return nil
+	}
+	tree.Routes = merged
+	logger.Info("Updating notification policy tree", "team", team, "routes", len(routes))
+	return alerting.SetPolicyTree(ctx, tree)
+}
+
+// mergeRoutes replaces the managed routes of current with managed.
+func mergeRoutes(current, managed []grafana.Route, teamNamespaces map[string]bool) []grafana.Route {
+	merged := make([]grafana.Route, 0, len(current)+len(managed))
+	inserted := false
+	for _, route := range current {
+		if !isManagedRoute(route, teamNamespaces) {
+			merged = append(merged, route)
+			continue
+		}
+		if !inserted {
+			merged = append(merged, managed...)
+			inserted = true
+		}
+	}
+	if !inserted {
+		merged = append(append([]grafana.Route{}, managed...), merged...)
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// isManagedRoute reports whether the operator wrote route. Routes written
+// before they were marked match a team namespace first and send to one of its
+// contact points.
+func isManagedRoute(route grafana.Route, teamNamespaces map[string]bool) bool {
+	for _, matcher := range route.ObjectMatchers {
+		if matcher == managedRouteMatcher {
+			return true
+		}
+	}
+	if len(route.ObjectMatchers) == 0 {
+		return false
+	}
+	first := route.ObjectMatchers[0]
+	return first[0] == namespaceAlertLabel && first[1] == "=" && teamNamespaces[first[2]] &&
+		strings.HasPrefix(route.Receiver, contactPointName(first[2], ""))
+}
+
+// namespaceRoute converts the route of config, matching the namespace of the
+// config, to a Grafana route.
+func namespaceRoute(config *grafanav1alpha1.GrafanaAlertingConfig) (grafana.Route, error) {
+	receivers := map[string]bool{}
+	for _, cp := range config.Spec.ContactPoints {
+		receivers[cp.Name] = true
+	}
+	route, err := convertRoute(config.Namespace, *config.Spec.Route, receivers)
+	if err != nil {
+		return grafana.Route{}, err
+	}
+	route.ObjectMatchers = append([][3]string{{namespaceAlertLabel, "=", config.Namespace}, managedRouteMatcher}, route.ObjectMatchers...)
+	return route, nil
+}
+
+// convertRoute converts a route and its nested routes. Receivers have to be
+// contact points of the same config.
+func convertRoute(namespace string, in grafanav1alpha1.NotificationRoute, receivers map[string]bool) (grafana.Route, error) {
+	out := grafana.Route{
+		GroupBy:        in.GroupBy,
+		Continue:       in.Continue,
+		GroupWait:      in.GroupWait,
+		GroupInterval:  in.GroupInterval,
+		RepeatInterval: in.RepeatInterval,
+	}
+	if in.Receiver != "" {
+		if !receivers[in.Receiver] {
+			return out, fmt.Errorf("receiver %q is not a contact point of this config", in.Receiver)
+		}
+		out.Receiver = contactPointName(namespace, in.Receiver)
+	}
+	for _, m := range in.Matchers {
+		out.ObjectMatchers = append(out.ObjectMatchers, [3]string{m.Label, m.Operator, m.Value})
+	}
+	for _, nested := range in.Routes {
+		route, err := convertRoute(namespace, nested, receivers)
+		if err != nil {
+			return out, err
+		}
+		out.Routes = append(out.Routes, route)
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	grafanav1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+var _ = Describe("Notification policies", func() {
+	receivers := map[string]bool{"oncall": true, "slack": true}
+
+	DescribeTable("convertRoute prefixes the receivers with the namespace",
+		func(in grafanav1alpha1.NotificationRoute, want grafana.Route) {
+			Expect(convertRoute("team-a-prod", in, receivers)).To(Equal(want))
+		},
+		Entry("timings",
+			grafanav1alpha1.NotificationRoute{
+				Receiver: "slack", GroupBy: []string{"alertname"}, GroupWait: "30s", GroupInterval: "5m", RepeatInterval: "4h", Continue: true,
+			},
+			grafana.Route{
+				Receiver: "team-a-prod-slack", GroupBy: []string{"alertname"}, GroupWait: "30s", GroupInterval: "5m", RepeatInterval: "4h", Continue: true,
+			}),
+		Entry("nested routes",
+			grafanav1alpha1.NotificationRoute{
+				Receiver: "slack",
+				Routes: []grafanav1alpha1.NotificationRoute{{
+					Receiver: "oncall",
+					Matchers: []grafanav1alpha1.RouteMatcher{{Label: "severity", Operator: "=", Value: "critical"}},
+					Routes: []grafanav1alpha1.NotificationRoute{{
+						Matchers: []grafanav1alpha1.RouteMatcher{{Label: "service", Operator: "=~", Value: "api|web"}},
+					}},
+				}},
+			},
+			grafana.Route{
+				Receiver: "team-a-prod-slack",
+				Routes: []grafana.Route{{
+					Receiver:       "team-a-prod-oncall",
+					ObjectMatchers: [][3]string{{"severity", "=", "critical"}},
+					Routes: []grafana.Route{{
+						ObjectMatchers: [][3]string{{"service", "=~", "api|web"}},
+					}},
+				}},
+			}),
+	)
+
+	DescribeTable("convertRoute refuses unknown receivers",
+		func(in grafanav1alpha1.NotificationRoute) {
+			_, err := convertRoute("team-a-prod", in, receivers)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("on the route", grafanav1alpha1.NotificationRoute{Receiver: "email"}),
+		Entry("on a nested route", grafanav1alpha1.NotificationRoute{
+			Receiver: "slack",
+			Routes:   []grafanav1alpha1.NotificationRoute{{Receiver: "email"}},
+		}),
+	)
+
+	teamNamespaces := map[string]bool{"team-a-prod": true, "team-a-stage": true}
+	manual := grafana.Route{Receiver: "default"}
+	legacy := grafana.Route{Receiver: "team-a-prod-slack", ObjectMatchers: [][3]string{{namespaceAlertLabel, "=", "team-a-prod"}}}
+	marked := grafana.Route{Receiver: "team-a-stage-slack", ObjectMatchers: [][3]string{{namespaceAlertLabel, "=", "team-a-stage"}, managedRouteMatcher}}
+	otherTeam := grafana.Route{Receiver: "team-b-prod-slack", ObjectMatchers: [][3]string{{namespaceAlertLabel, "=", "team-b-prod"}}}
+	managed := grafana.Route{Receiver: "team-a-prod-oncall", ObjectMatchers: [][3]string{{namespaceAlertLabel, "=", "team-a-prod"}, managedRouteMatcher}}
+
+	DescribeTable("mergeRoutes replaces only the routes of the team",
+		func(current, routes, want []grafana.Route) {
+			Expect(mergeRoutes(current, routes, teamNamespaces)).To(Equal(want))
+		},
+		Entry("empty", nil, nil, []grafana.Route(nil)),
+		Entry("first routes", nil, []grafana.Route{managed}, []grafana.Route{managed}),
+		Entry("managed first without managed routes", []grafana.Route{manual}, []grafana.Route{managed}, []grafana.Route{managed, manual}),
+		Entry("replaced in place", []grafana.Route{manual, marked, otherTeam, legacy}, []grafana.Route{managed}, []grafana.Route{manual, managed, otherTeam}),
+		Entry("removed", []grafana.Route{marked, manual}, nil, []grafana.Route{manual}),
+	)
+})
@@ -0,0 +1,529 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	nsMonitoringLabel = "monitoring.snappcloud.io/grafana-datasource"
+	// namespaceOrgAnnotation is recorded on monitored namespaces by the
+	// namespace controller, it holds the team org of the namespace.
+	namespaceOrgAnnotation = "monitoring.snappcloud.io/grafana-datasource-org-id"
+	// prometheusRuleAnnotation marks the Grafana rules converted from a
+	// PrometheusRule, it holds the PrometheusRule name.
+	prometheusRuleAnnotation = "snappcloud_prometheusrule"
+	// defaultRuleGroupInterval is the Prometheus default evaluation interval.
+	defaultRuleGroupInterval = time.Minute
+	// ruleGroupIntervalStep is the Grafana base evaluation interval, rule
+	// group intervals must be a multiple of it.
+	ruleGroupIntervalStep = 10 * time.Second
+	// datasourceRequeueDelay is how long to wait for the namespace datasource
+	// to show up in Grafana.
+	datasourceRequeueDelay = 30 * time.Second
+	// maxRuleGroupTitle is the longest rule group title Grafana accepts.
+	maxRuleGroupTitle = 190
+)
+
+// prometheusRuleGVK is the prometheus-operator PrometheusRule kind. It is
+// handled as unstructured to not depend on the prometheus-operator module.
+var prometheusRuleGVK = schema.GroupVersionKind{
+	Group:   "monitoring.coreos.com",
+	Version: "v1",
+	Kind:    "PrometheusRule",
+}
+
+// PrometheusRuleReconciler converts the alerting rules of the PrometheusRules
+// of a monitored namespace into Grafana-managed alert rules in the namespace
+// folder, querying the namespace datasource. Requests are keyed by namespace.
+type PrometheusRuleReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheusrules,verbs=get;list;watch
+
+// Reconcile writes one Grafana rule group per PrometheusRule group and deletes
+// the converted rules whose PrometheusRule or group is gone.
+func (r *PrometheusRuleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	ns := &corev1.Namespace{}
+	err := r.Get(ctx, req.NamespacedName, ns)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get Namespace")
+		return ctrl.Result{}, err
+	}
+	// The folder and its rules are removed by the namespace controller
+	if _, ok := ns.Labels[nsMonitoringLabel]; !ok || !ns.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+	orgID, err := strconv.ParseInt(ns.Annotations[namespaceOrgAnnotation], 10, 64)
+	if err != nil {
+		logger.Info("Waiting for namespace to be provisioned in Grafana", "namespace", ns.Name)
+		return ctrl.Result{}, nil
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(prometheusRuleGVK.GroupVersion().WithKind(prometheusRuleGVK.Kind + "List"))
+	err = r.List(ctx, list, client.InNamespace(ns.Name))
+	if err != nil {
+		logger.Error(err, "Failed to list PrometheusRules")
+		return ctrl.Result{}, err
+	}
+
+	alerting, err := grafana.FromContext(ctx).NewAlertingClient(uint(orgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana alerting client")
+		return ctrl.Result{}, err
+	}
+	folderUID := grafana.NamespaceFolderUID(ns.Name)
+
+	var groups []grafana.RuleGroup
+	if hasAlertingRules(list.Items) {
+		sdkClient, err := grafana.FromContext(ctx).NewClient(uint(orgID))
+		if err != nil {
+			logger.Error(err, "Unable to create Grafana client")
+			return ctrl.Result{}, err
+		}
+		// The namespace controller removes the rules once the namespace goes
+		err = grafana.GuardNamespace(ctx, r.Client, ns)
+		if err != nil {
+			logger.Error(err, "Unable to add finalizer to Namespace")
+			return ctrl.Result{}, err
+		}
+		folder, err := grafana.EnsureNamespaceFolder(ctx, sdkClient, ns.Name)
+		if err != nil {
+			logger.Error(err, "Unable to reconcile namespace folder", "orgID", orgID)
+			return ctrl.Result{}, err
+		}
+		folderUID = folder.UID
+
+		dsUID, err := datasourceUIDByName(ctx, sdkClient, ns.Name)
+		if err != nil {
+			logger.Error(err, "Unable to list Grafana datasources", "orgID", orgID)
+			return ctrl.Result{}, err
+		}
+		if dsUID == "" {
+			logger.Info("Waiting for datasource to be created in Grafana", "datasource.Name", ns.Name)
+			return ctrl.Result{RequeueAfter: datasourceRequeueDelay}, nil
+		}
+
+		conv := &ruleConverter{namespace: ns.Name, orgID: orgID, folderUID: folderUID, datasourceUID: dsUID,
+			titles: map[string]int{}, groupTitles: map[string]bool{}}
+		// Titles are made unique in order, which has to be the same on every pass
+		sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].GetName() < list.Items[j].GetName() })
+		for _, pr := range list.Items {
+			if !pr.GetDeletionTimestamp().IsZero() {
+				continue
+			}
+			converted, err := conv.convert(&pr)
+			if err != nil {
+				// An invalid PrometheusRule is rejected by prometheus-operator too
+				logger.Error(err, "Unable to convert PrometheusRule groups, skipping them", "prometheusRule", pr.GetName())
+			}
+			groups = append(groups, converted...)
+		}
+	}
+
+	desired := map[string]bool{}
+	for _, group := range groups {
+		desired[group.Title] = true
+		err = ensureRuleGroup(ctx, alerting, group)
+		if err != nil {
+			logger.Error(err, "Unable to write rule group", "ruleGroup", group.Title)
+			return ctrl.Result{}, err
+		}
+	}
+
+	existing, err := alerting.GetAlertRules(ctx)
+	if err != nil {
+		logger.Error(err, "Unable to list alert rules", "orgID", orgID)
+		return ctrl.Result{}, err
+	}
+	for _, rule := range existing {
+		if rule.FolderUID != folderUID || rule.Annotations[prometheusRuleAnnotation] == "" || desired[rule.RuleGroup] {
+			continue
+		}
+		logger.Info("Removing alert rule without PrometheusRule", "rule.UID", rule.UID, "ruleGroup", rule.RuleGroup)
+		err = alerting.DeleteAlertRule(ctx, rule.UID)
+		if err != nil {
+			logger.Error(err, "Unable to delete alert rule", "rule.UID", rule.UID)
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: resyncPeriod}, nil
+}
+
+// ensureRuleGroup writes group unless Grafana already has it as is.
+func ensureRuleGroup(ctx context.Context, alerting *grafana.AlertingClient, group grafana.RuleGroup) error {
+	current, err := alerting.GetRuleGroup(ctx, group.FolderUID, group.Title)
+	if err != nil && !grafana.IsNotFound(err) {
+		return err
+	}
+	if err == nil && ruleGroupInSync(&current, &group) {
+		return nil
+	}
+	log.FromContext(ctx).Info("Writing rule group", "ruleGroup", group.Title, "rules", len(group.Rules))
+	return alerting.SetRuleGroup(ctx, group)
+}
+
+// ruleConverter converts PrometheusRules of a namespace. Titles count the
+// rule titles already used in the folder and groupTitles hold the rule group
+// titles, Grafana requires both unique.
+type ruleConverter struct {
+	namespace     string
+	orgID         int64
+	folderUID     string
+	datasourceUID string
+	titles        map[string]int
+	groupTitles   map[string]bool
+}
+
+// convert returns a rule group per group of pr holding alerting rules.
+// Recording rules are left to Prometheus. Invalid groups are skipped, the
+// returned error lists them.
+func (c *ruleConverter) convert(pr *unstructured.Unstructured) ([]grafana.RuleGroup, error) {
+	groups, _, err := unstructured.NestedSlice(pr.Object, "spec", "groups")
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if _, ok := g.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("invalid group in PrometheusRule %s", pr.GetName())
+		}
+	}
+	// Groups are converted by name, so reordering them keeps the titles
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, _, _ := unstructured.NestedString(groups[i].(map[string]interface{}), "name")
+		b, _, _ := unstructured.NestedString(groups[j].(map[string]interface{}), "name")
+		return a < b
+	})
+	var out []grafana.RuleGroup
+	var errs []error
+	for _, g := range groups {
+		group := g.(map[string]interface{})
+		name, _, _ := unstructured.NestedString(group, "name")
+		ruleGroup, err := c.convertGroup(pr.GetName(), name, group)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("group %s: %w", name, err))
+			continue
+		}
+		if len(ruleGroup.Rules) > 0 {
+			out = append(out, ruleGroup)
+		}
+	}
+	return out, utilerrors.NewAggregate(errs)
+}
+
+// convertGroup converts the alerting rules of the PrometheusRule group name.
+func (c *ruleConverter) convertGroup(prName, name string, group map[string]interface{}) (grafana.RuleGroup, error) {
+	interval, err := parseDuration(group, "interval", defaultRuleGroupInterval)
+	if err != nil {
+		return grafana.RuleGroup{}, err
+	}
+	title := c.groupTitle(prName, name)
+	ruleGroup := grafana.RuleGroup{Title: title, FolderUID: c.folderUID, Interval: ruleGroupInterval(time.Duration(interval))}
+
+	rules, _, _ := unstructured.NestedSlice(group, "rules")
+	for i, item := range rules {
+		rule, ok := item.(map[string]interface{})
+		if !ok {
+			return grafana.RuleGroup{}, fmt.Errorf("invalid rule %d", i)
+		}
+		alert, _, _ := unstructured.NestedString(rule, "alert")
+		if alert == "" {
+			continue
+		}
+		converted, err := c.convertRule(prName, title, name, i, alert, rule)
+		if err != nil {
+			return grafana.RuleGroup{}, fmt.Errorf("alert %s: %w", alert, err)
+		}
+		ruleGroup.Rules = append(ruleGroup.Rules, converted)
+	}
+	return ruleGroup, nil
+}
+
+// ruleGroupInterval returns the interval in seconds Grafana evaluates a group
+// evaluated every interval by Prometheus: Grafana only accepts multiples of
+// its base interval, so other intervals are rounded up.
+func ruleGroupInterval(interval time.Duration) int64 {
+	steps := (interval + ruleGroupIntervalStep - 1) / ruleGroupIntervalStep
+	if steps < 1 {
+		steps = 1
+	}
+	return int64((steps * ruleGroupIntervalStep).Seconds())
+}
+
+// groupTitle returns the rule group title of a PrometheusRule group. Titles
+// which are too long or already taken get a suffix derived from the
+// PrometheusRule and group names.
+func (c *ruleConverter) groupTitle(prName, groupName string) string {
+	title := prName + "-" + groupName
+	if len(title) > maxRuleGroupTitle || c.groupTitles[title] {
+		hash := sha256.Sum256([]byte(prName + "/" + groupName))
+		suffix := "-" + hex.EncodeToString(hash[:])[:8]
+		if len(title) > maxRuleGroupTitle-len(suffix) {
+			title = title[:maxRuleGroupTitle-len(suffix)]
+		}
+		title += suffix
+	}
+	c.groupTitles[title] = true
+	return title
+}
+
+// ruleGroupInSync compares the fields of the rule groups the operator sets.
+// Grafana adds fields of its own and defaults to the rules and their queries.
+func ruleGroupInSync(current, desired *grafana.RuleGroup) bool {
+	if current.Title != desired.Title || current.FolderUID != desired.FolderUID || current.Interval != desired.Interval ||
+		len(current.Rules) != len(desired.Rules) {
+		return false
+	}
+	rules := map[string]*grafana.AlertRule{}
+	for i := range current.Rules {
+		rules[current.Rules[i].UID] = &current.Rules[i]
+	}
+	for i := range desired.Rules {
+		want := &desired.Rules[i]
+		got, ok := rules[want.UID]
+		if !ok || !alertRuleInSync(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func alertRuleInSync(current, desired *grafana.AlertRule) bool {
+	if current.Title != desired.Title || current.Condition != desired.Condition || current.RuleGroup != desired.RuleGroup ||
+		current.NoDataState != desired.NoDataState || current.ExecErrState != desired.ExecErrState ||
+		!sameDuration(current.For, desired.For) || !sameStrings(current.Labels, desired.Labels) ||
+		!sameStrings(current.Annotations, desired.Annotations) || len(current.Data) != len(desired.Data) {
+		return false
+	}
+	for i := range desired.Data {
+		got, want := current.Data[i], desired.Data[i]
+		if got.RefID != want.RefID || got.DatasourceUID != want.DatasourceUID || got.RelativeTimeRange != want.RelativeTimeRange {
+			return false
+		}
+		for key, value := range want.Model {
+			if !sameJSON(got.Model[key], value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sameDuration(a, b string) bool {
+	da, errA := model.ParseDuration(a)
+	db, errB := model.ParseDuration(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return da == db
+}
+
+// sameStrings compares string maps, nil and empty are the same.
+func sameStrings(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if v, ok := b[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sameJSON compares two values in their JSON form, so numbers decoded by
+// Grafana compare equal to the ones set by the operator.
+func sameJSON(a, b interface{}) bool {
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(rawA) == string(rawB)
+}
+
+// convertRule converts a Prometheus alerting rule. The query returns the
+// firing series, the math expression turns every returned series into a
+// firing alert whatever its value, as Prometheus does.
+func (c *ruleConverter) convertRule(prName, groupTitle, groupName string, index int, alert string, rule map[string]interface{}) (grafana.AlertRule, error) {
+	expr := fmt.Sprint(rule["expr"])
+	forDuration, err := parseDuration(rule, "for", 0)
+	if err != nil {
+		return grafana.AlertRule{}, err
+	}
+
+	labels := map[string]string{}
+	if m, ok, _ := unstructured.NestedStringMap(rule, "labels"); ok {
+		labels = m
+	}
+	labels["namespace"] = c.namespace
+	annotations := map[string]string{}
+	if m, ok, _ := unstructured.NestedStringMap(rule, "annotations"); ok {
+		annotations = m
+	}
+	annotations[prometheusRuleAnnotation] = prName
+
+	title := alert
+	c.titles[alert]++
+	if n := c.titles[alert]; n > 1 {
+		title = fmt.Sprintf("%s (%d)", alert, n)
+	}
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s/%d", c.namespace, prName, groupName, index)))
+	return grafana.AlertRule{
+		UID:       "pr-" + hex.EncodeToString(hash[:])[:24],
+		OrgID:     c.orgID,
+		FolderUID: c.folderUID,
+		RuleGroup: groupTitle,
+		Title:     title,
+		Condition: "B",
+		Data: []grafana.AlertQuery{
+			{
+				RefID:             "A",
+				DatasourceUID:     c.datasourceUID,
+				RelativeTimeRange: grafana.RelativeTimeRange{From: 600},
+				Model: map[string]interface{}{
+					"refId":         "A",
+					"expr":          expr,
+					"instant":       true,
+					"intervalMs":    1000,
+					"maxDataPoints": 43200,
+					"datasource":    map[string]interface{}{"type": "prometheus", "uid": c.datasourceUID},
+				},
+			},
+			{
+				RefID:         "B",
+				DatasourceUID: "__expr__",
+				Model: map[string]interface{}{
+					"refId":         "B",
+					"type":          "math",
+					"expression":    "is_number($A) || is_nan($A) || is_inf($A)",
+					"intervalMs":    1000,
+					"maxDataPoints": 43200,
+					"datasource":    map[string]interface{}{"type": "__expr__", "uid": "__expr__"},
+				},
+			},
+		},
+		// No series means nothing fires in Prometheus
+		NoDataState:  "OK",
+		ExecErrState: "Error",
+		For:          forDuration.String(),
+		Labels:       labels,
+		Annotations:  annotations,
+	}, nil
+}
+
+// parseDuration parses the Prometheus duration at key of obj, def is
+// returned when it is not set.
+func parseDuration(obj map[string]interface{}, key string, def time.Duration) (model.Duration, error) {
+	s, ok, _ := unstructured.NestedString(obj, key)
+	if !ok || s == "" {
+		return model.Duration(def), nil
+	}
+	return model.ParseDuration(s)
+}
+
+// hasAlertingRules reports whether any of the PrometheusRules has an
+// alerting rule.
+func hasAlertingRules(prs []unstructured.Unstructured) bool {
+	for _, pr := range prs {
+		groups, _, _ := unstructured.NestedSlice(pr.Object, "spec", "groups")
+		for _, g := range groups {
+			group, _ := g.(map[string]interface{})
+			rules, _, _ := unstructured.NestedSlice(group, "rules")
+			for _, item := range rules {
+				rule, _ := item.(map[string]interface{})
+				if alert, _, _ := unstructured.NestedString(rule, "alert"); alert != "" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// datasourceUIDByName returns the UID Grafana gave to the named datasource, or
+// an empty string when it does not exist yet.
+func datasourceUIDByName(ctx context.Context, c grafana.Client, name string) (string, error) {
+	datasources, err := c.GetAllDatasources(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, ds := range datasources {
+		if ds.Name == name {
+			return ds.UID, nil
+		}
+	}
+	return "", nil
+}
+
+// SetupWithManager sets up the controller with the Manager. It does nothing
+// when the PrometheusRule CRD is not installed.
+func (r *PrometheusRuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	_, err := mgr.GetRESTMapper().RESTMapping(prometheusRuleGVK.GroupKind(), prometheusRuleGVK.Version)
+	if meta.IsNoMatchError(err) {
+		ctrl.Log.WithName("setup").Info("PrometheusRule CRD is not installed, alert rules are not imported")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pr := &unstructured.Unstructured{}
+	pr.SetGroupVersionKind(prometheusRuleGVK)
+	newObject := func() client.Object { return &corev1.Namespace{} }
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("prometheusrule").
+		Watches(&corev1.Namespace{}, &handler.EnqueueRequestForObject{}).
+		Watches(pr, handler.EnqueueRequestsFromMapFunc(objectToNamespace)).
+		Complete(grafana.HandleErrors(mgr, grafana.SelectInstance(mgr, r, newObject), newObject))
+}
+
+// objectToNamespace maps a namespaced object to its namespace.
+func objectToNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: obj.GetNamespace()}}}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// newRuleConverter returns a converter for the folder of namespace team-a.
+func newRuleConverter() *ruleConverter {
+	return &ruleConverter{
+		namespace:     "team-a",
+		orgID:         2,
+		folderUID:     "ns-team-a",
+		datasourceUID: "ds-team-a",
+		titles:        map[string]int{},
+		groupTitles:   map[string]bool{},
+	}
+}
+
+// prometheusRule returns a PrometheusRule with the given groups.
+func prometheusRule(name string, groups ...interface{}) *unstructured.Unstructured {
+	pr := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"groups": groups},
+	}}
+	pr.SetGroupVersionKind(prometheusRuleGVK)
+	pr.SetName(name)
+	pr.SetNamespace("team-a")
+	return pr
+}
+
+// ruleGroup returns a PrometheusRule group, the interval is left out when
+// empty.
+func ruleGroup(name, interval string, rules ...interface{}) map[string]interface{} {
+	group := map[string]interface{}{"name": name, "rules": rules}
+	if interval != "" {
+		group["interval"] = interval
+	}
+	return group
+}
+
+// alertingRule returns a PrometheusRule alerting rule, for is left out when
+// empty.
+func alertingRule(alert, forDuration string) map[string]interface{} {
+	rule := map[string]interface{}{"alert": alert, "expr": "up == 0"}
+	if forDuration != "" {
+		rule["for"] = forDuration
+	}
+	return rule
+}
+
+// titlesOf returns the group titles and the rule titles of groups.
+func titlesOf(groups []grafana.RuleGroup) ([]string, []string) {
+	var groupTitles, ruleTitles []string
+	for _, group := range groups {
+		groupTitles = append(groupTitles, group.Title)
+		for _, rule := range group.Rules {
+			ruleTitles = append(ruleTitles, rule.Title)
+		}
+	}
+	return groupTitles, ruleTitles
+}
+
+// uidsOf returns the UIDs of the rules of groups.
+func uidsOf(groups []grafana.RuleGroup) []string {
+	var uids []string
+	for _, group := range groups {
+		for _, rule := range group.Rules {
+			uids = append(uids, rule.UID)
+		}
+	}
+	return uids
+}
+
+var _ = Describe("PrometheusRule conversion", func() {
+	It("converts the alerting rules of every group", func() {
+		groups, err := newRuleConverter().convert(prometheusRule("api",
+			ruleGroup("availability", "",
+				alertingRule("APIDown", "5m"),
+				map[string]interface{}{"record": "job:up:sum", "expr": "sum(up)"},
+			),
+			ruleGroup("recording", "", map[string]interface{}{"record": "job:errors:rate5m", "expr": "rate(errors[5m])"}),
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups).To(HaveLen(1))
+		group := groups[0]
+		Expect(group.Title).To(Equal("api-availability"))
+		Expect(group.FolderUID).To(Equal("ns-team-a"))
+		Expect(group.Interval).To(Equal(int64(60)))
+		Expect(group.Rules).To(HaveLen(1))
+		rule := group.Rules[0]
+		Expect(rule.Title).To(Equal("APIDown"))
+		Expect(rule.RuleGroup).To(Equal("api-availability"))
+		Expect(rule.OrgID).To(Equal(int64(2)))
+		Expect(rule.For).To(Equal("5m"))
+		Expect(rule.Labels).To(Equal(map[string]string{"namespace": "team-a"}))
+		Expect(rule.Annotations).To(Equal(map[string]string{prometheusRuleAnnotation: "api"}))
+		Expect(rule.Data[0].DatasourceUID).To(Equal("ds-team-a"))
+		Expect(rule.Data[0].Model["expr"]).To(Equal("up == 0"))
+	})
+
+	DescribeTable("convert parses the durations of the groups and rules",
+		func(interval, forDuration string, wantInterval int64, wantFor string) {
+			groups, err := newRuleConverter().convert(prometheusRule("api", ruleGroup("availability", interval, alertingRule("APIDown", forDuration))))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(groups[0].Interval).To(Equal(wantInterval))
+			Expect(groups[0].Rules[0].For).To(Equal(wantFor))
+		},
+		Entry("defaults", "", "", int64(60), "0s"),
+		Entry("minutes", "2m", "10m", int64(120), "10m"),
+		Entry("mixed units", "1m30s", "1h30m", int64(90), "1h30m"),
+		Entry("interval rounded up to 10s", "15s", "", int64(20), "0s"),
+		Entry("interval below 10s", "1s", "", int64(10), "0s"),
+		Entry("sub-second interval", "10s500ms", "", int64(20), "0s"),
+	)
+
+	DescribeTable("convert skips the groups with invalid durations",
+		func(interval, forDuration, want string) {
+			groups, err := newRuleConverter().convert(prometheusRule("api",
+				ruleGroup("availability", interval, alertingRule("APIDown", forDuration)),
+				ruleGroup("latency", "", alertingRule("APISlow", "")),
+			))
+			Expect(err).To(MatchError(HavePrefix(want)))
+			groupTitles, ruleTitles := titlesOf(groups)
+			Expect(groupTitles).To(Equal([]string{"api-latency"}))
+			Expect(ruleTitles).To(Equal([]string{"APISlow"}))
+		},
+		Entry("interval", "often", "", "group availability: "),
+		Entry("for", "", "5 minutes", "group availability: alert APIDown: "),
+	)
+
+	It("numbers the rules sharing a title", func() {
+		converter := newRuleConverter()
+		first, err := converter.convert(prometheusRule("api", ruleGroup("availability", "", alertingRule("Down", ""), alertingRule("Down", ""))))
+		Expect(err).NotTo(HaveOccurred())
+		second, err := converter.convert(prometheusRule("web", ruleGroup("availability", "", alertingRule("Down", ""))))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, titles := titlesOf(append(first, second...))
+		Expect(titles).To(Equal([]string{"Down", "Down (2)", "Down (3)"}))
+	})
+
+	It("keeps the titles and UIDs when the groups are reordered", func() {
+		availability := ruleGroup("availability", "", alertingRule("APIDown", ""))
+		latency := ruleGroup("latency", "", alertingRule("APISlow", ""), alertingRule("APIDown", ""))
+		groups, err := newRuleConverter().convert(prometheusRule("api", availability, latency))
+		Expect(err).NotTo(HaveOccurred())
+		reordered, err := newRuleConverter().convert(prometheusRule("api", latency, availability))
+		Expect(err).NotTo(HaveOccurred())
+
+		groupTitles, ruleTitles := titlesOf(groups)
+		Expect(groupTitles).To(Equal([]string{"api-availability", "api-latency"}))
+		Expect(ruleTitles).To(Equal([]string{"APIDown", "APISlow", "APIDown (2)"}))
+		reorderedGroupTitles, reorderedRuleTitles := titlesOf(reordered)
+		Expect(reorderedGroupTitles).To(Equal(groupTitles))
+		Expect(reorderedRuleTitles).To(Equal(ruleTitles))
+		Expect(uidsOf(reordered)).To(Equal(uidsOf(groups)))
+		for _, uid := range uidsOf(groups) {
+			Expect(uid).To(MatchRegexp("^pr-[0-9a-f]{24}$"))
+		}
+	})
+
+	It("gives the rules of other namespaces other UIDs", func() {
+		pr := prometheusRule("api", ruleGroup("availability", "", alertingRule("APIDown", "")))
+		groups, err := newRuleConverter().convert(pr)
+		Expect(err).NotTo(HaveOccurred())
+		converter := newRuleConverter()
+		converter.namespace = "team-b"
+		other, err := converter.convert(pr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(uidsOf(other)).NotTo(Equal(uidsOf(groups)))
+	})
+
+	DescribeTable("groupTitle suffixes the titles which are taken or too long",
+		func(taken bool, prName, groupName string, want string) {
+			converter := newRuleConverter()
+			if taken {
+				converter.groupTitles[prName+"-"+groupName] = true
+			}
+			title := converter.groupTitle(prName, groupName)
+			Expect(title).To(MatchRegexp(want))
+			Expect(len(title)).To(BeNumerically("<=", maxRuleGroupTitle))
+			Expect(converter.groupTitles).To(HaveKey(title))
+		},
+		Entry("free", false, "api", "availability", "^api-availability$"),
+		Entry("taken", true, "api", "availability", "^api-availability-[0-9a-f]{8}$"),
+		Entry("too long", false, "api", strings.Repeat("g", 200), "^api-g{177}-[0-9a-f]{8}$"),
+	)
+
+	It("suffixes the same title the same way", func() {
+		a, b := newRuleConverter(), newRuleConverter()
+		a.groupTitles["api-availability"] = true
+		b.groupTitles["api-availability"] = true
+		Expect(a.groupTitle("api", "availability")).To(Equal(b.groupTitle("api", "availability")))
+		Expect(a.groupTitle("api-availability", "x")).NotTo(Equal(a.groupTitle("api", "availability-x")))
+	})
+
+	groups, err := newRuleConverter().convert(prometheusRule("api", ruleGroup("availability", "", alertingRule("APIDown", "5m"), alertingRule("APISlow", ""))))
+	It("converts the group compared", func() {
+		Expect(err).NotTo(HaveOccurred())
+	})
+	desired := groups[0]
+
+	// inGrafana returns desired as Grafana returns it, decoded from JSON and
+	// with the durations formatted by Grafana.
+	inGrafana := func(mutate func(group *grafana.RuleGroup)) *grafana.RuleGroup {
+		raw, _ := json.Marshal(desired)
+		group := &grafana.RuleGroup{}
+		_ = json.Unmarshal(raw, group)
+		group.Rules[0].For = "5m0s"
+		group.Rules[1].For = "0s"
+		if mutate != nil {
+			mutate(group)
+		}
+		return group
+	}
+
+	DescribeTable("ruleGroupInSync compares the fields the operator sets",
+		func(current *grafana.RuleGroup, want bool) {
+			Expect(ruleGroupInSync(current, &desired)).To(Equal(want))
+		},
+		Entry("same", inGrafana(nil), true),
+		Entry("rules reordered", inGrafana(func(group *grafana.RuleGroup) {
+			group.Rules[0], group.Rules[1] = group.Rules[1], group.Rules[0]
+		}), true),
+		Entry("fields added by Grafana", inGrafana(func(group *grafana.RuleGroup) {
+			group.Rules[0].Data[0].Model["hide"] = false
+		}), true),
+		Entry("other interval", inGrafana(func(group *grafana.RuleGroup) { group.Interval = 120 }), false),
+		Entry("other for", inGrafana(func(group *grafana.RuleGroup) { group.Rules[0].For = "10m" }), false),
+		Entry("other expression", inGrafana(func(group *grafana.RuleGroup) {
+			group.Rules[0].Data[0].Model["expr"] = "up == 1"
+		}), false),
+		Entry("other labels", inGrafana(func(group *grafana.RuleGroup) {
+			group.Rules[0].Labels["severity"] = "critical"
+		}), false),
+		Entry("rule removed", inGrafana(func(group *grafana.RuleGroup) { group.Rules = group.Rules[:1] }), false),
+		Entry("rule replaced", inGrafana(func(group *grafana.RuleGroup) { group.Rules[1].UID = "pr-other" }), false),
+	)
+})
@@ -0,0 +1,218 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	usernameKey = "grafana-username"
+	passwordKey = "grafana-password"
+	urlKey      = "grafana-url"
+	tokenKey    = "grafana-token"
+	// orgTokenKeyPrefix is followed by the ID of the org of the token.
+	orgTokenKeyPrefix = "grafana-token-org-"
+
+	// verifyTimeout bounds the request checking new credentials.
+	verifyTimeout = 10 * time.Second
+	// rejectedRequeueDelay is how often rejected credentials are checked
+	// again, Grafana may be updated after the Secret during a rotation.
+	rejectedRequeueDelay = time.Minute
+)
+
+// Get the Secret holding the Grafana credentials as a env, it lives in the
+// operator namespace. The credentials are read from the GRAFANA_* envs once
+// when it is empty.
+var credentialsSecret = os.Getenv("GRAFANA_CREDENTIALS_SECRET")
+var operatorNamespace = os.Getenv("OPERATOR_NAMESPACE")
+
+// Get Grafana URL, username, password and service account token as a env,
+// the URL is the default of the Secret.
+var grafanaURL = os.Getenv("GRAFANA_URL")
+var grafanaUsername = os.Getenv("GRAFANA_USERNAME")
+var grafanaPassword = os.Getenv("GRAFANA_PASSWORD")
+var grafanaToken = os.Getenv("GRAFANA_TOKEN")
+
+// CredentialsReconciler loads the Grafana credentials of the operator from a
+// Secret into a Connection, and swaps them whenever the Secret changes. It
+// runs on every replica, the webhooks need credentials too.
+type CredentialsReconciler struct {
+	client.Client
+	Connection *grafana.Connection
+	// Recorder reports an incomplete Secret on it.
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// Reconcile checks the credentials of the Secret against Grafana and loads
+// them. Rejected or incomplete credentials, and a missing Secret, do not
+// replace working ones.
+func (r *CredentialsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, req.NamespacedName, secret)
+	if errors.IsNotFound(err) {
+		logger.Info("Grafana credentials Secret not found, keeping the loaded credentials if any")
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get Grafana credentials Secret")
+		return ctrl.Result{}, err
+	}
+
+	creds, ok := credentialsFromSecret(ctx, secret, grafanaURL)
+	if !ok {
+		// A Secret being rewritten may be incomplete for a moment
+		keys := []string{urlKey, usernameKey, passwordKey, tokenKey, orgTokenKeyPrefix + "<org ID>"}
+		logger.Info("Grafana credentials Secret is incomplete, keeping the loaded credentials if any", "keys", keys)
+		r.Recorder.Eventf(secret, corev1.EventTypeWarning, "IncompleteCredentials",
+			"Grafana credentials are incomplete, a URL and %s and %s or a token are needed; the loaded credentials are kept", usernameKey, passwordKey)
+		return ctrl.Result{}, nil
+	}
+	current, err := r.Connection.Credentials()
+	loaded := err == nil
+	if loaded && reflect.DeepEqual(current, *creds) {
+		return ctrl.Result{}, nil
+	}
+
+	err = verify(ctx, *creds)
+	if grafana.IsUnauthorized(err) {
+		if loaded {
+			logger.Error(err, "Grafana rejected the new credentials, keeping the loaded ones")
+		} else {
+			logger.Error(err, "Grafana rejected the credentials")
+		}
+		return ctrl.Result{RequeueAfter: rejectedRequeueDelay}, nil
+	}
+	if err != nil {
+		// Grafana being down does not make the credentials invalid
+		logger.Error(err, "Unable to check Grafana credentials, loading them unchecked")
+	}
+	r.Connection.Set(creds)
+	logger.Info("Grafana credentials loaded", "url", creds.URL, "username", creds.Username,
+		"token", creds.Token != "", "orgTokens", len(creds.OrgTokens))
+	return ctrl.Result{}, nil
+}
+
+// credentialsFromSecret reads the credentials of a Secret, the URL defaults
+// to defaultURL. It reports whether they are complete.
+func credentialsFromSecret(ctx context.Context, secret *corev1.Secret, defaultURL string) (*grafana.Credentials, bool) {
+	creds := &grafana.Credentials{
+		URL:       string(secret.Data[urlKey]),
+		Username:  string(secret.Data[usernameKey]),
+		Password:  string(secret.Data[passwordKey]),
+		Token:     string(secret.Data[tokenKey]),
+		OrgTokens: map[uint]string{},
+	}
+	if creds.URL == "" {
+		creds.URL = defaultURL
+	}
+	for key, value := range secret.Data {
+		if !strings.HasPrefix(key, orgTokenKeyPrefix) {
+			continue
+		}
+		orgID, err := strconv.ParseUint(strings.TrimPrefix(key, orgTokenKeyPrefix), 10, 64)
+		if err != nil || orgID == 0 {
+			log.FromContext(ctx).Info("Ignoring Grafana token of invalid org ID", "key", key)
+			continue
+		}
+		creds.OrgTokens[uint(orgID)] = string(value)
+	}
+	if creds.Username == "" || creds.Password == "" {
+		creds.Username, creds.Password = "", ""
+	}
+	complete := creds.URL != "" && (creds.Username != "" || creds.Token != "" || len(creds.OrgTokens) > 0)
+	return creds, complete
+}
+
+// verify authenticates to Grafana with each credential of creds.
+func verify(ctx context.Context, creds grafana.Credentials) error {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+
+	check := func(single grafana.Credentials, orgID uint) error {
+		client, err := grafana.NewClient(single, orgID)
+		if err != nil {
+			return err
+		}
+		_, err = client.GetActualUser(ctx)
+		return err
+	}
+	if creds.Username != "" {
+		if err := check(grafana.Credentials{URL: creds.URL, Transport: creds.Transport, Username: creds.Username, Password: creds.Password}, 0); err != nil {
+			return err
+		}
+	}
+	if creds.Token != "" {
+		if err := check(grafana.Credentials{URL: creds.URL, Transport: creds.Transport, Token: creds.Token}, 0); err != nil {
+			return err
+		}
+	}
+	for orgID, token := range creds.OrgTokens {
+		if err := check(grafana.Credentials{URL: creds.URL, Transport: creds.Transport, OrgTokens: map[uint]string{orgID: token}}, orgID); err != nil {
+			return fmt.Errorf("token of org %d: %w", orgID, err)
+		}
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager. Without a Secret
+// the credentials of the envs are loaded as they are.
+func (r *CredentialsReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if credentialsSecret == "" {
+		ctrl.Log.WithName("setup").Info("GRAFANA_CREDENTIALS_SECRET is not set, Grafana credentials are read from the environment")
+		if grafanaURL == "" || (grafanaUsername == "" || grafanaPassword == "") && grafanaToken == "" {
+			return nil
+		}
+		creds := &grafana.Credentials{URL: grafanaURL, Username: grafanaUsername, Password: grafanaPassword, Token: grafanaToken}
+		r.Connection.Set(creds)
+		return nil
+	}
+
+	key := types.NamespacedName{Namespace: operatorNamespace, Name: credentialsSecret}
+	needLeaderElection := false
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("grafanacredentials").
+		For(&corev1.Secret{}, builder.OnlyMetadata, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return client.ObjectKeyFromObject(obj) == key
+		}))).
+		WithOptions(controller.Options{NeedLeaderElection: &needLeaderElection}).
+		Complete(r)
+}
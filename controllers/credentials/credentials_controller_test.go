@@ -0,0 +1,66 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+var _ = Describe("credentialsFromSecret", func() {
+	const defaultURL = "https://grafana.default"
+
+	DescribeTable("reads the credentials of the Secret",
+		func(data map[string]string, want grafana.Credentials, wantComplete bool) {
+			secret := &corev1.Secret{Data: map[string][]byte{}}
+			for key, value := range data {
+				secret.Data[key] = []byte(value)
+			}
+			got, complete := credentialsFromSecret(context.Background(), secret, defaultURL)
+			Expect(complete).To(Equal(wantComplete))
+			Expect(*got).To(Equal(want))
+		},
+		Entry("basic auth with the default URL",
+			map[string]string{usernameKey: "admin", passwordKey: "secret"},
+			grafana.Credentials{URL: defaultURL, Username: "admin", Password: "secret", OrgTokens: map[uint]string{}}, true),
+		Entry("token with its URL",
+			map[string]string{urlKey: "https://grafana.other", tokenKey: "glsa_1"},
+			grafana.Credentials{URL: "https://grafana.other", Token: "glsa_1", OrgTokens: map[uint]string{}}, true),
+		Entry("org tokens",
+			map[string]string{orgTokenKeyPrefix + "2": "glsa_2", orgTokenKeyPrefix + "0": "glsa_0", orgTokenKeyPrefix + "two": "glsa_two"},
+			grafana.Credentials{URL: defaultURL, OrgTokens: map[uint]string{2: "glsa_2"}}, true),
+		Entry("username without password",
+			map[string]string{usernameKey: "admin"},
+			grafana.Credentials{URL: defaultURL, OrgTokens: map[uint]string{}}, false),
+		Entry("only invalid org tokens",
+			map[string]string{orgTokenKeyPrefix + "x": "glsa_x"},
+			grafana.Credentials{URL: defaultURL, OrgTokens: map[uint]string{}}, false),
+		Entry("empty", nil, grafana.Credentials{URL: defaultURL, OrgTokens: map[uint]string{}}, false),
+	)
+
+	It("is incomplete without a URL", func() {
+		secret := &corev1.Secret{Data: map[string][]byte{tokenKey: []byte("glsa_1")}}
+		_, complete := credentialsFromSecret(context.Background(), secret, "")
+		Expect(complete).To(BeFalse())
+	})
+})
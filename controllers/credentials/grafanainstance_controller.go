@@ -0,0 +1,217 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	grafanav1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	conditionReady = "Ready"
+	// defaultCAKey is the key of the CA bundle in the Secret of caSecretRef.
+	defaultCAKey = "ca.crt"
+)
+
+// GrafanaInstanceReconciler loads the credentials of every GrafanaInstance
+// into the Registry, and keeps them in sync with the instance and its
+// Secrets. Like the CredentialsReconciler it runs on every replica.
+type GrafanaInstanceReconciler struct {
+	client.Client
+	Registry *grafana.Registry
+}
+
+//+kubebuilder:rbac:groups=grafana.snappcloud.io,resources=grafanainstances,verbs=get;list;watch
+//+kubebuilder:rbac:groups=grafana.snappcloud.io,resources=grafanainstances/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+// Reconcile checks the credentials of an instance against its Grafana and
+// loads them. As with the operator credentials, rejected credentials do not
+// replace working ones, and neither does a missing or incomplete Secret or
+// broken TLS settings: they only set Ready to False.
+func (r *GrafanaInstanceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	instance := &grafanav1alpha1.GrafanaInstance{}
+	err := r.Get(ctx, req.NamespacedName, instance)
+	if errors.IsNotFound(err) {
+		logger.Info("GrafanaInstance removed, unloading its credentials")
+		r.Registry.Remove(req.Name)
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get GrafanaInstance")
+		return ctrl.Result{}, err
+	}
+	conn := r.Registry.Connection(instance.Name)
+	r.Registry.SetDefault(instance.Name, instance.Spec.Default)
+
+	ref := instance.Spec.CredentialsSecretRef
+	secret := &corev1.Secret{}
+	err = r.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, secret)
+	if errors.IsNotFound(err) {
+		return ctrl.Result{}, r.setReady(ctx, instance, metav1.ConditionFalse, "SecretNotFound",
+			fmt.Sprintf("Secret %s/%s not found", ref.Namespace, ref.Name))
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get Grafana credentials Secret")
+		return ctrl.Result{}, err
+	}
+	creds, ok := credentialsFromSecret(ctx, secret, instance.Spec.URL)
+	if !ok {
+		return ctrl.Result{}, r.setReady(ctx, instance, metav1.ConditionFalse, "IncompleteCredentials",
+			fmt.Sprintf("Secret %s/%s has none of the keys %s and %s, %s or %s<org ID>",
+				ref.Namespace, ref.Name, usernameKey, passwordKey, tokenKey, orgTokenKeyPrefix))
+	}
+	// The instance URL wins over the one of the Secret
+	creds.URL = instance.Spec.URL
+	creds.Transport, err = r.transport(ctx, instance.Spec.TLS)
+	if err != nil {
+		return ctrl.Result{}, r.setReady(ctx, instance, metav1.ConditionFalse, "InvalidTLS", err.Error())
+	}
+
+	// The transport is rebuilt on every reconcile so a rotated CA is picked
+	// up, the credentials are checked with it each time
+	current, err := conn.Credentials()
+	loaded := err == nil
+	err = verify(ctx, *creds)
+	if grafana.IsUnauthorized(err) {
+		logger.Error(err, "Grafana rejected the credentials of the instance", "loaded", loaded)
+		if err := r.setReady(ctx, instance, metav1.ConditionFalse, "Unauthorized", err.Error()); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: rejectedRequeueDelay}, nil
+	}
+	if err != nil {
+		// Grafana being down does not make the credentials invalid
+		logger.Error(err, "Unable to check Grafana credentials of the instance, loading them unchecked")
+	}
+	conn.Set(creds)
+	if old, ok := current.Transport.(*http.Transport); ok && loaded {
+		old.CloseIdleConnections()
+	}
+	logger.Info("Grafana instance loaded", "url", creds.URL, "default", instance.Spec.Default)
+	return ctrl.Result{}, r.setReady(ctx, instance, metav1.ConditionTrue, "Loaded", "Credentials loaded")
+}
+
+// transport builds the HTTP transport of the TLS settings of an instance, nil
+// for the default one.
+func (r *GrafanaInstanceReconciler) transport(ctx context.Context, settings *grafanav1alpha1.InstanceTLS) (http.RoundTripper, error) {
+	if settings == nil || settings.CASecretRef == nil && !settings.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		//nolint:gosec // Explicitly requested by the GrafanaInstance
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+	if ref := settings.CASecretRef; ref != nil {
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, secret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get CA Secret %s/%s: %w", ref.Namespace, ref.Name, err)
+		}
+		key := ref.Key
+		if key == "" {
+			key = defaultCAKey
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(secret.Data[key]) {
+			return nil, fmt.Errorf("no PEM certificate in key %s of Secret %s/%s", key, ref.Namespace, ref.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// setReady records the Ready condition. Every replica loads the instances,
+// so the status is only written when it changes.
+func (r *GrafanaInstanceReconciler) setReady(ctx context.Context, instance *grafanav1alpha1.GrafanaInstance, status metav1.ConditionStatus, reason, message string) error {
+	before := meta.FindStatusCondition(instance.Status.Conditions, conditionReady)
+	if before != nil && before.Status == status && before.Reason == reason &&
+		before.Message == message && before.ObservedGeneration == instance.Generation {
+		return nil
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               conditionReady,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: instance.Generation,
+	})
+	err := r.Status().Update(ctx, instance)
+	if errors.IsConflict(err) {
+		// Another replica recorded it first
+		return nil
+	}
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Unable to update GrafanaInstance status")
+		return err
+	}
+	return nil
+}
+
+// secretToInstances enqueues the instances reading the Secret.
+func (r *GrafanaInstanceReconciler) secretToInstances(ctx context.Context, obj client.Object) []reconcile.Request {
+	list := &grafanav1alpha1.GrafanaInstanceList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "Unable to list GrafanaInstances")
+		return nil
+	}
+	refers := func(ref grafanav1alpha1.SecretReference) bool {
+		return ref.Namespace == obj.GetNamespace() && ref.Name == obj.GetName()
+	}
+	var requests []reconcile.Request
+	for _, instance := range list.Items {
+		tls := instance.Spec.TLS
+		if refers(instance.Spec.CredentialsSecretRef) || tls != nil && tls.CASecretRef != nil && refers(*tls.CASecretRef) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: instance.Name}})
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *GrafanaInstanceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	needLeaderElection := false
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&grafanav1alpha1.GrafanaInstance{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.secretToInstances), builder.OnlyMetadata).
+		WithOptions(controller.Options{NeedLeaderElection: &needLeaderElection}).
+		Complete(r)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	grafanav1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+var _ = Describe("GrafanaInstanceReconciler", func() {
+	const instanceName = "credentials-test"
+
+	var loaded *grafana.Credentials
+
+	BeforeEach(func() {
+		loaded = &grafana.Credentials{URL: "https://grafana.test", Username: "admin", Password: "secret"}
+		grafana.Instances.Connection(instanceName).Set(loaded)
+	})
+
+	AfterEach(func() {
+		grafana.Instances.Remove(instanceName)
+	})
+
+	credentialsRef := grafanav1alpha1.SecretReference{Namespace: "grafana", Name: "credentials"}
+
+	DescribeTable("keeps the loaded credentials",
+		func(tls *grafanav1alpha1.InstanceTLS, reason string, objs ...client.Object) {
+			instance := &grafanav1alpha1.GrafanaInstance{
+				ObjectMeta: metav1.ObjectMeta{Name: instanceName},
+				Spec: grafanav1alpha1.GrafanaInstanceSpec{
+					URL:                  "https://grafana.test",
+					CredentialsSecretRef: credentialsRef,
+					TLS:                  tls,
+				},
+			}
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+				WithObjects(append(objs, instance)...).
+				WithStatusSubresource(instance).
+				Build()
+			r := &GrafanaInstanceReconciler{Client: c, Registry: grafana.Instances}
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: instanceName}})
+			Expect(err).NotTo(HaveOccurred())
+
+			creds, err := grafana.Instances.Connection(instanceName).Credentials()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(creds).To(Equal(*loaded))
+
+			Expect(c.Get(context.Background(), types.NamespacedName{Name: instanceName}, instance)).To(Succeed())
+			ready := meta.FindStatusCondition(instance.Status.Conditions, conditionReady)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+			Expect(ready.Reason).To(Equal(reason))
+		},
+		Entry("when the Secret is missing", nil, "SecretNotFound"),
+		Entry("when the Secret is incomplete", nil, "IncompleteCredentials",
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: credentialsRef.Namespace, Name: credentialsRef.Name},
+				Data:       map[string][]byte{usernameKey: []byte("admin")},
+			}),
+		Entry("when the CA is invalid",
+			&grafanav1alpha1.InstanceTLS{CASecretRef: &grafanav1alpha1.SecretReference{Namespace: "grafana", Name: "ca"}},
+			"InvalidTLS",
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: credentialsRef.Namespace, Name: credentialsRef.Name},
+				Data:       map[string][]byte{usernameKey: []byte("admin"), passwordKey: []byte("rotated")},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "grafana", Name: "ca"},
+				Data:       map[string][]byte{defaultCAKey: []byte("not a certificate")},
+			}),
+	)
+})
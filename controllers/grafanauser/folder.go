@@ -0,0 +1,146 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafanauser
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/grafana-tools/sdk"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	grafanauserv1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	grafanauserv1beta1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// ensureFolderPermissions grants the users of every GrafanaUser in the
+// namespace access to the namespace folder, with the highest role a user is
+// listed with. Users not known to Grafana yet are skipped. The folder gets
+// the Grafana default permissions back once the namespace has no GrafanaUser,
+// it is not created then.
+func (r *GrafanaUserReconciler) ensureFolderPermissions(ctx context.Context, ns *corev1.Namespace, orgClient grafana.Client, users []sdk.User) error {
+	logger := log.FromContext(ctx)
+
+	// The folder is removed by the namespace controller, which only handles monitored namespaces
+	if _, ok := ns.Labels[nsMonitoringLabel]; !ok {
+		return nil
+	}
+
+	list := &grafanauserv1beta1.GrafanaUserList{}
+	err := r.List(ctx, list, client.InNamespace(ns.Name))
+	if err != nil {
+		logger.Error(err, "Failed to list GrafanaUsers")
+		return err
+	}
+
+	perms := grafana.DefaultFolderPermissions
+	if len(list.Items) > 0 {
+		members := make([]roleLists, 0, len(list.Items))
+		for i := range list.Items {
+			lists, err := resolveMembers(ctx, orgClient, &list.Items[i], time.Now())
+			if err != nil {
+				logger.Error(err, "Unable to resolve GrafanaUser groups", "grafanaUser", list.Items[i].Name)
+				return err
+			}
+			members = append(members, lists)
+		}
+		perms = folderPermissions(members, users)
+	}
+
+	var folder sdk.Folder
+	if len(list.Items) > 0 {
+		// The namespace controller removes the folder once the namespace goes
+		err = grafana.GuardNamespace(ctx, r.Client, ns)
+		if err != nil {
+			logger.Error(err, "Unable to add finalizer to Namespace")
+			return err
+		}
+		folder, err = grafana.EnsureNamespaceFolder(ctx, orgClient, ns.Name)
+	} else {
+		var ok bool
+		folder, ok, err = grafana.GetNamespaceFolder(ctx, orgClient, ns.Name)
+		if err == nil && !ok {
+			return nil
+		}
+	}
+	if err != nil {
+		logger.Error(err, "Unable to reconcile namespace folder")
+		return err
+	}
+	changed, err := grafana.SetFolderPermissions(ctx, orgClient, folder.UID, perms)
+	if err != nil {
+		logger.Error(err, "Unable to set folder permissions", "folder.UID", folder.UID)
+		return err
+	}
+	if changed {
+		logger.Info("Folder permissions updated", "folder.UID", folder.UID, "permissions", len(perms))
+	}
+	return nil
+}
+
+// folderPermissions maps the admin, edit and view lists of the GrafanaUsers to
+// folder permissions of the matching Grafana users.
+func folderPermissions(members []roleLists, users []sdk.User) []sdk.FolderPermission {
+	ids := map[string]uint{}
+	for _, user := range users {
+		ids[grafanauserv1alpha1.NormalizeUser(user.Email)] = user.ID
+		ids[grafanauserv1alpha1.NormalizeUser(user.Login)] = user.ID
+	}
+
+	highest := map[uint]sdk.PermissionType{}
+	grant := func(emails []string, permission sdk.PermissionType) {
+		for _, email := range emails {
+			id, ok := ids[grafanauserv1alpha1.NormalizeUser(email)]
+			if ok && highest[id] < permission {
+				highest[id] = permission
+			}
+		}
+	}
+	for _, lists := range members {
+		grant(lists.admin, sdk.PermissionAdmin)
+		grant(lists.edit, sdk.PermissionEdit)
+		grant(lists.view, sdk.PermissionView)
+	}
+
+	perms := make([]sdk.FolderPermission, 0, len(highest))
+	for id, permission := range highest {
+		perms = append(perms, sdk.FolderPermission{UserId: id, Permission: permission})
+	}
+	sort.Slice(perms, func(i, j int) bool { return perms[i].UserId < perms[j].UserId })
+	return perms
+}
+
+// namespaceToGrafanaUsers enqueues the GrafanaUsers of a namespace, so folder
+// permissions are set once the namespace is monitored.
+func (r *GrafanaUserReconciler) namespaceToGrafanaUsers(ctx context.Context, obj client.Object) []reconcile.Request {
+	list := &grafanauserv1beta1.GrafanaUserList{}
+	err := r.List(ctx, list, client.InNamespace(obj.GetName()))
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GrafanaUsers")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, gu := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&gu)})
+	}
+	return requests
+}
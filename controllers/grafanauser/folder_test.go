@@ -0,0 +1,65 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafanauser
+
+import (
+	"github.com/grafana-tools/sdk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("folderPermissions", func() {
+	users := []sdk.User{
+		{ID: 1, Email: "jane@snapp.cab", Login: "jane"},
+		{ID: 2, Email: "bob@snapp.cab", Login: "bob"},
+		{ID: 3, Email: "Al@Snapp.cab", Login: "al"},
+	}
+
+	DescribeTable("grants each known member its highest role",
+		func(members []roleLists, want []sdk.FolderPermission) {
+			Expect(folderPermissions(members, users)).To(Equal(want))
+		},
+		Entry("no members", nil, []sdk.FolderPermission{}),
+		Entry("roles",
+			[]roleLists{{admin: []string{"jane@snapp.cab"}, edit: []string{"bob"}, view: []string{"al"}}},
+			[]sdk.FolderPermission{
+				{UserId: 1, Permission: sdk.PermissionAdmin},
+				{UserId: 2, Permission: sdk.PermissionEdit},
+				{UserId: 3, Permission: sdk.PermissionView},
+			}),
+		Entry("email or login case-insensitively",
+			[]roleLists{{view: []string{"JANE", "al@snapp.cab"}}},
+			[]sdk.FolderPermission{
+				{UserId: 1, Permission: sdk.PermissionView},
+				{UserId: 3, Permission: sdk.PermissionView},
+			}),
+		Entry("highest role across GrafanaUsers",
+			[]roleLists{
+				{view: []string{"jane", "bob"}},
+				{edit: []string{"jane@snapp.cab"}, admin: []string{"bob"}},
+				{view: []string{"bob@snapp.cab"}},
+			},
+			[]sdk.FolderPermission{
+				{UserId: 1, Permission: sdk.PermissionEdit},
+				{UserId: 2, Permission: sdk.PermissionAdmin},
+			}),
+		Entry("unknown users skipped",
+			[]roleLists{{admin: []string{"ghost@snapp.cab"}, view: []string{"bob"}}},
+			[]sdk.FolderPermission{{UserId: 2, Permission: sdk.PermissionView}}),
+	)
+})
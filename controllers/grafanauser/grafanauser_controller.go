@@ -18,30 +18,45 @@ package grafanauser
 
 import (
 	"context"
-	"fmt"
 	"os"
-	"strings"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"github.com/grafana-tools/sdk"
 	grafanauserv1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	grafanauserv1beta1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+	"golang.org/x/exp/slices"
 	corev1 "k8s.io/api/core/v1"
 )
 
 const (
-	teamLabel = "snappcloud.io/team"
+	teamLabel         = "snappcloud.io/team"
+	nsMonitoringLabel = "monitoring.snappcloud.io/grafana-datasource"
+	// pendingRequeueDelay is how soon users who never logged in to Grafana
+	// are looked up again, doubled on every pass they are still pending up to
+	// maxPendingRequeueDelay.
+	pendingRequeueDelay    = time.Minute
+	maxPendingRequeueDelay = 30 * time.Minute
+	// orgRequeueDelay is how often a GrafanaUser waits for the team org to
+	// be created by the namespace controller.
+	orgRequeueDelay = time.Minute
 )
 
-// Get Grafana URL and PassWord as a env.
-var grafanaPassword = os.Getenv("GRAFANA_PASSWORD")
-var grafanaUsername = os.Getenv("GRAFANA_USERNAME")
-var grafanaURL = os.Getenv("GRAFANA_URL")
+// Add editors to the org as viewers as a env, they edit their namespace
+// folders through folder permissions only.
+var orgRoleViewerOnly, _ = strconv.ParseBool(os.Getenv("ORG_ROLE_VIEWER_ONLY"))
 
 // GrafanaReconciler reconciles a Grafana object
 type GrafanaUserReconciler struct {
@@ -70,7 +85,7 @@ func (r *GrafanaUserReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	reqLogger := log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
 	// Getting namespace
 	ns := &corev1.Namespace{}
-	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: req.Namespace}, ns)
+	err := r.Client.Get(ctx, types.NamespacedName{Name: req.Namespace}, ns)
 	if err != nil {
 		log.Error(err, "Failed to get namespace")
 		return ctrl.Result{}, err
@@ -82,28 +97,43 @@ func (r *GrafanaUserReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, nil
 	}
 	//Connecting to the Grafana API
-	grafanaclient, err := sdk.NewClient(grafanaURL, fmt.Sprintf("%s:%s", grafanaUsername, grafanaPassword), sdk.DefaultHTTPClient)
+	grafanaclient, err := grafana.FromContext(ctx).NewClient(0)
 	if err != nil {
 		reqLogger.Error(err, "Unable to create Grafana client")
 		return ctrl.Result{}, err
 	}
 	//Retrieving the Organization Info
 	retrievedOrg, err := grafanaclient.GetOrgByOrgName(ctx, org)
+	if grafana.IsNotFound(err) {
+		// The namespace controller creates the team org
+		reqLogger.Info("Waiting for team organization to be created", "team", org)
+		return ctrl.Result{RequeueAfter: orgRequeueDelay}, nil
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "Organization not found") {
-			reqLogger.Error(err, "Unable to get organization")
-			return ctrl.Result{}, err
-		}
+		reqLogger.Error(err, "Unable to get organization")
+		return ctrl.Result{}, err
+	}
+	getallUser, err := grafanaclient.GetAllUsers(ctx)
+	if err != nil {
+		reqLogger.Error(err, "Unable to get Grafana users")
+		return ctrl.Result{}, err
+	}
+	orgClient, err := grafana.FromContext(ctx).NewClient(retrievedOrg.ID)
+	if err != nil {
+		reqLogger.Error(err, "Unable to create Grafana client")
+		return ctrl.Result{}, err
 	}
 	reqLogger.Info("Reconciling grafana")
-	grafana := &grafanauserv1alpha1.GrafanaUser{}
-	err = r.Client.Get(context.TODO(), req.NamespacedName, grafana)
+	user := &grafanauserv1beta1.GrafanaUser{}
+	err = r.Client.Get(ctx, req.NamespacedName, user)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// Request object not found, could have been deleted after reconcile request.
 			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
-			// Return and don't requeue
-			return ctrl.Result{}, nil
+			// The remaining GrafanaUsers of the namespace define the folder permissions
+			resolvedMembers.forget(req.NamespacedName)
+			pendingBackoff.forget(req.NamespacedName)
+			return ctrl.Result{}, r.ensureFolderPermissions(ctx, ns, orgClient, getallUser)
 		}
 		// Error reading the object - requeue the request.
 		return ctrl.Result{}, err
@@ -112,36 +142,140 @@ func (r *GrafanaUserReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 	}
 
-	_, err = r.AddUsersToGrafanaOrgByEmail(ctx, req, org, grafanaclient, retrievedOrg, grafana.Spec.Admin, "admin")
+	now := time.Now()
+	members, err := resolveMembers(ctx, orgClient, user, now)
+	if err != nil {
+		reqLogger.Error(err, "Unable to resolve GrafanaUser groups")
+		return ctrl.Result{}, err
+	}
+	resolvedMembers.record(req.NamespacedName, members)
+	_, err = r.AddUsersToGrafanaOrgByEmail(ctx, req, org, grafanaclient, retrievedOrg, getallUser, members.admin, "admin")
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	_, err = r.AddUsersToGrafanaOrgByEmail(ctx, req, org, grafanaclient, retrievedOrg, grafana.Spec.Edit, "editor")
+	editRole := "editor"
+	if orgRoleViewerOnly {
+		editRole = "viewer"
+	}
+	_, err = r.AddUsersToGrafanaOrgByEmail(ctx, req, org, grafanaclient, retrievedOrg, getallUser, members.edit, editRole)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
-	_, err = r.AddUsersToGrafanaOrgByEmail(ctx, req, org, grafanaclient, retrievedOrg, grafana.Spec.View, "viewer")
+	_, err = r.AddUsersToGrafanaOrgByEmail(ctx, req, org, grafanaclient, retrievedOrg, getallUser, members.view, "viewer")
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	err = r.ensureFolderPermissions(ctx, ns, orgClient, getallUser)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Users who never logged in to Grafana are added on a later pass
+	pending := pendingUsers(members, getallUser)
+	changed := !slices.Equal(pending, user.Status.Pending)
+	if changed {
+		user.Status.Pending = pending
+		err = r.Status().Update(ctx, user)
+		if err != nil {
+			reqLogger.Error(err, "Unable to update GrafanaUser status")
+			return ctrl.Result{}, err
+		}
+	}
+	// Expired members lose their folder permissions on the pass after they expire
+	requeue := nextExpiry(user, now)
+	if len(pending) > 0 {
+		delay := pendingBackoff.next(req.NamespacedName, changed)
+		reqLogger.Info("Waiting for users to log in to Grafana", "pending", pending, "retryIn", delay)
+		if requeue == 0 || requeue > delay {
+			requeue = delay
+		}
+	} else {
+		pendingBackoff.forget(req.NamespacedName)
+	}
+	return ctrl.Result{RequeueAfter: requeue}, nil
 }
-func (r *GrafanaUserReconciler) AddUsersToGrafanaOrgByEmail(ctx context.Context, req ctrl.Request, org string, client *sdk.Client, retrievedOrg sdk.Org, emails []string, role string) (ctrl.Result, error) {
+
+// pendingBackoff spaces out the lookups of the users of a GrafanaUser which
+// stay pending, each lists every Grafana user.
+var pendingBackoff = &pendingDelays{delays: map[types.NamespacedName]time.Duration{}}
+
+type pendingDelays struct {
+	mu     sync.Mutex
+	delays map[types.NamespacedName]time.Duration
+}
+
+// next returns the delay before the next lookup of the pending users of key,
+// starting over when they changed.
+func (p *pendingDelays) next(key types.NamespacedName, changed bool) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delay, ok := p.delays[key]
+	switch {
+	case changed || !ok:
+		delay = pendingRequeueDelay
+	case delay < maxPendingRequeueDelay:
+		delay *= 2
+		if delay > maxPendingRequeueDelay {
+			delay = maxPendingRequeueDelay
+		}
+	}
+	p.delays[key] = delay
+	return delay
+}
+
+func (p *pendingDelays) forget(key types.NamespacedName) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.delays, key)
+}
+
+// pendingUsers returns the users of the GrafanaUser without a Grafana account.
+func pendingUsers(members roleLists, users []sdk.User) []string {
+	var pending []string
+	for _, list := range [][]string{members.admin, members.edit, members.view} {
+		for _, entry := range list {
+			found := false
+			for _, user := range users {
+				if sameUser(entry, user.Email, user.Login) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				pending = append(pending, entry)
+			}
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+func (r *GrafanaUserReconciler) AddUsersToGrafanaOrgByEmail(ctx context.Context, req ctrl.Request, org string, client grafana.Client, retrievedOrg sdk.Org, getallUser []sdk.User, emails []string, role string) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 	reqLogger := log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
 	orgID := retrievedOrg.ID
 	orgName := retrievedOrg.Name
-	getallUser, _ := client.GetAllUsers(ctx)
-	getuserOrg, _ := client.GetOrgUsers(ctx, orgID)
+	getuserOrg, err := client.GetOrgUsers(ctx, orgID)
+	if err != nil {
+		reqLogger.Error(err, "Unable to get organization users")
+		return ctrl.Result{}, err
+	}
 	for _, email := range emails {
 		var orguserfound bool
 		for _, orguser := range getuserOrg {
-			UserOrg := orguser.Email
-			if email == UserOrg {
+			if sameUser(email, orguser.Email, orguser.Login) {
 				orguserfound = true
 				reqLogger.Info(orguser.Email, "is already in", orgName)
+				// Editors keep their access through the folder permissions
+				if orgRoleViewerOnly && role == "viewer" && orguser.Role == "Editor" {
+					_, err = client.UpdateOrgUser(ctx, sdk.UserRole{LoginOrEmail: email, Role: "Viewer"}, orgID, orguser.ID)
+					if err != nil {
+						return ctrl.Result{}, err
+					}
+					log.Info(orguser.Email, "is reduced to viewer in", orgName)
+				}
 				break
 			}
 		}
@@ -149,14 +283,13 @@ func (r *GrafanaUserReconciler) AddUsersToGrafanaOrgByEmail(ctx context.Context,
 			continue
 		}
 		for _, user := range getallUser {
-			UserEmail := user.Email
-			if email == UserEmail {
+			if sameUser(email, user.Email, user.Login) {
 				newuser := sdk.UserRole{LoginOrEmail: email, Role: role}
-				_, err := client.AddOrgUser(ctx, newuser, orgID)
+				_, err = client.AddOrgUser(ctx, newuser, orgID)
 				if err != nil {
 					return ctrl.Result{}, err
 				} else {
-					log.Info(UserEmail, "is added to", orgName)
+					log.Info(user.Email, "is added to", orgName)
 				}
 				break
 			}
@@ -165,9 +298,22 @@ func (r *GrafanaUserReconciler) AddUsersToGrafanaOrgByEmail(ctx context.Context,
 	return ctrl.Result{}, nil
 }
 
+// sameUser reports whether a GrafanaUser entry is the Grafana user with the
+// given email and login. Entries written before the defaulter may differ in case.
+func sameUser(entry, email, login string) bool {
+	entry = grafanauserv1alpha1.NormalizeUser(entry)
+	return entry == grafanauserv1alpha1.NormalizeUser(email) || entry == grafanauserv1alpha1.NormalizeUser(login)
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *GrafanaUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := metrics.Registry.Register(&memberCollector{client: mgr.GetClient()})
+	if err != nil {
+		return err
+	}
+	newObject := func() client.Object { return &grafanauserv1beta1.GrafanaUser{} }
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&grafanauserv1alpha1.GrafanaUser{}).
-		Complete(r)
+		For(&grafanauserv1beta1.GrafanaUser{}).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.namespaceToGrafanaUsers)).
+		Complete(grafana.HandleErrors(mgr, grafana.SelectInstance(mgr, r, newObject), newObject))
 }
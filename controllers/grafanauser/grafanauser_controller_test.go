@@ -0,0 +1,133 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafanauser
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/grafana-tools/sdk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// orgUsersClient serves the users of an org and records the ones added, the
+// other calls are not implemented.
+type orgUsersClient struct {
+	grafana.Client
+	orgUsers   []sdk.OrgUser
+	orgUserErr error
+	added      []sdk.UserRole
+}
+
+func (c *orgUsersClient) GetOrgUsers(_ context.Context, _ uint) ([]sdk.OrgUser, error) {
+	return c.orgUsers, c.orgUserErr
+}
+
+func (c *orgUsersClient) AddOrgUser(_ context.Context, user sdk.UserRole, _ uint) (sdk.StatusMessage, error) {
+	c.added = append(c.added, user)
+	return sdk.StatusMessage{}, nil
+}
+
+var _ = Describe("Pending users", func() {
+	users := []sdk.User{
+		{Login: "jane", Email: "jane@snapp.cab"},
+		{Login: "john.doe", Email: "john@snapp.cab"},
+	}
+
+	DescribeTable("pendingUsers returns the members without a Grafana account, sorted",
+		func(members roleLists, want []string) {
+			Expect(pendingUsers(members, users)).To(Equal(want))
+		},
+		Entry("none", roleLists{}, []string(nil)),
+		Entry("found by email or login", roleLists{admin: []string{"jane@snapp.cab"}, view: []string{"john.doe"}}, []string(nil)),
+		Entry("case and spaces", roleLists{edit: []string{" Jane@Snapp.Cab", "JOHN.DOE"}}, []string(nil)),
+		Entry("missing in every list", roleLists{admin: []string{"zoe"}, edit: []string{"jane"}, view: []string{"bob@snapp.cab"}},
+			[]string{"bob@snapp.cab", "zoe"}),
+	)
+
+	Describe("pendingDelays", func() {
+		key := types.NamespacedName{Namespace: "team-a", Name: "users"}
+		var delays *pendingDelays
+		BeforeEach(func() {
+			delays = &pendingDelays{delays: map[types.NamespacedName]time.Duration{}}
+		})
+
+		It("doubles the delay while the same users stay pending, up to the cap", func() {
+			var got []time.Duration
+			for i := 0; i < 8; i++ {
+				got = append(got, delays.next(key, false))
+			}
+			Expect(got).To(Equal([]time.Duration{
+				time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute,
+				maxPendingRequeueDelay, maxPendingRequeueDelay, maxPendingRequeueDelay,
+			}))
+		})
+
+		It("starts over when the pending users change", func() {
+			delays.next(key, false)
+			delays.next(key, false)
+			Expect(delays.next(key, true)).To(Equal(pendingRequeueDelay))
+			Expect(delays.next(key, false)).To(Equal(2 * pendingRequeueDelay))
+		})
+
+		It("starts over once forgotten, and keeps the delays of other GrafanaUsers", func() {
+			other := types.NamespacedName{Namespace: "team-b", Name: "users"}
+			delays.next(key, false)
+			delays.next(key, false)
+			delays.next(other, false)
+			delays.next(other, false)
+
+			delays.forget(key)
+			Expect(delays.delays).NotTo(HaveKey(key))
+			Expect(delays.next(key, false)).To(Equal(pendingRequeueDelay))
+			Expect(delays.next(other, false)).To(Equal(4 * pendingRequeueDelay))
+		})
+	})
+})
+
+var _ = Describe("AddUsersToGrafanaOrgByEmail", func() {
+	org := sdk.Org{ID: 2, Name: "team-a"}
+	users := []sdk.User{
+		{Login: "jane", Email: "jane@snapp.cab"},
+		{Login: "john.doe", Email: "john@snapp.cab"},
+	}
+
+	It("adds the Grafana users missing from the org", func() {
+		client := &orgUsersClient{orgUsers: []sdk.OrgUser{{Login: "jane", Email: "jane@snapp.cab", Role: "Viewer"}}}
+		r := &GrafanaUserReconciler{}
+		_, err := r.AddUsersToGrafanaOrgByEmail(context.Background(), ctrl.Request{}, org.Name, client, org, users,
+			[]string{"jane@snapp.cab", "john.doe", "bob@snapp.cab"}, "viewer")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.added).To(Equal([]sdk.UserRole{{LoginOrEmail: "john.doe", Role: "viewer"}}))
+	})
+
+	It("returns the error listing the org users", func() {
+		client := &orgUsersClient{orgUserErr: errors.New("grafana unavailable")}
+		r := &GrafanaUserReconciler{}
+		_, err := r.AddUsersToGrafanaOrgByEmail(context.Background(), ctrl.Request{}, org.Name, client, org, users,
+			[]string{"john.doe"}, "viewer")
+		Expect(err).To(MatchError("grafana unavailable"))
+		Expect(client.added).To(BeEmpty())
+	})
+})
@@ -0,0 +1,106 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafanauser
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana-tools/sdk"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	grafanauserv1beta1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// roleLists holds the users of a GrafanaUser by role, as emails or logins.
+type roleLists struct {
+	admin []string
+	edit  []string
+	view  []string
+}
+
+func (l *roleLists) add(role grafanauserv1beta1.Role, user string) {
+	switch role {
+	case grafanauserv1beta1.RoleAdmin:
+		l.admin = append(l.admin, user)
+	case grafanauserv1beta1.RoleEditor:
+		l.edit = append(l.edit, user)
+	default:
+		l.view = append(l.view, user)
+	}
+}
+
+// resolveMembers returns the members of a GrafanaUser which have not expired
+// at now, and the members of its groups. Groups are the Grafana teams of the
+// org of client, groups missing in Grafana are skipped.
+func resolveMembers(ctx context.Context, client grafana.Client, gu *grafanauserv1beta1.GrafanaUser, now time.Time) (roleLists, error) {
+	var lists roleLists
+	for _, member := range gu.Spec.Members {
+		if !member.Expired(now) {
+			lists.add(member.Role, member.Name())
+		}
+	}
+	for _, group := range gu.Spec.Groups {
+		members, found, err := teamMembers(ctx, client, group.Name)
+		if err != nil {
+			return lists, err
+		}
+		if !found {
+			log.FromContext(ctx).Info("Grafana team of group not found, skipping", "group", group.Name)
+			continue
+		}
+		for _, member := range members {
+			user := member.Email
+			if user == "" {
+				user = member.Login
+			}
+			lists.add(group.Role, user)
+		}
+	}
+	return lists, nil
+}
+
+// teamMembers returns the members of the Grafana team with the given name.
+func teamMembers(ctx context.Context, client grafana.Client, name string) ([]sdk.TeamMember, bool, error) {
+	page, err := client.SearchTeams(ctx, sdk.WithQuery(name))
+	if err != nil {
+		return nil, false, err
+	}
+	for _, team := range page.Teams {
+		if team.Name == name {
+			members, err := client.GetTeamMembers(ctx, team.ID)
+			return members, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// nextExpiry returns how long until the next member of a GrafanaUser expires,
+// zero when no member expires.
+func nextExpiry(gu *grafanauserv1beta1.GrafanaUser, now time.Time) time.Duration {
+	var next time.Duration
+	for _, member := range gu.Spec.Members {
+		if member.ExpiresAt == nil || member.Expired(now) {
+			continue
+		}
+		if until := member.ExpiresAt.Sub(now); next == 0 || until < next {
+			next = until
+		}
+	}
+	return next
+}
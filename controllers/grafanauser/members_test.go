@@ -0,0 +1,123 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafanauser
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/grafana-tools/sdk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	grafanauserv1beta1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// teamsClient serves the Grafana teams of an org, the other calls are not
+// implemented.
+type teamsClient struct {
+	grafana.Client
+	teams   map[string][]sdk.TeamMember
+	teamErr error
+}
+
+func (c *teamsClient) SearchTeams(_ context.Context, _ ...sdk.SearchTeamParams) (sdk.PageTeams, error) {
+	names := make([]string, 0, len(c.teams))
+	for name := range c.teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	page := sdk.PageTeams{}
+	for i, name := range names {
+		page.Teams = append(page.Teams, sdk.Team{ID: uint(i + 1), Name: name})
+	}
+	return page, c.teamErr
+}
+
+func (c *teamsClient) GetTeamMembers(_ context.Context, teamID uint) ([]sdk.TeamMember, error) {
+	page, _ := c.SearchTeams(context.Background())
+	for _, team := range page.Teams {
+		if team.ID == teamID {
+			return c.teams[team.Name], nil
+		}
+	}
+	return nil, errors.New("team not found")
+}
+
+// membersCase is a GrafanaUser spec and the members it resolves to.
+type membersCase struct {
+	spec    grafanauserv1beta1.GrafanaUserSpec
+	teamErr error
+	want    roleLists
+	wantErr bool
+}
+
+var _ = Describe("resolveMembers", func() {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	past := metav1.NewTime(now.Add(-time.Hour))
+	future := metav1.NewTime(now.Add(time.Hour))
+	teams := map[string][]sdk.TeamMember{
+		"dev": {{Login: "dev"}},
+		"sre": {{Email: "ops@snapp.cab", Login: "ops"}, {Login: "oncall"}},
+	}
+
+	DescribeTable("lists the members by role",
+		func(tt membersCase) {
+			client := &teamsClient{teams: teams, teamErr: tt.teamErr}
+			gu := &grafanauserv1beta1.GrafanaUser{Spec: tt.spec}
+			got, err := resolveMembers(context.Background(), client, gu, now)
+			if tt.wantErr {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(tt.want))
+		},
+		Entry("members by role", membersCase{
+			spec: grafanauserv1beta1.GrafanaUserSpec{Members: []grafanauserv1beta1.Member{
+				{Email: "admin@snapp.cab", Role: grafanauserv1beta1.RoleAdmin},
+				{Login: "editor", Role: grafanauserv1beta1.RoleEditor},
+				{Email: "viewer@snapp.cab", Login: "viewer", Role: grafanauserv1beta1.RoleViewer},
+			}},
+			want: roleLists{admin: []string{"admin@snapp.cab"}, edit: []string{"editor"}, view: []string{"viewer@snapp.cab"}},
+		}),
+		Entry("expired members", membersCase{
+			spec: grafanauserv1beta1.GrafanaUserSpec{Members: []grafanauserv1beta1.Member{
+				{Login: "gone", Role: grafanauserv1beta1.RoleAdmin, ExpiresAt: &past},
+				{Login: "still", Role: grafanauserv1beta1.RoleAdmin, ExpiresAt: &future},
+			}},
+			want: roleLists{admin: []string{"still"}},
+		}),
+		Entry("groups", membersCase{
+			spec: grafanauserv1beta1.GrafanaUserSpec{Groups: []grafanauserv1beta1.GroupRef{
+				{Name: "sre", Role: grafanauserv1beta1.RoleEditor},
+				{Name: "missing", Role: grafanauserv1beta1.RoleAdmin},
+			}},
+			want: roleLists{edit: []string{"ops@snapp.cab", "oncall"}},
+		}),
+		Entry("team search failed", membersCase{
+			spec:    grafanauserv1beta1.GrafanaUserSpec{Groups: []grafanauserv1beta1.GroupRef{{Name: "sre", Role: grafanauserv1beta1.RoleViewer}}},
+			teamErr: errors.New("unavailable"),
+			wantErr: true,
+		}),
+	)
+})
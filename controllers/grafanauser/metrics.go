@@ -0,0 +1,145 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafanauser
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	grafanauserv1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	grafanauserv1beta1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+)
+
+// collectTimeout bounds the cache reads of a scrape.
+const collectTimeout = 5 * time.Second
+
+var (
+	pendingUsersDesc = prometheus.NewDesc("grafana_complementary_pending_users",
+		"Number of users of a GrafanaUser who never logged in to Grafana, from its status.",
+		[]string{"namespace", "grafanauser"}, nil)
+	orgMembersDesc = prometheus.NewDesc("grafana_complementary_org_members",
+		"Number of members the GrafanaUsers of a team grant a role in its org, groups resolved.",
+		[]string{"team", "role"}, nil)
+)
+
+// resolvedMembers records the members each GrafanaUser resolved to on its
+// last reconcile.
+var resolvedMembers = &memberRecords{members: map[types.NamespacedName]roleLists{}}
+
+type memberRecords struct {
+	mu      sync.Mutex
+	members map[types.NamespacedName]roleLists
+}
+
+func (m *memberRecords) record(key types.NamespacedName, members roleLists) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.members[key] = members
+}
+
+func (m *memberRecords) forget(key types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.members, key)
+}
+
+func (m *memberRecords) get(key types.NamespacedName) (roleLists, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members, ok := m.members[key]
+	return members, ok
+}
+
+// memberCollector reports the members and pending users of the GrafanaUsers.
+// It reads the cache on every scrape, so series of removed GrafanaUsers and
+// teams go away with them.
+type memberCollector struct {
+	client client.Reader
+}
+
+func (c *memberCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingUsersDesc
+	ch <- orgMembersDesc
+}
+
+func (c *memberCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	logger := log.Log.WithName("metrics")
+
+	list := &grafanauserv1beta1.GrafanaUserList{}
+	err := c.client.List(ctx, list)
+	if err != nil {
+		logger.Error(err, "Unable to list GrafanaUsers")
+		return
+	}
+	// Editors are Viewers of the org when they edit through folder permissions only
+	editRole := "Editor"
+	if orgRoleViewerOnly {
+		editRole = "Viewer"
+	}
+	teams := map[string]string{}
+	// The role of each member of a team, the highest one it is granted
+	roles := map[string]map[string]string{}
+	for _, gu := range list.Items {
+		ch <- prometheus.MustNewConstMetric(pendingUsersDesc, prometheus.GaugeValue, float64(len(gu.Status.Pending)), gu.Namespace, gu.Name)
+
+		members, ok := resolvedMembers.get(types.NamespacedName{Namespace: gu.Namespace, Name: gu.Name})
+		if !ok {
+			continue
+		}
+		team, ok := teams[gu.Namespace]
+		if !ok {
+			ns := &corev1.Namespace{}
+			if c.client.Get(ctx, client.ObjectKey{Name: gu.Namespace}, ns) == nil {
+				team = ns.Labels[teamLabel]
+			}
+			teams[gu.Namespace] = team
+		}
+		if team == "" {
+			continue
+		}
+		if roles[team] == nil {
+			roles[team] = map[string]string{}
+		}
+		// Lower roles first so higher ones overwrite them
+		for _, granted := range []struct {
+			role  string
+			users []string
+		}{{"Viewer", members.view}, {editRole, members.edit}, {"Admin", members.admin}} {
+			for _, user := range granted.users {
+				roles[team][grafanauserv1alpha1.NormalizeUser(user)] = granted.role
+			}
+		}
+	}
+	for team, members := range roles {
+		counts := map[string]int{"Admin": 0, "Editor": 0, "Viewer": 0}
+		for _, role := range members {
+			counts[role]++
+		}
+		for role, count := range counts {
+			ch <- prometheus.MustNewConstMetric(orgMembersDesc, prometheus.GaugeValue, float64(count), team, role)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	// BackendGrafanaOperatorV4 emits integreatly.org/v1alpha1 GrafanaDataSource objects.
+	BackendGrafanaOperatorV4 = "grafana-operator-v4"
+	// BackendGrafanaOperatorV5 emits grafana.integreatly.org/v1beta1 GrafanaDatasource objects.
+	BackendGrafanaOperatorV5 = "grafana-operator-v5"
+	// BackendGrafanaAPI manages datasources through the Grafana HTTP API.
+	BackendGrafanaAPI = "grafana-api"
+
+	// managedByLabel marks the datasource objects written by the operator.
+	managedByLabel = grafana.ManagedByLabel
+	managedByValue = grafana.ManagedByValue
+	// specHashAnnotation records the hash of the spec last written by the
+	// operator, another spec means the object was edited by someone else.
+	specHashAnnotation = "grafana.snappcloud.io/spec-hash"
+)
+
+// Get the datasource backend and the grafana-operator v5 instance selector as a env.
+var datasourceBackend = os.Getenv("DATASOURCE_BACKEND")
+var grafanaInstanceSelector = os.Getenv("GRAFANA_INSTANCE_SELECTOR")
+
+// Datasource is the backend independent description of a generated
+// Prometheus datasource.
+type Datasource struct {
+	// Name of both the Kubernetes object and the Grafana datasource.
+	Name string
+	// UID of the Grafana datasource, used by backends talking to Grafana directly.
+	UID string
+	// OrgID is the Grafana organization the datasource belongs to.
+	OrgID int64
+	// Token authenticates the datasource against the label-enforcing proxy.
+	Token string
+	// Namespace is sent to the label-enforcing proxy in the namespace header.
+	Namespace string
+}
+
+// Backend makes Grafana serve the generated datasources.
+type Backend interface {
+	// EnsureDatasource creates the datasource or repairs its drift. The owner
+	// is set as controller of any Kubernetes object created for it.
+	EnsureDatasource(ctx context.Context, ds *Datasource, owner client.Object) error
+	// Watch registers the objects owned by the backend on the controller.
+	Watch(b *builder.Builder) *builder.Builder
+}
+
+// DatasourceDeleter is implemented by backends whose datasources are not
+// garbage collected with the namespace. The reconciler then guards namespaces
+// with a finalizer and records where their datasource lives.
+type DatasourceDeleter interface {
+	// DeleteDatasource removes the datasource with the given UID from the org.
+	DeleteDatasource(ctx context.Context, orgID int64, uid string) error
+}
+
+// NewBackend returns the backend with the given name, an empty name selects
+// grafana-operator v4 for backward compatibility.
+// Drift of the datasource objects is reported as events on their owner.
+func NewBackend(name string, c client.Client, scheme *runtime.Scheme, recorder record.EventRecorder) (Backend, error) {
+	switch name {
+	case "", BackendGrafanaOperatorV4:
+		return &grafanaOperatorV4Backend{Client: c, Scheme: scheme, Recorder: recorder}, nil
+	case BackendGrafanaOperatorV5:
+		selector, err := parseInstanceSelector(grafanaInstanceSelector)
+		if err != nil {
+			return nil, err
+		}
+		return &grafanaOperatorV5Backend{Client: c, Scheme: scheme, Recorder: recorder, InstanceSelector: selector}, nil
+	case BackendGrafanaAPI:
+		return &grafanaAPIBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown datasource backend %q", name)
+	}
+}
+
+// supportsInstance reports whether the datasource backend can provision a
+// namespace selecting the Grafana instance, the grafana-operator backends
+// only write to the Grafana of grafana-operator.
+func supportsInstance(instance string) bool {
+	return datasourceBackend == BackendGrafanaAPI || grafana.Instances.IsDefault(instance)
+}
+
+// parseInstanceSelector parses a comma separated list of key=value pairs.
+func parseInstanceSelector(s string) (map[string]string, error) {
+	selector := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid grafana instance selector %q", pair)
+		}
+		selector[key] = value
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("grafana instance selector is required by the %s backend", BackendGrafanaOperatorV5)
+	}
+	return selector, nil
+}
+
+// specHash returns the hash of a datasource object spec.
+func specHash(spec interface{}) string {
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// reportDrift emits an event on the owner when the spec of obj is not the
+// one last written by the operator. Objects written before the hash was
+// recorded are not reported.
+func reportDrift(recorder record.EventRecorder, owner, obj client.Object, kind string, spec interface{}) {
+	recorded := obj.GetAnnotations()[specHashAnnotation]
+	if recorder == nil || owner == nil || recorded == "" || recorded == specHash(spec) {
+		return
+	}
+	recorder.Eventf(owner, corev1.EventTypeWarning, "DatasourceDrift",
+		"%s %s/%s was changed outside the operator, the change is reverted", kind, obj.GetNamespace(), obj.GetName())
+}
+
+// recordSpecHash records the hash of the spec of obj, as stored by the API
+// server, once the operator wrote it.
+func recordSpecHash(ctx context.Context, c client.Client, obj client.Object, spec interface{}) error {
+	hash := specHash(spec)
+	if obj.GetAnnotations()[specHashAnnotation] == hash {
+		return nil
+	}
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[specHashAnnotation] = hash
+	obj.SetAnnotations(annotations)
+	return c.Patch(ctx, obj, patch)
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/grafana-tools/sdk"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// secureJSONHashKey keeps a hash of the secure fields in jsonData, Grafana
+// never returns secureJsonData so this is the only way to detect their drift.
+const secureJSONHashKey = "snappcloudSecureJsonDataHash"
+
+// grafanaAPIBackend manages datasources directly through the Grafana HTTP API,
+// for Grafana instances which are not run by grafana-operator.
+type grafanaAPIBackend struct{}
+
+func (b *grafanaAPIBackend) EnsureDatasource(ctx context.Context, ds *Datasource, owner client.Object) error {
+	logger := log.FromContext(ctx).WithValues("datasource.Name", ds.Name, "datasource.UID", ds.UID, "orgID", ds.OrgID)
+
+	client, err := newGrafanaClient(ctx, uint(ds.OrgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return err
+	}
+	desired, err := b.generateDatasource(ds)
+	if err != nil {
+		return err
+	}
+
+	existing, err := findDatasource(ctx, client, ds.UID, ds.Name)
+	if err != nil {
+		logger.Error(err, "Unable to list Grafana datasources")
+		return err
+	}
+	if existing == nil {
+		logger.Info("Creating Grafana datasource")
+		msg, err := client.CreateDatasource(ctx, desired)
+		if err != nil {
+			logger.Error(err, "Unable to create Grafana datasource")
+			return err
+		}
+		if msg.ID == nil {
+			err = fmt.Errorf("datasource %q was not created: %s", ds.Name, stringValue(msg.Message))
+			logger.Error(err, "Unable to create Grafana datasource")
+			return err
+		}
+		return nil
+	}
+
+	if datasourceInSync(existing, &desired) {
+		return nil
+	}
+	if existing.UID != desired.UID {
+		// Grafana rejects a second datasource with the same name, so one
+		// created by hand or before the operator managed it is taken over
+		logger.Info("Adopting Grafana datasource with the same name", "datasource.ID", existing.ID, "previousUID", existing.UID)
+	}
+	logger.Info("Updating Grafana datasource", "datasource.ID", existing.ID)
+	desired.ID = existing.ID
+	msg, err := client.UpdateDatasource(ctx, desired)
+	if err != nil {
+		logger.Error(err, "Unable to update Grafana datasource")
+		return err
+	}
+	if msg.ID == nil {
+		err = fmt.Errorf("datasource %q was not updated: %s", ds.Name, stringValue(msg.Message))
+		logger.Error(err, "Unable to update Grafana datasource")
+		return err
+	}
+	return nil
+}
+
+// DeleteDatasource removes the datasource from Grafana, it is a no-op when the
+// datasource is already gone.
+func (b *grafanaAPIBackend) DeleteDatasource(ctx context.Context, orgID int64, uid string) error {
+	logger := log.FromContext(ctx).WithValues("datasource.UID", uid, "orgID", orgID)
+
+	client, err := newGrafanaClient(ctx, uint(orgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return err
+	}
+	existing, err := findDatasource(ctx, client, uid, "")
+	if err != nil {
+		logger.Error(err, "Unable to list Grafana datasources")
+		return err
+	}
+	if existing == nil {
+		return nil
+	}
+	logger.Info("Deleting Grafana datasource", "datasource.Name", existing.Name)
+	_, err = client.DeleteDatasource(ctx, existing.ID)
+	if err != nil {
+		logger.Error(err, "Unable to delete Grafana datasource")
+		return err
+	}
+	return nil
+}
+
+// Watch does nothing, datasources in Grafana do not emit Kubernetes events.
+func (b *grafanaAPIBackend) Watch(bld *builder.Builder) *builder.Builder {
+	return bld
+}
+
+func (b *grafanaAPIBackend) generateDatasource(ds *Datasource) (sdk.Datasource, error) {
+	secureJSONData := map[string]interface{}{
+		"httpHeaderValue1": "Bearer " + ds.Token,
+		"httpHeaderValue2": ds.Namespace,
+	}
+	raw, err := json.Marshal(secureJSONData)
+	if err != nil {
+		return sdk.Datasource{}, err
+	}
+	hash := sha256.Sum256(raw)
+	return sdk.Datasource{
+		OrgID:     uint(ds.OrgID),
+		UID:       ds.UID,
+		Name:      ds.Name,
+		Type:      "prometheus",
+		Access:    "proxy",
+		URL:       prometheusURL,
+		IsDefault: false,
+		JSONData: map[string]interface{}{
+			"httpMethod":      "POST",
+			"tlsSkipVerify":   true,
+			"httpHeaderName1": "Authorization",
+			"httpHeaderName2": "namespace",
+			secureJSONHashKey: hex.EncodeToString(hash[:]),
+		},
+		SecureJSONData: secureJSONData,
+	}, nil
+}
+
+// findDatasource returns the datasource with the given UID in the org of the
+// client, or the one with the given name when no datasource has the UID and
+// name is set. It returns nil when there is none.
+func findDatasource(ctx context.Context, client grafana.Client, uid, name string) (*sdk.Datasource, error) {
+	datasources, err := client.GetAllDatasources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range datasources {
+		if datasources[i].UID == uid {
+			return &datasources[i], nil
+		}
+	}
+	for i := range datasources {
+		if name != "" && datasources[i].Name == name {
+			return &datasources[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// datasourceInSync compares the fields managed by the operator. jsonData is
+// compared in its decoded JSON form, as returned by Grafana.
+func datasourceInSync(existing, desired *sdk.Datasource) bool {
+	if existing.UID != desired.UID || existing.Name != desired.Name || existing.Type != desired.Type || existing.Access != desired.Access ||
+		existing.URL != desired.URL || existing.IsDefault != desired.IsDefault {
+		return false
+	}
+	raw, err := json.Marshal(desired.JSONData)
+	if err != nil {
+		return false
+	}
+	var jsonData interface{}
+	if err := json.Unmarshal(raw, &jsonData); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(existing.JSONData, jsonData)
+}
+
+// datasourceUID derives a stable Grafana UID from the datasource name. Grafana
+// limits UIDs to 40 characters, which namespace names may exceed.
+func datasourceUID(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return "ds-" + hex.EncodeToString(hash[:])[:24]
+}
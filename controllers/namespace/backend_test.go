@@ -0,0 +1,215 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/grafana-tools/sdk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// datasourcesClient is a Grafana client of an org holding datasources.
+type datasourcesClient struct {
+	grafana.Client
+	datasources []sdk.Datasource
+}
+
+func (c *datasourcesClient) GetAllDatasources(ctx context.Context) ([]sdk.Datasource, error) {
+	return c.datasources, nil
+}
+
+var _ = Describe("Backends", func() {
+	DescribeTable("parseInstanceSelector reads the labels of the grafana-operator instances",
+		func(selector string, want map[string]string) {
+			Expect(parseInstanceSelector(selector)).To(Equal(want))
+		},
+		Entry("single label", "dashboards=grafana", map[string]string{"dashboards": "grafana"}),
+		Entry("spaces and trailing comma", " dashboards=grafana , env=prod,", map[string]string{"dashboards": "grafana", "env": "prod"}),
+		Entry("empty value", "dashboards=", map[string]string{"dashboards": ""}),
+	)
+
+	DescribeTable("parseInstanceSelector refuses invalid selectors",
+		func(selector string) {
+			_, err := parseInstanceSelector(selector)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("empty", ""),
+		Entry("only separators", " , "),
+		Entry("no value", "dashboards"),
+		Entry("no key", "=grafana"),
+	)
+
+	DescribeTable("NewBackend selects the backend by name",
+		func(name string, want Backend) {
+			backend, err := NewBackend(name, nil, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend).To(BeAssignableToTypeOf(want))
+		},
+		Entry("default", "", &grafanaOperatorV4Backend{}),
+		Entry("grafana-operator v4", BackendGrafanaOperatorV4, &grafanaOperatorV4Backend{}),
+		Entry("Grafana API", BackendGrafanaAPI, &grafanaAPIBackend{}),
+	)
+
+	It("NewBackend gives the grafana-operator v5 backend its instance selector", func() {
+		defer func(selector string) { grafanaInstanceSelector = selector }(grafanaInstanceSelector)
+		grafanaInstanceSelector = "dashboards=grafana"
+		backend, err := NewBackend(BackendGrafanaOperatorV5, nil, nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.(*grafanaOperatorV5Backend).InstanceSelector).To(Equal(map[string]string{"dashboards": "grafana"}))
+
+		grafanaInstanceSelector = ""
+		_, err = NewBackend(BackendGrafanaOperatorV5, nil, nil, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("NewBackend refuses unknown backends", func() {
+		_, err := NewBackend("grafana-operator-v3", nil, nil, nil)
+		Expect(err).To(MatchError(ContainSubstring("grafana-operator-v3")))
+	})
+})
+
+var _ = Describe("Grafana API backend", func() {
+	datasources := []sdk.Datasource{
+		{ID: 1, UID: "ds-a", Name: "team-a"},
+		{ID: 2, UID: "ds-b", Name: "team-b"},
+	}
+
+	DescribeTable("findDatasource looks datasources up by UID, then by name",
+		func(uid, name string, want *sdk.Datasource) {
+			found, err := findDatasource(context.Background(), &datasourcesClient{datasources: datasources}, uid, name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(Equal(want))
+		},
+		Entry("by UID", "ds-b", "team-a", &datasources[1]),
+		Entry("by name", "ds-c", "team-a", &datasources[0]),
+		Entry("unknown", "ds-c", "team-c", (*sdk.Datasource)(nil)),
+		Entry("unknown UID without name", "ds-c", "", (*sdk.Datasource)(nil)),
+	)
+
+	desired, err := (&grafanaAPIBackend{}).generateDatasource(&Datasource{Name: "team-a", UID: "ds-a", OrgID: 2, Token: "token", Namespace: "team-a"})
+	It("generates the datasource", func() {
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	// inGrafana returns desired as Grafana returns it, with jsonData decoded
+	// from JSON and without secureJsonData.
+	inGrafana := func(mutate func(ds *sdk.Datasource)) *sdk.Datasource {
+		ds := desired
+		ds.ID = 1
+		ds.SecureJSONData = nil
+		ds.JSONData = map[string]interface{}{}
+		for key, value := range desired.JSONData.(map[string]interface{}) {
+			ds.JSONData.(map[string]interface{})[key] = value
+		}
+		if mutate != nil {
+			mutate(&ds)
+		}
+		return &ds
+	}
+
+	DescribeTable("datasourceInSync compares the fields managed by the operator",
+		func(existing *sdk.Datasource, want bool) {
+			Expect(datasourceInSync(existing, &desired)).To(Equal(want))
+		},
+		Entry("same", inGrafana(nil), true),
+		Entry("other UID", inGrafana(func(ds *sdk.Datasource) { ds.UID = "old" }), false),
+		Entry("other URL", inGrafana(func(ds *sdk.Datasource) { ds.URL = "http://other" }), false),
+		Entry("default datasource", inGrafana(func(ds *sdk.Datasource) { ds.IsDefault = true }), false),
+		Entry("other token", inGrafana(func(ds *sdk.Datasource) {
+			ds.JSONData.(map[string]interface{})[secureJSONHashKey] = "other"
+		}), false),
+		Entry("extra jsonData", inGrafana(func(ds *sdk.Datasource) {
+			ds.JSONData.(map[string]interface{})["timeInterval"] = "30s"
+		}), false),
+	)
+
+	It("adopts the datasource with the same name", func() {
+		server := &grafanaServer{responses: map[string]string{
+			"GET /api/datasources":   `[{"id":7,"uid":"created-by-hand","name":"team-a","type":"prometheus"}]`,
+			"PUT /api/datasources/7": `{"id":7,"message":"Datasource updated"}`,
+		}}
+		ctx, stop := withGrafana(server)
+		defer stop()
+
+		Expect((&grafanaAPIBackend{}).EnsureDatasource(ctx, &Datasource{Name: "team-a", UID: "ds-a", OrgID: 2, Token: "token", Namespace: "team-a"}, nil)).To(Succeed())
+		Expect(server.called()).To(Equal([]string{"GET /api/datasources", "PUT /api/datasources/7"}))
+		Expect(server.body("PUT /api/datasources/7")).To(ContainSubstring(`"uid":"ds-a"`))
+	})
+
+	It("deletes the recorded datasource when the namespace is finalized", func() {
+		server := &grafanaServer{responses: map[string]string{
+			"GET /api/datasources":      `[{"id":7,"uid":"ds-a","name":"team-a"}]`,
+			"DELETE /api/datasources/7": `{"message":"Data source deleted"}`,
+		}}
+		ctx, stop := withGrafana(server)
+		defer stop()
+
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:       "team-a",
+			Finalizers: []string{datasourceFinalizer},
+			Annotations: map[string]string{
+				datasourceUIDAnnotation: "ds-a",
+				datasourceOrgAnnotation: "2",
+				"other":                 "kept",
+			},
+		}}
+		r := &NamespaceReconciler{
+			Client:  fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(ns).Build(),
+			Backend: &grafanaAPIBackend{},
+		}
+		Expect(r.finalizeNamespace(ctx, ns)).To(Succeed())
+		Expect(server.called()).To(ContainElement("DELETE /api/datasources/7"))
+
+		finalized := &corev1.Namespace{}
+		Expect(r.Get(ctx, client.ObjectKeyFromObject(ns), finalized)).To(Succeed())
+		Expect(finalized.Finalizers).To(BeEmpty())
+		Expect(finalized.Annotations).To(Equal(map[string]string{"other": "kept"}))
+	})
+
+	It("keeps the finalizer when the datasource cannot be deleted", func() {
+		server := &grafanaServer{responses: map[string]string{
+			"GET /api/datasources": `[{"id":7,"uid":"ds-a","name":"team-a"}]`,
+		}}
+		ctx, stop := withGrafana(server)
+		defer stop()
+
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "team-a",
+			Finalizers:  []string{datasourceFinalizer},
+			Annotations: map[string]string{datasourceUIDAnnotation: "ds-a", datasourceOrgAnnotation: "2"},
+		}}
+		r := &NamespaceReconciler{
+			Client:  fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(ns).Build(),
+			Backend: &grafanaAPIBackend{},
+		}
+		Expect(r.finalizeNamespace(ctx, ns)).NotTo(Succeed())
+
+		kept := &corev1.Namespace{}
+		Expect(r.Get(ctx, client.ObjectKeyFromObject(ns), kept)).To(Succeed())
+		Expect(kept.Finalizers).To(ConsistOf(datasourceFinalizer))
+	})
+})
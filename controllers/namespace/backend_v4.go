@@ -0,0 +1,131 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+
+	grafanav1alpha1 "github.com/grafana-operator/grafana-operator/v4/api/integreatly/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// grafanaOperatorV4Backend writes datasources as grafana-operator v4
+// GrafanaDataSource objects in baseNs.
+type grafanaOperatorV4Backend struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+func (b *grafanaOperatorV4Backend) EnsureDatasource(ctx context.Context, ds *Datasource, owner client.Object) error {
+	logger := log.FromContext(ctx)
+
+	gfDs, err := b.generateGfDataSource(ds, owner)
+	if err != nil {
+		logger.Error(err, "Error generating grafanaDatasource manifest")
+		return err
+	}
+
+	// Check if grafanaDatasource does not exist and create a new one
+	found := &grafanav1alpha1.GrafanaDataSource{}
+	err = b.Get(ctx, types.NamespacedName{Name: gfDs.Name, Namespace: baseNs}, found)
+	if err != nil && errors.IsNotFound(err) {
+		logger.Info("Creating grafana datasource", "grafanaDatasource.Name", gfDs.Name)
+		err = b.Create(ctx, gfDs)
+		if err != nil {
+			logger.Error(err, "Unable to create GrafanaDataSource")
+			return err
+		}
+		return recordSpecHash(ctx, b.Client, gfDs, gfDs.Spec)
+	} else if err != nil {
+		logger.Error(err, "Failed to get grafanaDatasource")
+		return err
+	}
+
+	// If GrafanaDatasource already exist, check if it is deeply equal with desrired state
+	if !reflect.DeepEqual(gfDs.Spec, found.Spec) || found.Labels[managedByLabel] != managedByValue {
+		reportDrift(b.Recorder, owner, found, "GrafanaDataSource", found.Spec)
+		logger.Info("Updating grafanaDatasource", "grafanaDatasource.Namespace", found.Namespace, "grafanaDatasource.Name", found.Name)
+		found.Spec = gfDs.Spec
+		if found.Labels == nil {
+			found.Labels = map[string]string{}
+		}
+		found.Labels[managedByLabel] = managedByValue
+		err := b.Update(ctx, found)
+		if err != nil {
+			logger.Error(err, "Failed to update grafanaDatasource", "grafanaDatasource.Namespace", found.Namespace, "grafanaDatasource.Name", found.Name)
+			return err
+		}
+	}
+	return recordSpecHash(ctx, b.Client, found, found.Spec)
+}
+
+func (b *grafanaOperatorV4Backend) Watch(bld *builder.Builder) *builder.Builder {
+	return bld.Owns(&grafanav1alpha1.GrafanaDataSource{})
+}
+
+func (b *grafanaOperatorV4Backend) generateGfDataSource(ds *Datasource, owner client.Object) (*grafanav1alpha1.GrafanaDataSource, error) {
+	grafanaDatasource := &grafanav1alpha1.GrafanaDataSource{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ds.Name,
+			Namespace: baseNs,
+			Labels:    map[string]string{managedByLabel: managedByValue},
+		},
+		Spec: grafanav1alpha1.GrafanaDataSourceSpec{
+			Name: ds.Name + ".yaml",
+			Datasources: []grafanav1alpha1.GrafanaDataSourceFields{{
+				Access:    "proxy",
+				Editable:  false,
+				IsDefault: false,
+				Name:      ds.Name,
+				OrgId:     int(ds.OrgID),
+				Type:      "prometheus",
+				Url:       prometheusURL,
+				Version:   1,
+				JsonData: grafanav1alpha1.GrafanaDataSourceJsonData{
+					HTTPMethod:      "POST",
+					TlsSkipVerify:   true,
+					HTTPHeaderName1: "Authorization",
+					HTTPHeaderName2: "namespace",
+				},
+				SecureJsonData: grafanav1alpha1.GrafanaDataSourceSecureJsonData{
+					HTTPHeaderValue1: "Bearer " + ds.Token,
+					HTTPHeaderValue2: ds.Namespace,
+				},
+			}},
+		},
+	}
+
+	// Set target Namespace as the owner of GrafanaDatasource in another Namespace
+	if owner != nil {
+		err := ctrl.SetControllerReference(owner, grafanaDatasource, b.Scheme)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return grafanaDatasource, nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	grafanav1alpha1 "github.com/grafana-operator/grafana-operator/v4/api/integreatly/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// datasourceTokenKey is the key of the token in the Secret referenced by valuesFrom.
+	datasourceTokenKey = "token"
+	// datasourceSyncedCondition is set by grafana-operator v5 once the datasource is in Grafana.
+	datasourceSyncedCondition = "DatasourceSynchronized"
+)
+
+// grafanaDatasourceV5GVK is the grafana-operator v5 datasource kind. It is
+// handled as unstructured to not depend on the v5 module.
+var grafanaDatasourceV5GVK = schema.GroupVersionKind{
+	Group:   "grafana.integreatly.org",
+	Version: "v1beta1",
+	Kind:    "GrafanaDatasource",
+}
+
+//+kubebuilder:rbac:groups=grafana.integreatly.org,resources=grafanadatasources,verbs=get;list;watch;create;update;patch;delete
+
+// grafanaOperatorV5Backend writes datasources as grafana-operator v5
+// GrafanaDatasource objects in baseNs. Tokens are kept in a Secret next to
+// them and injected with valuesFrom.
+type grafanaOperatorV5Backend struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// InstanceSelector selects the Grafana instances serving the datasources.
+	InstanceSelector map[string]string
+}
+
+func (b *grafanaOperatorV5Backend) EnsureDatasource(ctx context.Context, ds *Datasource, owner client.Object) error {
+	logger := log.FromContext(ctx)
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: ds.Name + "-datasource", Namespace: baseNs}}
+	op, err := controllerutil.CreateOrUpdate(ctx, b.Client, secret, func() error {
+		secret.Data = map[string][]byte{datasourceTokenKey: []byte(ds.Token)}
+		return b.setOwner(owner, secret)
+	})
+	if err != nil {
+		logger.Error(err, "Unable to reconcile datasource token Secret", "secret.Name", secret.Name)
+		return err
+	}
+	logger.Info("Datasource token Secret reconciled", "secret.Name", secret.Name, "operation", op)
+
+	// Reuse the UID of a datasource provisioned by grafana-operator v4, so
+	// grafana-operator v5 adopts it instead of creating a duplicate.
+	oldDs, err := b.getV4Datasource(ctx, ds.Name)
+	if err != nil {
+		return err
+	}
+	adoptUID := ""
+	if oldDs != nil {
+		adoptUID, err = existingDatasourceUID(ctx, ds)
+		if err != nil {
+			return err
+		}
+	}
+
+	gfDs := &unstructured.Unstructured{}
+	gfDs.SetGroupVersionKind(grafanaDatasourceV5GVK)
+	gfDs.SetName(ds.Name)
+	gfDs.SetNamespace(baseNs)
+	var existing *unstructured.Unstructured
+	op, err = controllerutil.CreateOrUpdate(ctx, b.Client, gfDs, func() error {
+		if gfDs.GetResourceVersion() != "" {
+			existing = gfDs.DeepCopy()
+		}
+		uid, _, _ := unstructured.NestedString(gfDs.Object, "spec", "datasource", "uid")
+		if uid == "" {
+			uid = adoptUID
+		}
+		if err := unstructured.SetNestedField(gfDs.Object, b.generateSpec(ds, secret.Name, uid), "spec"); err != nil {
+			return err
+		}
+		labels := gfDs.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[managedByLabel] = managedByValue
+		gfDs.SetLabels(labels)
+		return b.setOwner(owner, gfDs)
+	})
+	if err != nil {
+		logger.Error(err, "Unable to reconcile GrafanaDatasource", "grafanaDatasource.Name", ds.Name)
+		return err
+	}
+	logger.Info("GrafanaDatasource reconciled", "grafanaDatasource.Name", ds.Name, "operation", op)
+	if op == controllerutil.OperationResultUpdated && existing != nil {
+		reportDrift(b.Recorder, owner, existing, grafanaDatasourceV5GVK.Kind, existing.Object["spec"])
+	}
+	err = recordSpecHash(ctx, b.Client, gfDs, gfDs.Object["spec"])
+	if err != nil {
+		logger.Error(err, "Unable to record GrafanaDatasource spec hash", "grafanaDatasource.Name", ds.Name)
+		return err
+	}
+
+	if oldDs == nil {
+		return nil
+	}
+	// Remove the v4 object only once grafana-operator v5 took over
+	if !grafanaDatasourceV5Ready(gfDs) {
+		logger.Info("Waiting for GrafanaDatasource before removing GrafanaDataSource", "grafanaDatasource.Name", ds.Name)
+		return nil
+	}
+	logger.Info("Removing migrated GrafanaDataSource", "grafanaDatasource.Name", ds.Name)
+	err = b.Delete(ctx, oldDs)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Unable to remove migrated GrafanaDataSource", "grafanaDatasource.Name", ds.Name)
+		return err
+	}
+	return nil
+}
+
+func (b *grafanaOperatorV5Backend) Watch(bld *builder.Builder) *builder.Builder {
+	gfDs := &unstructured.Unstructured{}
+	gfDs.SetGroupVersionKind(grafanaDatasourceV5GVK)
+	return bld.Owns(gfDs)
+}
+
+func (b *grafanaOperatorV5Backend) setOwner(owner, obj client.Object) error {
+	if owner == nil {
+		return nil
+	}
+	return ctrl.SetControllerReference(owner, obj, b.Scheme)
+}
+
+// generateSpec builds the GrafanaDatasource spec. Unstructured values must use
+// the types produced by JSON decoding so the comparison in CreateOrUpdate holds.
+func (b *grafanaOperatorV5Backend) generateSpec(ds *Datasource, secretName, uid string) map[string]interface{} {
+	matchLabels := map[string]interface{}{}
+	for k, v := range b.InstanceSelector {
+		matchLabels[k] = v
+	}
+	datasource := map[string]interface{}{
+		"name":      ds.Name,
+		"type":      "prometheus",
+		"access":    "proxy",
+		"url":       prometheusURL,
+		"isDefault": false,
+		"editable":  false,
+		"orgId":     ds.OrgID,
+		"jsonData": map[string]interface{}{
+			"httpMethod":      "POST",
+			"tlsSkipVerify":   true,
+			"httpHeaderName1": "Authorization",
+			"httpHeaderName2": "namespace",
+		},
+		"secureJsonData": map[string]interface{}{
+			"httpHeaderValue1": "Bearer ${" + datasourceTokenKey + "}",
+			"httpHeaderValue2": ds.Namespace,
+		},
+	}
+	if uid != "" {
+		datasource["uid"] = uid
+	}
+	return map[string]interface{}{
+		"instanceSelector": map[string]interface{}{
+			"matchLabels": matchLabels,
+		},
+		"valuesFrom": []interface{}{
+			map[string]interface{}{
+				"targetPath": "secureJsonData.httpHeaderValue1",
+				"valueFrom": map[string]interface{}{
+					"secretKeyRef": map[string]interface{}{
+						"name": secretName,
+						"key":  datasourceTokenKey,
+					},
+				},
+			},
+		},
+		"datasource": datasource,
+	}
+}
+
+// getV4Datasource returns the grafana-operator v4 object left from a previous
+// backend, or nil when there is none or the v4 CRD is not installed.
+func (b *grafanaOperatorV5Backend) getV4Datasource(ctx context.Context, name string) (*grafanav1alpha1.GrafanaDataSource, error) {
+	oldDs := &grafanav1alpha1.GrafanaDataSource{}
+	err := b.Get(ctx, types.NamespacedName{Name: name, Namespace: baseNs}, oldDs)
+	if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to get grafanaDatasource", "grafanaDatasource.Name", name)
+		return nil, err
+	}
+	return oldDs, nil
+}
+
+// existingDatasourceUID returns the UID of the datasource already in Grafana
+// with the same name, or an empty string when there is none.
+func existingDatasourceUID(ctx context.Context, ds *Datasource) (string, error) {
+	client, err := newGrafanaClient(ctx, uint(ds.OrgID))
+	if err != nil {
+		return "", err
+	}
+	datasources, err := client.GetAllDatasources(ctx)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Unable to list Grafana datasources", "orgID", ds.OrgID)
+		return "", err
+	}
+	for _, existing := range datasources {
+		if existing.Name == ds.Name {
+			return existing.UID, nil
+		}
+	}
+	return "", nil
+}
+
+// grafanaDatasourceV5Ready reports whether grafana-operator v5 has synchronized
+// the datasource. Releases without conditions only set the status UID.
+func grafanaDatasourceV5Ready(gfDs *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(gfDs.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == datasourceSyncedCondition {
+			return condition["status"] == string(metav1.ConditionTrue)
+		}
+	}
+	uid, _, _ := unstructured.NestedString(gfDs.Object, "status", "uid")
+	return uid != ""
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/grafana-tools/sdk"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	// dashboardTemplateLabel marks the ConfigMaps of the operator namespace
+	// holding dashboard templates, every key ending in .json is a template.
+	dashboardTemplateLabel = "grafana.snappcloud.io/dashboard-template"
+	// defaultDashboardTag marks the dashboards rendered from the templates.
+	defaultDashboardTag = "snappcloud-default-dashboard"
+	// templateHashKey keeps the hash of the dashboard content written by the
+	// operator in the dashboard model, Grafana stores unknown keys as is.
+	templateHashKey = "snappcloudTemplateHash"
+	// datasourceRequeueDelay is how long to wait for a datasource to show up in Grafana.
+	datasourceRequeueDelay = 30 * time.Second
+)
+
+// Get the operator namespace as a env, it holds the dashboard templates.
+var operatorNamespace = os.Getenv("OPERATOR_NAMESPACE")
+
+// dashboardTemplateData is passed to the dashboard templates. Templates use
+// [[ ]] delimiters since {{ }} is used by Grafana legends.
+type dashboardTemplateData struct {
+	Namespace      string
+	Team           string
+	DatasourceName string
+	DatasourceUID  string
+}
+
+// dashboardTemplate is a dashboard template read from a ConfigMap key.
+type dashboardTemplate struct {
+	// Name is <configmap>/<key>.
+	Name string
+	Text string
+	// ConfigMap holds the template, errors of the template are reported on it.
+	ConfigMap *corev1.ConfigMap
+}
+
+// ensureDashboards creates the folder of the namespace in the team org and
+// installs the default dashboards in it, wired to the namespace datasource.
+// Dashboards whose template is gone are removed. Without templates no folder
+// is created.
+func (r *NamespaceReconciler) ensureDashboards(ctx context.Context, ns *corev1.Namespace, team string, ds *Datasource) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	client, err := newGrafanaClient(ctx, uint(ds.OrgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return ctrl.Result{}, err
+	}
+	templates, err := r.dashboardTemplates(ctx)
+	if err != nil {
+		logger.Error(err, "Unable to list dashboard templates")
+		return ctrl.Result{}, err
+	}
+	folder, ok, err := namespaceFolder(ctx, r.Client, client, ns, len(templates) > 0)
+	if err != nil {
+		logger.Error(err, "Unable to reconcile namespace folder", "orgID", ds.OrgID)
+		return ctrl.Result{}, err
+	}
+	if !ok {
+		return ctrl.Result{}, nil
+	}
+
+	desired := map[string]bool{}
+	if len(templates) > 0 {
+		dsUID, err := grafanaDatasourceUID(ctx, client, ds.Name)
+		if err != nil {
+			logger.Error(err, "Unable to list Grafana datasources", "orgID", ds.OrgID)
+			return ctrl.Result{}, err
+		}
+		// The datasource may still be on its way through grafana-operator
+		if dsUID == "" {
+			logger.Info("Waiting for datasource to be created in Grafana", "datasource.Name", ds.Name)
+			return ctrl.Result{RequeueAfter: datasourceRequeueDelay}, nil
+		}
+
+		data := dashboardTemplateData{
+			Namespace:      ns.Name,
+			Team:           team,
+			DatasourceName: ds.Name,
+			DatasourceUID:  dsUID,
+		}
+		for _, tpl := range templates {
+			uid := dashboardUID(ns.Name, tpl.Name)
+			desired[uid] = true
+			model, err := renderDashboard(tpl, data)
+			if err != nil {
+				// Nothing to retry until the template is fixed, the dashboard is kept as is
+				logger.Error(err, "Unable to render dashboard template, skipping it", "template", tpl.Name)
+				r.Recorder.Eventf(tpl.ConfigMap, corev1.EventTypeWarning, "InvalidDashboardTemplate", "%v", err)
+				continue
+			}
+			_, err = writeDashboard(ctx, client, folder, uid, defaultDashboardTag, model, false)
+			if err != nil {
+				logger.Error(err, "Unable to reconcile dashboard", "template", tpl.Name, "dashboard.UID", uid)
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	found, err := client.Search(ctx, sdk.SearchType(sdk.SearchTypeDashboard), sdk.SearchFolderID(folder.ID), sdk.SearchTag(defaultDashboardTag))
+	if err != nil {
+		logger.Error(err, "Unable to search dashboards", "folder.UID", folder.UID)
+		return ctrl.Result{}, err
+	}
+	for _, board := range found {
+		if desired[board.UID] {
+			continue
+		}
+		logger.Info("Removing dashboard without template", "dashboard.UID", board.UID, "dashboard.Title", board.Title)
+		_, err = client.DeleteDashboardByUID(ctx, board.UID)
+		if err != nil {
+			logger.Error(err, "Unable to delete dashboard", "dashboard.UID", board.UID)
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// namespaceFolder returns the folder of the namespace, and whether it exists.
+// With create the namespace is guarded with the datasource finalizer and the
+// folder is created when missing, otherwise an existing folder is only looked
+// up so the dashboards the operator left in it can be removed.
+func namespaceFolder(ctx context.Context, c client.Client, grafanaClient grafana.Client, ns *corev1.Namespace, create bool) (sdk.Folder, bool, error) {
+	if !create {
+		return grafana.GetNamespaceFolder(ctx, grafanaClient, ns.Name)
+	}
+	err := grafana.GuardNamespace(ctx, c, ns)
+	if err != nil {
+		return sdk.Folder{}, false, err
+	}
+	folder, err := grafana.EnsureNamespaceFolder(ctx, grafanaClient, ns.Name)
+	if err != nil {
+		return sdk.Folder{}, false, err
+	}
+	return folder, true, nil
+}
+
+// renderDashboard executes the template and returns the dashboard model.
+func renderDashboard(tpl dashboardTemplate, data dashboardTemplateData) (map[string]interface{}, error) {
+	t, err := template.New(tpl.Name).Delims("[[", "]]").Option("missingkey=error").Parse(tpl.Text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing dashboard template %s: %w", tpl.Name, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("rendering dashboard template %s: %w", tpl.Name, err)
+	}
+	model := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &model); err != nil {
+		return nil, fmt.Errorf("dashboard template %s is not valid JSON: %w", tpl.Name, err)
+	}
+	return model, nil
+}
+
+// writeDashboard stamps model with its UID, tag and content hash, and writes
+// it to the folder unless Grafana already has the same content there. With
+// keepEdited a dashboard whose content no longer matches its stamped hash,
+// because it was saved in Grafana, is left alone, otherwise it is
+// overwritten. It reports whether the dashboard was written.
+func writeDashboard(ctx context.Context, client grafana.Client, folder sdk.Folder, uid, tag string, model map[string]interface{}, keepEdited bool) (bool, error) {
+	model["uid"] = uid
+	tags, _ := model["tags"].([]interface{})
+	model["tags"] = append(tags, tag)
+	hash, err := contentHash(model)
+	if err != nil {
+		return false, err
+	}
+
+	existing, meta, err := client.GetRawDashboardByUID(ctx, uid)
+	if err != nil && !grafana.IsNotFound(err) {
+		return false, err
+	}
+	if err == nil {
+		edited := dashboardEdited(existing)
+		if keepEdited && edited {
+			log.FromContext(ctx).Info("Dashboard was edited in Grafana, leaving it alone", "dashboard.UID", uid, "updatedBy", meta.UpdatedBy)
+			return false, nil
+		}
+		if meta.FolderID == folder.ID && dashboardHash(existing) == hash && !edited {
+			return false, nil
+		}
+	}
+
+	model[templateHashKey] = hash
+	raw, err := json.Marshal(model)
+	if err != nil {
+		return false, err
+	}
+	log.FromContext(ctx).Info("Writing dashboard", "dashboard.UID", uid, "folder.UID", folder.UID)
+	_, err = client.SetRawDashboardWithParam(ctx, sdk.RawBoardRequest{
+		Dashboard:  raw,
+		Parameters: sdk.SetDashboardParams{FolderID: folder.ID, Overwrite: true},
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// contentHash returns the hash of a dashboard model, leaving out the fields
+// Grafana sets on save and the stamped hash itself. It drops them from model.
+func contentHash(model map[string]interface{}) (string, error) {
+	delete(model, "id")
+	delete(model, "version")
+	delete(model, templateHashKey)
+	content, err := json.Marshal(model)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// dashboardEdited reports whether the dashboard was changed in Grafana since
+// the operator wrote it: its content no longer matches the stamped hash.
+// Dashboards at an operator UID without a stamp were replaced in Grafana, so
+// they count as edited too.
+func dashboardEdited(raw []byte) bool {
+	stamped := dashboardHash(raw)
+	if stamped == "" {
+		return true
+	}
+	model := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &model); err != nil {
+		return true
+	}
+	hash, err := contentHash(model)
+	return err != nil || hash != stamped
+}
+
+// dashboardHash returns the template hash stamped on a dashboard model.
+func dashboardHash(raw []byte) string {
+	model := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &model); err != nil {
+		return ""
+	}
+	hash, _ := model[templateHashKey].(string)
+	return hash
+}
+
+// dashboardUID derives a stable dashboard UID from the namespace and template.
+func dashboardUID(namespace, templateName string) string {
+	hash := sha256.Sum256([]byte(namespace + "/" + templateName))
+	return "db-" + hex.EncodeToString(hash[:])[:24]
+}
+
+// dashboardTemplates returns the dashboard templates of the operator
+// namespace, sorted by name.
+func (r *NamespaceReconciler) dashboardTemplates(ctx context.Context) ([]dashboardTemplate, error) {
+	if operatorNamespace == "" {
+		return nil, nil
+	}
+	list := &corev1.ConfigMapList{}
+	err := r.List(ctx, list, client.InNamespace(operatorNamespace), client.HasLabels{dashboardTemplateLabel})
+	if err != nil {
+		return nil, err
+	}
+	var templates []dashboardTemplate
+	for i := range list.Items {
+		cm := &list.Items[i]
+		for key, text := range cm.Data {
+			if strings.HasSuffix(key, ".json") {
+				templates = append(templates, dashboardTemplate{Name: cm.Name + "/" + key, Text: text, ConfigMap: cm})
+			}
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+// grafanaDatasourceUID returns the UID Grafana gave to the named datasource, or
+// an empty string when it does not exist yet.
+func grafanaDatasourceUID(ctx context.Context, client grafana.Client, name string) (string, error) {
+	datasources, err := client.GetAllDatasources(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, ds := range datasources {
+		if ds.Name == name {
+			return ds.UID, nil
+		}
+	}
+	return "", nil
+}
+
+// templateToNamespaces maps a dashboard template ConfigMap to every monitored
+// namespace, so template changes are rolled out.
+func (r *NamespaceReconciler) templateToNamespaces(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetNamespace() != operatorNamespace {
+		return nil
+	}
+	if _, ok := obj.GetLabels()[dashboardTemplateLabel]; !ok {
+		return nil
+	}
+	list := &corev1.NamespaceList{}
+	err := r.List(ctx, list, client.HasLabels{nsMonitoringLabel, teamLabel})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Unable to list monitored namespaces")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, ns := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKey{Name: ns.Name}})
+	}
+	return requests
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/grafana-tools/sdk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+var _ = Describe("Dashboards", func() {
+	data := dashboardTemplateData{Namespace: "team-a", Team: "team", DatasourceName: "team-a", DatasourceUID: "ds-a"}
+
+	DescribeTable("renderDashboard renders templates with [[ ]] delimiters",
+		func(text string, want map[string]interface{}) {
+			model, err := renderDashboard(dashboardTemplate{Name: "templates/pods.json", Text: text}, data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(model).To(Equal(want))
+		},
+		Entry("fields", `{"title": "[[ .Namespace ]] of [[ .Team ]]", "datasource": {"uid": "[[ .DatasourceUID ]]"}}`,
+			map[string]interface{}{"title": "team-a of team", "datasource": map[string]interface{}{"uid": "ds-a"}}),
+		Entry("Grafana legends", `{"legendFormat": "{{ pod }}"}`,
+			map[string]interface{}{"legendFormat": "{{ pod }}"}),
+	)
+
+	DescribeTable("renderDashboard reports broken templates",
+		func(text, want string) {
+			_, err := renderDashboard(dashboardTemplate{Name: "templates/pods.json", Text: text}, data)
+			Expect(err).To(MatchError(HavePrefix(want)))
+		},
+		Entry("unparsable", `{"title": "[[ .Namespace "}`, "parsing dashboard template templates/pods.json"),
+		Entry("missing key", `{"title": "[[ .Cluster ]]"}`, "rendering dashboard template templates/pods.json"),
+		Entry("invalid JSON", `{"title": [[ .Namespace ]]}`, "dashboard template templates/pods.json is not valid JSON"),
+	)
+
+	It("namespaceFolder only creates the folder when asked to", func() {
+		folderUID := grafana.NamespaceFolderUID("team-a")
+		server := &grafanaServer{responses: map[string]string{
+			"POST /api/folders": `{"id":5,"uid":"` + folderUID + `","title":"team-a"}`,
+		}}
+		ctx, stop := withGrafana(server)
+		defer stop()
+		grafanaClient, err := newGrafanaClient(ctx, 2)
+		Expect(err).NotTo(HaveOccurred())
+
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(ns).Build()
+
+		_, ok, err := namespaceFolder(ctx, c, grafanaClient, ns, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+		Expect(ns.Finalizers).To(BeEmpty())
+		Expect(server.called()).NotTo(ContainElement("POST /api/folders"))
+
+		folder, ok, err := namespaceFolder(ctx, c, grafanaClient, ns, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(folder.UID).To(Equal(folderUID))
+		Expect(server.body("POST /api/folders")).To(ContainSubstring(`"uid":"` + folderUID + `"`))
+
+		guarded := &corev1.Namespace{}
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(ns), guarded)).To(Succeed())
+		Expect(guarded.Finalizers).To(ConsistOf(datasourceFinalizer))
+	})
+
+	Describe("templateToNamespaces", func() {
+		var previous string
+		BeforeEach(func() {
+			previous = operatorNamespace
+			operatorNamespace = "operator"
+		})
+		AfterEach(func() {
+			operatorNamespace = previous
+		})
+
+		DescribeTable("enqueues every monitored namespace for the templates of the operator namespace",
+			func(namespace string, labels map[string]string, want []reconcile.Request) {
+				r := &NamespaceReconciler{Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+					teamNamespace("team-a", "team", ""),
+					teamNamespace("team-b", "team", ""),
+					&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unmonitored", Labels: map[string]string{teamLabel: "team"}}},
+				).Build()}
+				cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "templates", Namespace: namespace, Labels: labels}}
+				Expect(r.templateToNamespaces(context.Background(), cm)).To(Equal(want))
+			},
+			Entry("template", "operator", map[string]string{dashboardTemplateLabel: ""}, []reconcile.Request{
+				{NamespacedName: client.ObjectKey{Name: "team-a"}},
+				{NamespacedName: client.ObjectKey{Name: "team-b"}},
+			}),
+			Entry("not a template", "operator", nil, []reconcile.Request(nil)),
+			Entry("template in another namespace", "team-a", map[string]string{dashboardTemplateLabel: ""}, []reconcile.Request(nil)),
+		)
+	})
+
+	folderUID := grafana.NamespaceFolderUID("team-a")
+	folder := `{"id":5,"uid":"` + folderUID + `","title":"team-a"}`
+	operatorRule := `{"uid":"converted","folderUID":"` + folderUID + `","annotations":{"` + prometheusRuleAnnotation + `":"team-a/rules"}}`
+	teamRule := `{"uid":"by-hand","folderUID":"` + folderUID + `","annotations":{"summary":"by hand"}}`
+	elsewhereRule := `{"uid":"elsewhere","folderUID":"other","annotations":{"` + prometheusRuleAnnotation + `":"team-b/rules"}}`
+	operatorDashboard := `{"uid":"db-default","tags":["` + defaultDashboardTag + `"]}`
+	teamDashboard := `{"uid":"by-hand","tags":["team"]}`
+
+	DescribeTable("the finalizer only deletes the content written by the operator",
+		func(rules, dashboards string, want, kept []string) {
+			server := &grafanaServer{responses: map[string]string{
+				"GET /api/v1/provisioning/alert-rules":              `[` + rules + `]`,
+				"DELETE /api/v1/provisioning/alert-rules/converted": ``,
+				"GET /api/folders/" + folderUID:                     folder,
+				"GET /api/search":                                   `[` + dashboards + `]`,
+				"DELETE /api/dashboards/uid/db-default":             `{"title":"Pods"}`,
+				"DELETE /api/folders/" + folderUID:                  `{"message":"Folder deleted"}`,
+			}}
+			ctx, stop := withGrafana(server)
+			defer stop()
+
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "team-a",
+				Finalizers:  []string{datasourceFinalizer},
+				Annotations: map[string]string{datasourceOrgAnnotation: "2"},
+			}}
+			r := &NamespaceReconciler{
+				Client:  fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(ns).Build(),
+				Backend: &recordingBackend{},
+			}
+			Expect(r.finalizeNamespace(ctx, ns)).To(Succeed())
+			for _, call := range want {
+				Expect(server.called()).To(ContainElement(call))
+			}
+			for _, call := range kept {
+				Expect(server.called()).NotTo(ContainElement(call))
+			}
+		},
+		Entry("operator content only", operatorRule+","+elsewhereRule, operatorDashboard,
+			[]string{"DELETE /api/v1/provisioning/alert-rules/converted", "DELETE /api/dashboards/uid/db-default", "DELETE /api/folders/" + folderUID},
+			[]string{"DELETE /api/v1/provisioning/alert-rules/elsewhere"}),
+		Entry("alert rules of the team", operatorRule+","+teamRule, operatorDashboard,
+			[]string{"DELETE /api/v1/provisioning/alert-rules/converted", "DELETE /api/dashboards/uid/db-default"},
+			[]string{"DELETE /api/v1/provisioning/alert-rules/by-hand", "DELETE /api/folders/" + folderUID}),
+		Entry("dashboards of the team", operatorRule, operatorDashboard+","+teamDashboard,
+			[]string{"DELETE /api/v1/provisioning/alert-rules/converted", "DELETE /api/dashboards/uid/db-default"},
+			[]string{"DELETE /api/dashboards/uid/by-hand", "DELETE /api/folders/" + folderUID}),
+	)
+})
+
+// stampedDashboard returns model stamped with its content hash as Grafana
+// returns it, with the fields Grafana sets on save. edit changes the model
+// after the stamp.
+func stampedDashboard(model map[string]interface{}, edit func(map[string]interface{})) map[string]interface{} {
+	copied := map[string]interface{}{}
+	for k, v := range model {
+		copied[k] = v
+	}
+	hash, err := contentHash(copied)
+	Expect(err).NotTo(HaveOccurred())
+	copied[templateHashKey] = hash
+	copied["id"] = 12
+	copied["version"] = 3
+	if edit != nil {
+		edit(copied)
+	}
+	return copied
+}
+
+// rawDashboard returns model as JSON.
+func rawDashboard(model map[string]interface{}) []byte {
+	raw, err := json.Marshal(model)
+	Expect(err).NotTo(HaveOccurred())
+	return raw
+}
+
+var _ = Describe("Dashboard writes", func() {
+	uid := "db-pods"
+	// written is the model writeDashboard stamps for the pods template
+	written := map[string]interface{}{"title": "Pods", "uid": uid, "tags": []interface{}{"kubernetes", defaultDashboardTag}}
+	retitled := func(model map[string]interface{}) { model["title"] = "My pods" }
+	unstamped := func(model map[string]interface{}) { delete(model, templateHashKey) }
+
+	It("contentHash leaves out the fields set by Grafana and the stamp", func() {
+		hash, err := contentHash(map[string]interface{}{"title": "Pods"})
+		Expect(err).NotTo(HaveOccurred())
+		saved := map[string]interface{}{"title": "Pods", "id": 12, "version": 3, templateHashKey: "old"}
+		Expect(contentHash(saved)).To(Equal(hash))
+		Expect(saved).To(Equal(map[string]interface{}{"title": "Pods"}))
+		Expect(contentHash(map[string]interface{}{"title": "My pods"})).NotTo(Equal(hash))
+	})
+
+	DescribeTable("dashboardEdited compares the content with its stamp",
+		func(raw []byte, want bool) {
+			Expect(dashboardEdited(raw)).To(Equal(want))
+		},
+		Entry("as written", rawDashboard(stampedDashboard(written, nil)), false),
+		Entry("saved again in Grafana", rawDashboard(stampedDashboard(written, func(model map[string]interface{}) { model["version"] = 4 })), false),
+		Entry("changed in Grafana", rawDashboard(stampedDashboard(written, retitled)), true),
+		Entry("without stamp", rawDashboard(stampedDashboard(written, unstamped)), true),
+		Entry("invalid JSON", []byte(`{`), true),
+	)
+
+	type writeCase struct {
+		existing   map[string]interface{}
+		folderID   int
+		keepEdited bool
+		want       bool
+	}
+
+	DescribeTable("writeDashboard only writes the dashboards which changed",
+		func(tc writeCase) {
+			server := &grafanaServer{responses: map[string]string{
+				"POST /api/dashboards/db": `{"status":"success","uid":"` + uid + `"}`,
+			}}
+			if tc.existing != nil {
+				server.responses["GET /api/dashboards/uid/"+uid] = fmt.Sprintf(`{"dashboard":%s,"meta":{"folderId":%d}}`, rawDashboard(tc.existing), tc.folderID)
+			}
+			ctx, stop := withGrafana(server)
+			defer stop()
+			grafanaClient, err := newGrafanaClient(ctx, 2)
+			Expect(err).NotTo(HaveOccurred())
+
+			model := map[string]interface{}{"title": "Pods", "tags": []interface{}{"kubernetes"}}
+			folder := sdk.Folder{ID: 5, UID: grafana.NamespaceFolderUID("team-a")}
+			ok, err := writeDashboard(ctx, grafanaClient, folder, uid, defaultDashboardTag, model, tc.keepEdited)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(Equal(tc.want))
+			if !tc.want {
+				Expect(server.called()).NotTo(ContainElement("POST /api/dashboards/db"))
+				return
+			}
+			request := struct {
+				Dashboard map[string]interface{} `json:"dashboard"`
+				FolderID  int                    `json:"folderId"`
+				Overwrite bool                   `json:"overwrite"`
+			}{}
+			Expect(json.Unmarshal([]byte(server.body("POST /api/dashboards/db")), &request)).To(Succeed())
+			// The sdk resets the id to let Grafana match the dashboard by UID
+			Expect(request.Dashboard).To(Equal(stampedDashboard(written, func(model map[string]interface{}) {
+				model["id"] = float64(0)
+				delete(model, "version")
+			})))
+			Expect(request.FolderID).To(Equal(5))
+			Expect(request.Overwrite).To(BeTrue())
+		},
+		Entry("missing", writeCase{want: true}),
+		Entry("in sync", writeCase{existing: stampedDashboard(written, nil), folderID: 5}),
+		Entry("in another folder", writeCase{existing: stampedDashboard(written, nil), folderID: 7, want: true}),
+		Entry("edited", writeCase{existing: stampedDashboard(written, retitled), folderID: 5, want: true}),
+		Entry("edited and kept", writeCase{existing: stampedDashboard(written, retitled), folderID: 5, keepEdited: true}),
+		Entry("without stamp", writeCase{existing: stampedDashboard(written, unstamped), folderID: 5, want: true}),
+		Entry("without stamp and kept", writeCase{existing: stampedDashboard(written, unstamped), folderID: 5, keepEdited: true}),
+	)
+})
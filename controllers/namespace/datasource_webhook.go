@@ -0,0 +1,137 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	datasourceWebhookPath = "/validate-grafanadatasource"
+	// serviceAccountTokenPath is where the token of the operator
+	// ServiceAccount is mounted, its subject names the ServiceAccount.
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// log is for logging in this package.
+var datasourcelog = logf.Log.WithName("grafanadatasource-resource")
+
+// Get the ServiceAccount the operator runs as from envs, in the operator
+// namespace, only it may change the datasources it manages.
+var operatorServiceAccount = os.Getenv("OPERATOR_SERVICE_ACCOUNT")
+
+// DatasourceGuard rejects changes to the spec and ownership label of the
+// GrafanaDataSources managed by the operator unless the operator makes them.
+// Metadata such as finalizers and annotations stays writable for the Grafana
+// operator, and deletes are allowed so the objects are garbage collected.
+type DatasourceGuard struct {
+	// operator is the user name of the operator ServiceAccount.
+	operator string
+}
+
+//+kubebuilder:webhook:path=/validate-grafanadatasource,mutating=false,failurePolicy=fail,sideEffects=None,groups=integreatly.org;grafana.integreatly.org,resources=grafanadatasources,verbs=update,versions=v1alpha1;v1beta1,name=vgrafanadatasource.kb.io,admissionReviewVersions=v1
+
+// SetupWebhookWithManager registers the guard. The operator ServiceAccount
+// is read from the envs, or from the mounted token when they are not set.
+func (g *DatasourceGuard) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	g.operator = operatorUser()
+	if g.operator == "" {
+		datasourcelog.Info("Operator ServiceAccount is not known, set OPERATOR_NAMESPACE and OPERATOR_SERVICE_ACCOUNT, updates of managed datasources are refused")
+	}
+	mgr.GetWebhookServer().Register(datasourceWebhookPath, &webhook.Admission{Handler: g})
+	return nil
+}
+
+// operatorUser returns the user name of the ServiceAccount the operator runs
+// as, or an empty string when it is not known.
+func operatorUser() string {
+	if operatorNamespace != "" && operatorServiceAccount != "" {
+		return fmt.Sprintf("system:serviceaccount:%s:%s", operatorNamespace, operatorServiceAccount)
+	}
+	token, err := os.ReadFile(serviceAccountTokenPath)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(string(token)), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || !strings.HasPrefix(claims.Subject, "system:serviceaccount:") {
+		return ""
+	}
+	return claims.Subject
+}
+
+var _ admission.Handler = &DatasourceGuard{}
+
+// Handle implements admission.Handler.
+func (g *DatasourceGuard) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+	if g.operator != "" && req.UserInfo.Username == g.operator {
+		return admission.Allowed("")
+	}
+	old := &unstructured.Unstructured{}
+	if err := json.Unmarshal(req.OldObject.Raw, &old.Object); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if old.GetLabels()[grafana.ManagedByLabel] != grafana.ManagedByValue {
+		return admission.Allowed("")
+	}
+	// Without the operator ServiceAccount nobody can be told apart from it
+	if g.operator == "" {
+		return admission.Denied(fmt.Sprintf("%s is managed by %s whose ServiceAccount is not known to the webhook, set OPERATOR_NAMESPACE and OPERATOR_SERVICE_ACCOUNT on the operator",
+			req.Name, grafana.ManagedByValue))
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(req.Object.Raw, &obj.Object); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	datasourcelog.Info("validate update", "namespace", req.Namespace, "name", req.Name, "user", req.UserInfo.Username)
+	if obj.GetLabels()[grafana.ManagedByLabel] != grafana.ManagedByValue {
+		return admission.Denied(fmt.Sprintf("%s is managed by %s, its %s label may not be changed", req.Name, grafana.ManagedByValue, grafana.ManagedByLabel))
+	}
+	if !reflect.DeepEqual(old.Object["spec"], obj.Object["spec"]) {
+		return admission.Denied(fmt.Sprintf("%s is managed by %s and generated from the namespace labels, its spec may not be edited", req.Name, grafana.ManagedByValue))
+	}
+	return admission.Allowed("")
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// operatorSA is the user name of the operator in the guard specs.
+const operatorSA = "system:serviceaccount:operator:grafana-complementary-operator"
+
+// grafanaDatasource returns a GrafanaDataSource with the given labels and URL
+// as JSON.
+func grafanaDatasource(labels map[string]interface{}, url string) runtime.RawExtension {
+	obj := map[string]interface{}{
+		"apiVersion": "integreatly.org/v1alpha1",
+		"kind":       "GrafanaDataSource",
+		"metadata":   map[string]interface{}{"name": "team-a", "namespace": baseNs, "labels": labels},
+		"spec":       map[string]interface{}{"datasources": []interface{}{map[string]interface{}{"name": "team-a", "url": url}}},
+	}
+	raw, err := json.Marshal(obj)
+	Expect(err).NotTo(HaveOccurred())
+	return runtime.RawExtension{Raw: raw}
+}
+
+var _ = Describe("DatasourceGuard", func() {
+	managed := map[string]interface{}{grafana.ManagedByLabel: grafana.ManagedByValue}
+
+	type guardCase struct {
+		operator  string
+		operation admissionv1.Operation
+		user      string
+		old, obj  runtime.RawExtension
+		allowed   bool
+		code      int32
+		reason    string
+	}
+
+	DescribeTable("only lets the operator change the managed datasources",
+		func(tc guardCase) {
+			if tc.operation == "" {
+				tc.operation = admissionv1.Update
+			}
+			g := &DatasourceGuard{operator: tc.operator}
+			resp := g.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Name:      "team-a",
+				Operation: tc.operation,
+				UserInfo:  authenticationv1.UserInfo{Username: tc.user},
+				OldObject: tc.old,
+				Object:    tc.obj,
+			}})
+			Expect(resp.Allowed).To(Equal(tc.allowed))
+			if tc.code != 0 {
+				Expect(resp.Result.Code).To(Equal(tc.code))
+			}
+			Expect(resp.Result.Message).To(ContainSubstring(tc.reason))
+		},
+		Entry("delete", guardCase{
+			operator: operatorSA, operation: admissionv1.Delete, user: "jane",
+			allowed: true,
+		}),
+		Entry("spec changed by the operator", guardCase{
+			operator: operatorSA, user: operatorSA,
+			old: grafanaDatasource(managed, "http://a"), obj: grafanaDatasource(managed, "http://b"),
+			allowed: true,
+		}),
+		Entry("spec changed by someone else", guardCase{
+			operator: operatorSA, user: "jane",
+			old: grafanaDatasource(managed, "http://a"), obj: grafanaDatasource(managed, "http://b"),
+			code: http.StatusForbidden, reason: "its spec may not be edited",
+		}),
+		Entry("label removed by someone else", guardCase{
+			operator: operatorSA, user: "jane",
+			old: grafanaDatasource(managed, "http://a"), obj: grafanaDatasource(nil, "http://a"),
+			code: http.StatusForbidden, reason: "label may not be changed",
+		}),
+		Entry("metadata changed by someone else", guardCase{
+			operator: operatorSA, user: "system:serviceaccount:grafana:grafana-operator",
+			old:     grafanaDatasource(managed, "http://a"),
+			obj:     grafanaDatasource(map[string]interface{}{grafana.ManagedByLabel: grafana.ManagedByValue, "team": "a"}, "http://a"),
+			allowed: true,
+		}),
+		Entry("not managed", guardCase{
+			operator: operatorSA, user: "jane",
+			old: grafanaDatasource(nil, "http://a"), obj: grafanaDatasource(nil, "http://b"),
+			allowed: true,
+		}),
+		Entry("invalid object", guardCase{
+			operator: operatorSA, user: "jane",
+			old: runtime.RawExtension{Raw: []byte("{")}, obj: grafanaDatasource(managed, "http://a"),
+			code: http.StatusBadRequest,
+		}),
+		Entry("managed with the operator unknown", guardCase{
+			user: operatorSA,
+			old:  grafanaDatasource(managed, "http://a"), obj: grafanaDatasource(managed, "http://a"),
+			code: http.StatusForbidden, reason: "set OPERATOR_NAMESPACE and OPERATOR_SERVICE_ACCOUNT",
+		}),
+		Entry("not managed with the operator unknown", guardCase{
+			user: "jane",
+			old:  grafanaDatasource(nil, "http://a"), obj: grafanaDatasource(nil, "http://b"),
+			allowed: true,
+		}),
+	)
+
+	It("operatorUser names the ServiceAccount of the envs", func() {
+		defer func(namespace, serviceAccount string) {
+			operatorNamespace, operatorServiceAccount = namespace, serviceAccount
+		}(operatorNamespace, operatorServiceAccount)
+		operatorNamespace, operatorServiceAccount = "operator", "grafana-complementary-operator"
+		Expect(operatorUser()).To(Equal(operatorSA))
+	})
+})
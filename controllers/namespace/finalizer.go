@@ -0,0 +1,221 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	// datasourceFinalizer keeps the namespace until its datasource and the
+	// content the operator wrote to its folder are removed from Grafana.
+	datasourceFinalizer = grafana.NamespaceFinalizer
+	// datasourceUIDAnnotation reports the UID of the namespace datasource in
+	// Grafana, for every backend.
+	datasourceUIDAnnotation = grafana.DatasourceUIDAnnotation
+	// datasourceOrgAnnotation reports the Grafana org holding the namespace
+	// datasource and folder.
+	datasourceOrgAnnotation = "monitoring.snappcloud.io/grafana-datasource-org-id"
+	// prometheusRuleAnnotation marks the alert rules converted from a
+	// PrometheusRule by the alerting controller.
+	prometheusRuleAnnotation = "snappcloud_prometheusrule"
+)
+
+// operatorDashboardTags are the tags of the dashboards written by the
+// operator, the only ones removed from a namespace folder.
+var operatorDashboardTags = []string{defaultDashboardTag, generatedDashboardTag, importedDashboardTag}
+
+// isMonitored reports whether the namespace carries both onboarding labels.
+func isMonitored(ns *corev1.Namespace) bool {
+	_, monitored := ns.Labels[nsMonitoringLabel]
+	_, hasTeam := ns.Labels[teamLabel]
+	return monitored && hasTeam
+}
+
+// recordedOrg returns the Grafana org recorded in the annotations of an owner.
+func recordedOrg(annotations map[string]string) (int64, bool) {
+	orgID, err := strconv.ParseInt(annotations[datasourceOrgAnnotation], 10, 64)
+	return orgID, err == nil
+}
+
+// recordedDatasource returns the datasource recorded in the annotations of
+// its owner.
+func recordedDatasource(annotations map[string]string) (orgID int64, uid string, ok bool) {
+	uid = annotations[datasourceUIDAnnotation]
+	orgID, ok = recordedOrg(annotations)
+	if uid == "" || !ok {
+		return 0, "", false
+	}
+	return orgID, uid, true
+}
+
+// recordGrafanaObjects records where the Grafana objects of the namespace
+// live. Objects recorded in another org, because the team label changed, are
+// deleted first. The namespace is only guarded with the datasource finalizer
+// for backends which are not garbage collected; the controllers writing to the
+// namespace folder add the finalizer themselves. The UID of the datasources of
+// the other backends is only known once they are in Grafana, it is recorded by
+// recordDatasourceUID.
+func (r *NamespaceReconciler) recordGrafanaObjects(ctx context.Context, ns *corev1.Namespace, ds *Datasource) error {
+	logger := log.FromContext(ctx)
+
+	_, deleter := r.Backend.(DatasourceDeleter)
+	orgID, ok := recordedOrg(ns.Annotations)
+	if ok && orgID == ds.OrgID && (!deleter || ns.Annotations[datasourceUIDAnnotation] == ds.UID && controllerutil.ContainsFinalizer(ns, datasourceFinalizer)) {
+		return nil
+	}
+	if ok && orgID != ds.OrgID {
+		logger.Info("Removing Grafana objects from previous organization", "orgID", orgID)
+		err := r.deleteGrafanaObjects(ctx, ns)
+		if err != nil {
+			return err
+		}
+	}
+
+	patch := client.MergeFrom(ns.DeepCopy())
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	if deleter {
+		ns.Annotations[datasourceUIDAnnotation] = ds.UID
+	} else {
+		delete(ns.Annotations, datasourceUIDAnnotation)
+	}
+	ns.Annotations[datasourceOrgAnnotation] = strconv.FormatInt(ds.OrgID, 10)
+	if deleter {
+		controllerutil.AddFinalizer(ns, datasourceFinalizer)
+	}
+	err := r.Patch(ctx, ns, patch)
+	if err != nil {
+		logger.Error(err, "Unable to record Grafana objects on Namespace")
+		return err
+	}
+	return nil
+}
+
+// recordDatasourceUID records the UID Grafana gave to the datasource of a
+// garbage collected backend, so the dashboard webhook accepts references to
+// it. It reports false while the datasource is not in Grafana yet.
+func (r *NamespaceReconciler) recordDatasourceUID(ctx context.Context, ns *corev1.Namespace, ds *Datasource) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	sdkClient, err := newGrafanaClient(ctx, uint(ds.OrgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return false, err
+	}
+	uid, err := grafanaDatasourceUID(ctx, sdkClient, ds.Name)
+	if err != nil {
+		logger.Error(err, "Unable to list Grafana datasources", "orgID", ds.OrgID)
+		return false, err
+	}
+	if uid == "" || ns.Annotations[datasourceUIDAnnotation] == uid {
+		return uid != "", nil
+	}
+
+	patch := client.MergeFrom(ns.DeepCopy())
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	ns.Annotations[datasourceUIDAnnotation] = uid
+	err = r.Patch(ctx, ns, patch)
+	if err != nil {
+		logger.Error(err, "Unable to record datasource UID on Namespace")
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteGrafanaObjects deletes the recorded datasource, and the dashboards and
+// alert rules the operator wrote to the namespace folder, from the recorded
+// org. The folder is deleted too unless it holds content of the team.
+func (r *NamespaceReconciler) deleteGrafanaObjects(ctx context.Context, ns *corev1.Namespace) error {
+	logger := log.FromContext(ctx)
+
+	orgID, ok := recordedOrg(ns.Annotations)
+	if !ok {
+		return nil
+	}
+	if deleter, ok := r.Backend.(DatasourceDeleter); ok {
+		if _, uid, ok := recordedDatasource(ns.Annotations); ok {
+			err := deleter.DeleteDatasource(ctx, orgID, uid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Grafana refuses to delete a folder holding alert rules
+	alerting, err := grafana.FromContext(ctx).NewAlertingClient(uint(orgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana alerting client")
+		return err
+	}
+	otherRules, err := alerting.DeleteFolderRules(ctx, grafana.NamespaceFolderUID(ns.Name), prometheusRuleAnnotation)
+	if err != nil {
+		logger.Error(err, "Unable to delete alert rules of namespace folder", "orgID", orgID)
+		return err
+	}
+
+	client, err := newGrafanaClient(ctx, uint(orgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return err
+	}
+	kept, err := grafana.DeleteNamespaceFolder(ctx, client, ns.Name, operatorDashboardTags, otherRules)
+	if err != nil {
+		logger.Error(err, "Unable to delete namespace folder", "orgID", orgID)
+		return err
+	}
+	if kept {
+		logger.Info("Keeping namespace folder, it holds dashboards or alert rules not written by the operator", "orgID", orgID)
+	}
+	return nil
+}
+
+// finalizeNamespace deletes the recorded Grafana objects, then removes the
+// record and the finalizer from the namespace.
+func (r *NamespaceReconciler) finalizeNamespace(ctx context.Context, ns *corev1.Namespace) error {
+	logger := log.FromContext(ctx)
+
+	err := r.deleteGrafanaObjects(ctx, ns)
+	if err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(ns.DeepCopy())
+	delete(ns.Annotations, datasourceUIDAnnotation)
+	delete(ns.Annotations, datasourceOrgAnnotation)
+	controllerutil.RemoveFinalizer(ns, datasourceFinalizer)
+	err = r.Patch(ctx, ns, patch)
+	if err != nil {
+		logger.Error(err, "Unable to remove datasource finalizer from Namespace")
+		return err
+	}
+	namespaceSyncs.forget(ns.Name)
+	tokenExpiries.forget(ns.Name, baseSa)
+	logger.Info("Grafana objects finalized", "namespace", ns.Name)
+	return nil
+}
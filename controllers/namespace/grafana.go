@@ -0,0 +1,84 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana-tools/sdk"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// newGrafanaClient connects to the Grafana API of the instance of ctx.
+// Requests are scoped to orgID unless it is zero.
+func newGrafanaClient(ctx context.Context, orgID uint) (grafana.Client, error) {
+	return grafana.FromContext(ctx).NewClient(orgID)
+}
+
+// getOrCreateOrg returns the Grafana organization of team, creating it when
+// it does not exist yet.
+func getOrCreateOrg(ctx context.Context, team string) (sdk.Org, error) {
+	logger := log.FromContext(ctx)
+
+	// Connecting to the Grafana API
+	client, err := newGrafanaClient(ctx, 0)
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return sdk.Org{}, err
+	}
+
+	// Retrieving the Organization Info
+	retrievedOrg, err := client.GetOrgByOrgName(ctx, team)
+	if err == nil {
+		return retrievedOrg, nil
+	}
+	if !grafana.IsNotFound(err) {
+		logger.Error(err, "Unable to get organization")
+		return sdk.Org{}, err
+	}
+
+	logger.Info("Creating organization", "team name is", team)
+	neworg := sdk.Org{Name: team}
+	msg, err := client.CreateOrg(ctx, neworg)
+	if grafana.IsConflict(err) {
+		// Created by another reconcile since it was looked up
+		return client.GetOrgByOrgName(ctx, team)
+	}
+	if err != nil {
+		logger.Error(err, "Failed to create organization")
+		return sdk.Org{}, err
+	}
+	if msg.OrgID == nil {
+		err = fmt.Errorf("organization %q was not created: %s", team, stringValue(msg.Message))
+		logger.Error(err, "Failed to create organization")
+		return sdk.Org{}, err
+	}
+	retrievedOrg = neworg
+	retrievedOrg.ID = *msg.OrgID
+	logger.Info("Organization created", "for team", team, "organization name is", retrievedOrg.Name)
+	return retrievedOrg, nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// testInstance is the Grafana instance the fake Grafana API is registered as.
+const testInstance = "test"
+
+// grafanaServer is a fake Grafana API answering the calls of responses,
+// keyed by method and path, and 404 to the others. It records the calls and
+// the body last sent to each.
+type grafanaServer struct {
+	mu        sync.Mutex
+	responses map[string]string
+	calls     []string
+	bodies    map[string]string
+}
+
+func (s *grafanaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	call := r.Method + " " + r.URL.Path
+	s.calls = append(s.calls, call)
+	if s.bodies == nil {
+		s.bodies = map[string]string{}
+	}
+	s.bodies[call] = string(body)
+	response, ok := s.responses[call]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = io.WriteString(w, response)
+}
+
+// called returns the calls received so far.
+func (s *grafanaServer) called() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// body returns the body last sent with call.
+func (s *grafanaServer) body(call string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies[call]
+}
+
+// withGrafana serves s and returns a context selecting it as the Grafana
+// instance, and a function stopping it.
+func withGrafana(s *grafanaServer) (context.Context, func()) {
+	ts := httptest.NewServer(s)
+	grafana.Instances.Connection(testInstance).Set(&grafana.Credentials{URL: ts.URL, Username: "admin", Password: "secret"})
+	ctx, err := grafana.Instances.ContextFor(context.Background(), instanceSelector(testInstance))
+	Expect(err).NotTo(HaveOccurred())
+	return ctx, func() {
+		grafana.Instances.Remove(testInstance)
+		ts.Close()
+	}
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	// collectTimeout bounds the cache reads of a scrape.
+	collectTimeout = 5 * time.Second
+	// legacyTokenInvalidSinceLabel is set by the API server on the legacy
+	// token Secrets it invalidated for not being used.
+	legacyTokenInvalidSinceLabel = "kubernetes.io/legacy-token-invalid-since"
+)
+
+var (
+	managedOrgsDesc = prometheus.NewDesc("grafana_complementary_managed_orgs",
+		"Number of Grafana orgs monitored namespaces are provisioned in, by instance.",
+		[]string{"instance"}, nil)
+	managedDatasourcesDesc = prometheus.NewDesc("grafana_complementary_managed_datasources",
+		"Number of datasources the operator manages, by team.",
+		[]string{"team"}, nil)
+	tokenExpiryDesc = prometheus.NewDesc("grafana_complementary_datasource_token_expiry_timestamp_seconds",
+		"Expiry of the ServiceAccount token of a datasource; +Inf for legacy tokens which do not expire, when they were invalidated for the invalidated ones.",
+		[]string{"team", "namespace", "serviceaccount"}, nil)
+	lastSyncDesc = prometheus.NewDesc("grafana_complementary_team_last_sync_timestamp_seconds",
+		"When every monitored namespace of a team was last fully reconciled, once they all were since the operator started.",
+		[]string{"team"}, nil)
+)
+
+// namespaceSyncs records when each namespace was last fully reconciled.
+var namespaceSyncs = &syncTimes{times: map[string]time.Time{}}
+
+type syncTimes struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+func (s *syncTimes) record(namespace string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.times[namespace] = time.Now()
+}
+
+func (s *syncTimes) forget(namespace string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.times, namespace)
+}
+
+func (s *syncTimes) get(namespace string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.times[namespace]
+	return t, ok
+}
+
+// tokenExpiries records the expiry of the datasource tokens, by token Secret.
+var tokenExpiries = &expiryTimes{expiries: map[types.NamespacedName]float64{}}
+
+type expiryTimes struct {
+	mu       sync.Mutex
+	expiries map[types.NamespacedName]float64
+}
+
+// record records the expiry of the token of a ServiceAccount token Secret.
+// Legacy token Secrets do not expire, unless the API server invalidated them
+// for not being used.
+func (e *expiryTimes) record(secret *corev1.Secret) {
+	key := client.ObjectKeyFromObject(secret)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	token := string(secret.Data[corev1.ServiceAccountTokenKey])
+	if token == "" {
+		delete(e.expiries, key)
+		return
+	}
+	expiry := math.Inf(1)
+	if exp, ok := tokenExpiry(token); ok {
+		expiry = float64(exp.Unix())
+	} else if since, err := time.Parse("2006-01-02", secret.Labels[legacyTokenInvalidSinceLabel]); err == nil {
+		expiry = float64(since.Unix())
+	}
+	e.expiries[key] = expiry
+}
+
+func (e *expiryTimes) forget(namespace, serviceAccount string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.expiries, types.NamespacedName{Namespace: namespace, Name: tokenSecretName(serviceAccount)})
+}
+
+func (e *expiryTimes) get(namespace, serviceAccount string) (float64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	expiry, ok := e.expiries[types.NamespacedName{Namespace: namespace, Name: tokenSecretName(serviceAccount)}]
+	return expiry, ok
+}
+
+// stateCollector reports the Grafana state managed for the monitored
+// namespaces. It reads the cache on every scrape, so series of removed
+// namespaces and teams go away with them. Token expiries are the ones
+// recorded when the tokens were last read, Secrets are not cached.
+type stateCollector struct {
+	client client.Reader
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- managedOrgsDesc
+	ch <- managedDatasourcesDesc
+	ch <- tokenExpiryDesc
+	ch <- lastSyncDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	logger := log.Log.WithName("metrics")
+
+	list := &corev1.NamespaceList{}
+	err := c.client.List(ctx, list, client.HasLabels{nsMonitoringLabel, teamLabel})
+	if err != nil {
+		logger.Error(err, "Unable to list namespaces")
+		return
+	}
+	orgs := map[string]map[int64]bool{}
+	datasources := map[string]int{}
+	oldestSync := map[string]time.Time{}
+	unsynced := map[string]bool{}
+	for i := range list.Items {
+		ns := &list.Items[i]
+		team := ns.Labels[teamLabel]
+		if !ns.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if orgID, ok := recordedOrg(ns.Annotations); ok {
+			instance := instanceName(ns)
+			if orgs[instance] == nil {
+				orgs[instance] = map[int64]bool{}
+			}
+			orgs[instance][orgID] = true
+			datasources[team]++
+		}
+		if synced, ok := namespaceSyncs.get(ns.Name); !ok {
+			unsynced[team] = true
+		} else if oldest, ok := oldestSync[team]; !ok || synced.Before(oldest) {
+			oldestSync[team] = synced
+		}
+		c.collectTokenExpiry(ch, team, ns.Name, baseSa)
+	}
+	if teamDatasourceEnabled {
+		sas := &corev1.ServiceAccountList{}
+		err = c.client.List(ctx, sas, client.InNamespace(baseNs), client.HasLabels{teamLabel})
+		if err != nil {
+			logger.Error(err, "Unable to list team ServiceAccounts")
+		}
+		for _, sa := range sas.Items {
+			team := sa.Labels[teamLabel]
+			datasources[team]++
+			c.collectTokenExpiry(ch, team, baseNs, sa.Name)
+		}
+	}
+
+	for instance, ids := range orgs {
+		ch <- prometheus.MustNewConstMetric(managedOrgsDesc, prometheus.GaugeValue, float64(len(ids)), instance)
+	}
+	for team, count := range datasources {
+		ch <- prometheus.MustNewConstMetric(managedDatasourcesDesc, prometheus.GaugeValue, float64(count), team)
+	}
+	for team, oldest := range oldestSync {
+		if !unsynced[team] {
+			ch <- prometheus.MustNewConstMetric(lastSyncDesc, prometheus.GaugeValue, float64(oldest.Unix()), team)
+		}
+	}
+}
+
+// instanceName names the Grafana instance of a namespace in the metrics,
+// resolving the default one.
+func instanceName(ns *corev1.Namespace) string {
+	conn, err := grafana.Instances.Get(grafana.InstanceOf(ns))
+	if err != nil {
+		return grafana.InstanceOf(ns)
+	}
+	return conn.Name()
+}
+
+// collectTokenExpiry reports the recorded expiry of the token of a
+// datasource ServiceAccount.
+func (c *stateCollector) collectTokenExpiry(ch chan<- prometheus.Metric, team, namespace, serviceAccount string) {
+	if expiry, ok := tokenExpiries.get(namespace, serviceAccount); ok {
+		ch <- prometheus.MustNewConstMetric(tokenExpiryDesc, prometheus.GaugeValue, expiry, team, namespace, serviceAccount)
+	}
+}
+
+// tokenExpiry returns the exp claim of a ServiceAccount token, a JWT.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
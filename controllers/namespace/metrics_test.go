@@ -0,0 +1,43 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/base64"
+	"time"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// jwt returns a token with payload as its claims.
+func jwt(payload string) string {
+	return "header." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".signature"
+}
+
+var _ = DescribeTable("tokenExpiry reads the exp claim of a ServiceAccount token",
+	func(token string, want time.Time, wantOK bool) {
+		got, ok := tokenExpiry(token)
+		Expect(ok).To(Equal(wantOK))
+		Expect(got).To(BeTemporally("==", want))
+	},
+	Entry("bound token", jwt(`{"exp":1861920000,"sub":"system:serviceaccount:team-a:monitoring"}`), time.Unix(1861920000, 0), true),
+	Entry("legacy token", jwt(`{"sub":"system:serviceaccount:team-a:monitoring"}`), time.Time{}, false),
+	Entry("invalid payload", jwt(`{`), time.Time{}, false),
+	Entry("invalid encoding", "header.!!!.signature", time.Time{}, false),
+	Entry("not a JWT", "token", time.Time{}, false),
+)
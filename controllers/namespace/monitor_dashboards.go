@@ -0,0 +1,481 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/grafana-tools/sdk"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	// generatedDashboardTag marks the dashboards generated from monitors.
+	generatedDashboardTag = "snappcloud-generated-dashboard"
+	// monitorResyncPeriod picks up metrics showing up after the first scrapes.
+	monitorResyncPeriod = teamResyncPeriod
+)
+
+// Monitor kinds of prometheus-operator a dashboard is generated for. They are
+// handled as unstructured to not depend on the prometheus-operator module.
+var (
+	serviceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+	podMonitorGVK     = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PodMonitor"}
+)
+
+// MonitorDashboardReconciler generates a starter dashboard in the namespace
+// folder for every ServiceMonitor and PodMonitor of a monitored namespace.
+// Requests are keyed by namespace.
+type MonitorDashboardReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// kinds are the monitor kinds installed in the cluster.
+	kinds []schema.GroupVersionKind
+	// reader lists the monitor targets from the API server, so no cluster
+	// wide Service or Pod informer is started for them.
+	reader client.Reader
+}
+
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;podmonitors,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=services;pods,verbs=get;list
+
+// Reconcile writes the dashboards of the monitors of the namespace, and
+// deletes the generated dashboards whose monitor is gone. Dashboards edited
+// in Grafana are neither regenerated nor deleted.
+func (r *MonitorDashboardReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	ns := &corev1.Namespace{}
+	err := r.Get(ctx, req.NamespacedName, ns)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get Namespace")
+		return ctrl.Result{}, err
+	}
+	// The folder and its dashboards are removed by the namespace controller
+	if !isMonitored(ns) || !ns.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+	orgID, ok := recordedOrg(ns.Annotations)
+	if !ok {
+		logger.Info("Waiting for namespace to be provisioned in Grafana", "namespace", ns.Name)
+		return ctrl.Result{}, nil
+	}
+
+	var monitors []unstructured.Unstructured
+	for _, gvk := range r.kinds {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		err = r.List(ctx, list, client.InNamespace(ns.Name))
+		if err != nil {
+			logger.Error(err, "Failed to list monitors", "kind", gvk.Kind)
+			return ctrl.Result{}, err
+		}
+		monitors = append(monitors, list.Items...)
+	}
+
+	sdkClient, err := newGrafanaClient(ctx, uint(orgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return ctrl.Result{}, err
+	}
+	folder, ok, err := namespaceFolder(ctx, r.Client, sdkClient, ns, len(monitors) > 0)
+	if err != nil {
+		logger.Error(err, "Unable to reconcile namespace folder", "orgID", orgID)
+		return ctrl.Result{}, err
+	}
+	if !ok {
+		return ctrl.Result{RequeueAfter: monitorResyncPeriod}, nil
+	}
+
+	desired := map[string]bool{}
+	if len(monitors) > 0 {
+		dsUID, err := grafanaDatasourceUID(ctx, sdkClient, ns.Name)
+		if err != nil {
+			logger.Error(err, "Unable to list Grafana datasources", "orgID", orgID)
+			return ctrl.Result{}, err
+		}
+		if dsUID == "" {
+			logger.Info("Waiting for datasource to be created in Grafana", "datasource.Name", ns.Name)
+			return ctrl.Result{RequeueAfter: datasourceRequeueDelay}, nil
+		}
+		prom, err := grafana.FromContext(ctx).NewPrometheusClient(uint(orgID), dsUID)
+		if err != nil {
+			logger.Error(err, "Unable to create Grafana Prometheus client")
+			return ctrl.Result{}, err
+		}
+
+		for i := range monitors {
+			monitor := &monitors[i]
+			uid := monitorDashboardUID(monitor)
+			desired[uid] = true
+
+			jobs, err := r.monitorJobs(ctx, monitor)
+			if err != nil {
+				logger.Error(err, "Unable to resolve monitor jobs", "kind", monitor.GetKind(), "name", monitor.GetName())
+				return ctrl.Result{}, err
+			}
+			if len(jobs) == 0 {
+				logger.Info("Monitor selects no target yet, skipping its dashboard", "kind", monitor.GetKind(), "name", monitor.GetName())
+				continue
+			}
+			model, err := generateMonitorDashboard(ctx, prom, ns.Name, monitor, jobs, dsUID)
+			if err != nil {
+				logger.Error(err, "Unable to query monitor metrics", "kind", monitor.GetKind(), "name", monitor.GetName())
+				return ctrl.Result{}, err
+			}
+			_, err = writeDashboard(ctx, sdkClient, folder, uid, generatedDashboardTag, model, true)
+			if err != nil {
+				logger.Error(err, "Unable to write monitor dashboard", "dashboard.UID", uid)
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	found, err := sdkClient.Search(ctx, sdk.SearchType(sdk.SearchTypeDashboard), sdk.SearchFolderID(folder.ID), sdk.SearchTag(generatedDashboardTag))
+	if err != nil {
+		logger.Error(err, "Unable to search dashboards", "folder.UID", folder.UID)
+		return ctrl.Result{}, err
+	}
+	for _, board := range found {
+		if desired[board.UID] {
+			continue
+		}
+		raw, _, err := sdkClient.GetRawDashboardByUID(ctx, board.UID)
+		if err != nil {
+			logger.Error(err, "Unable to get dashboard", "dashboard.UID", board.UID)
+			return ctrl.Result{}, err
+		}
+		if dashboardEdited(raw) {
+			continue
+		}
+		logger.Info("Removing dashboard without monitor", "dashboard.UID", board.UID, "dashboard.Title", board.Title)
+		_, err = sdkClient.DeleteDashboardByUID(ctx, board.UID)
+		if err != nil {
+			logger.Error(err, "Unable to delete dashboard", "dashboard.UID", board.UID)
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: monitorResyncPeriod}, nil
+}
+
+// monitorDashboardUID derives a stable dashboard UID from the monitor.
+func monitorDashboardUID(monitor *unstructured.Unstructured) string {
+	hash := sha256.Sum256([]byte(monitor.GetNamespace() + "/" + monitor.GetKind() + "/" + monitor.GetName()))
+	return "gd-" + hex.EncodeToString(hash[:])[:24]
+}
+
+// monitorJobs returns the job label values prometheus-operator gives to the
+// targets of the monitor: the Service name, or the value of the jobLabel of
+// the Service, for a ServiceMonitor, and <namespace>/<name>, or the value of
+// the jobLabel of the Pod, for a PodMonitor.
+func (r *MonitorDashboardReconciler) monitorJobs(ctx context.Context, monitor *unstructured.Unstructured) ([]string, error) {
+	jobLabel, _, _ := unstructured.NestedString(monitor.Object, "spec", "jobLabel")
+	if monitor.GetKind() == podMonitorGVK.Kind && jobLabel == "" {
+		return []string{monitor.GetNamespace() + "/" + monitor.GetName()}, nil
+	}
+
+	selector := labels.Everything()
+	if raw, ok, _ := unstructured.NestedMap(monitor.Object, "spec", "selector"); ok {
+		labelSelector := &metav1.LabelSelector{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, labelSelector)
+		if err != nil {
+			return nil, err
+		}
+		selector, err = metav1.LabelSelectorAsSelector(labelSelector)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Targets outside the namespace are not readable with the namespace datasource
+	opts := []client.ListOption{client.InNamespace(monitor.GetNamespace()), client.MatchingLabelsSelector{Selector: selector}}
+
+	// Only names and labels are needed, read as metadata of the monitored namespace
+	list := &metav1.PartialObjectMetadataList{}
+	if monitor.GetKind() == serviceMonitorGVK.Kind {
+		list.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ServiceList"))
+	} else {
+		list.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("PodList"))
+	}
+	if err := r.reader.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var jobs []string
+	for _, obj := range list.Items {
+		job := obj.GetName()
+		if value, ok := obj.GetLabels()[jobLabel]; jobLabel != "" && ok {
+			job = value
+		} else if jobLabel != "" && monitor.GetKind() == podMonitorGVK.Kind {
+			continue
+		}
+		if !seen[job] {
+			seen[job] = true
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Strings(jobs)
+	return jobs, nil
+}
+
+// generateMonitorDashboard builds the dashboard of a monitor: target health,
+// RED panels when a request counter is exposed, latency when a duration
+// histogram is exposed, and USE panels from the process metrics.
+func generateMonitorDashboard(ctx context.Context, prom *grafana.PrometheusClient, namespace string, monitor *unstructured.Unstructured, jobs []string, dsUID string) (map[string]interface{}, error) {
+	quoted := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		quoted = append(quoted, regexp.QuoteMeta(job))
+	}
+	matcher := `job=~"` + strings.ReplaceAll(strings.Join(quoted, "|"), `\`, `\\`) + `"`
+
+	names, err := prom.MetricNames(ctx, "{"+matcher+"}")
+	if err != nil {
+		return nil, err
+	}
+	metrics := map[string]bool{}
+	for _, name := range names {
+		metrics[name] = true
+	}
+
+	b := &dashboardBuilder{datasourceUID: dsUID}
+	b.row("Targets")
+	b.panel("Targets up", "short", `sum by (job) (up{`+matcher+`})`, "{{job}}")
+	b.panel("Scrape duration", "s", `max by (job) (scrape_duration_seconds{`+matcher+`})`, "{{job}}")
+
+	if requests := requestCounter(metrics); requests != "" {
+		b.row("Requests")
+		b.panel("Request rate", "reqps", `sum by (job) (rate(`+requests+`{`+matcher+`}[5m]))`, "{{job}}")
+		labelNames, err := prom.LabelNames(ctx, requests+"{"+matcher+"}")
+		if err != nil {
+			return nil, err
+		}
+		if errMatcher := errorMatcher(labelNames); errMatcher != "" {
+			b.panel("Error ratio", "percentunit",
+				`sum by (job) (rate(`+requests+`{`+matcher+`,`+errMatcher+`}[5m])) / sum by (job) (rate(`+requests+`{`+matcher+`}[5m]))`, "{{job}}")
+		}
+	}
+	if histogram := durationHistogram(metrics); histogram != "" {
+		unit := "s"
+		if strings.Contains(histogram, "milliseconds") {
+			unit = "ms"
+		}
+		b.panel("Latency", unit,
+			`histogram_quantile(0.99, sum by (le) (rate(`+histogram+`{`+matcher+`}[5m])))`, "p99",
+			`histogram_quantile(0.9, sum by (le) (rate(`+histogram+`{`+matcher+`}[5m])))`, "p90",
+			`histogram_quantile(0.5, sum by (le) (rate(`+histogram+`{`+matcher+`}[5m])))`, "p50")
+	}
+
+	if metrics["process_cpu_seconds_total"] || metrics["process_resident_memory_bytes"] {
+		b.row("Resources")
+	}
+	if metrics["process_cpu_seconds_total"] {
+		b.panel("CPU usage", "short", `sum by (pod) (rate(process_cpu_seconds_total{`+matcher+`}[5m]))`, "{{pod}}")
+	}
+	if metrics["process_resident_memory_bytes"] {
+		b.panel("Memory usage", "bytes", `sum by (pod) (process_resident_memory_bytes{`+matcher+`})`, "{{pod}}")
+	}
+	if metrics["process_open_fds"] && metrics["process_max_fds"] {
+		b.panel("File descriptors", "percentunit",
+			`max by (pod) (process_open_fds{`+matcher+`} / process_max_fds{`+matcher+`})`, "{{pod}}")
+	}
+	if metrics["go_goroutines"] {
+		b.panel("Goroutines", "short", `sum by (pod) (go_goroutines{`+matcher+`})`, "{{pod}}")
+	}
+
+	return map[string]interface{}{
+		"title":         namespace + " / " + monitor.GetName(),
+		"description":   "Generated from " + monitor.GetKind() + " " + monitor.GetName() + ". Saving changes stops the regeneration of this dashboard.",
+		"tags":          []interface{}{strings.ToLower(monitor.GetKind())},
+		"editable":      true,
+		"schemaVersion": 36,
+		"timezone":      "browser",
+		"refresh":       "1m",
+		"time":          map[string]interface{}{"from": "now-6h", "to": "now"},
+		"panels":        b.panels,
+	}, nil
+}
+
+// requestCounter picks the request counter of the job, if any.
+func requestCounter(metrics map[string]bool) string {
+	for _, name := range []string{"http_requests_total", "http_server_requests_total", "http_server_requests_seconds_count", "grpc_server_handled_total"} {
+		if metrics[name] {
+			return name
+		}
+	}
+	return firstMetric(metrics, func(name string) bool { return strings.HasSuffix(name, "_requests_total") })
+}
+
+// errorMatcher selects the failed requests from the status label of the
+// request counter, if it has one.
+func errorMatcher(labelNames []string) string {
+	has := map[string]bool{}
+	for _, name := range labelNames {
+		has[name] = true
+	}
+	switch {
+	case has["grpc_code"]:
+		return `grpc_code!="OK"`
+	case has["code"]:
+		return `code=~"5.."`
+	case has["status"]:
+		return `status=~"5.."`
+	case has["status_code"]:
+		return `status_code=~"5.."`
+	}
+	return ""
+}
+
+// durationHistogram picks the bucket series of the request duration
+// histogram, falling back to any duration histogram.
+func durationHistogram(metrics map[string]bool) string {
+	isDuration := func(name string) bool {
+		return strings.HasSuffix(name, "_bucket") && (strings.Contains(name, "duration") || strings.Contains(name, "latency"))
+	}
+	if name := firstMetric(metrics, func(name string) bool { return isDuration(name) && strings.Contains(name, "request") }); name != "" {
+		return name
+	}
+	return firstMetric(metrics, isDuration)
+}
+
+// firstMetric returns the first metric name in sorted order matching match.
+func firstMetric(metrics map[string]bool, match func(string) bool) string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if match(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// dashboardBuilder lays out rows and half-width time series panels.
+type dashboardBuilder struct {
+	datasourceUID string
+	panels        []interface{}
+	nextID        int
+	x, y          int
+}
+
+func (b *dashboardBuilder) row(title string) {
+	if b.x != 0 {
+		b.x, b.y = 0, b.y+8
+	}
+	b.nextID++
+	b.panels = append(b.panels, map[string]interface{}{
+		"id":        b.nextID,
+		"type":      "row",
+		"title":     title,
+		"collapsed": false,
+		"gridPos":   map[string]interface{}{"x": 0, "y": b.y, "w": 24, "h": 1},
+		"panels":    []interface{}{},
+	})
+	b.y++
+}
+
+// panel adds a time series panel, queries are pairs of expression and legend.
+func (b *dashboardBuilder) panel(title, unit string, queries ...string) {
+	datasource := map[string]interface{}{"type": "prometheus", "uid": b.datasourceUID}
+	var targets []interface{}
+	for i := 0; i+1 < len(queries); i += 2 {
+		targets = append(targets, map[string]interface{}{
+			"refId":        string(rune('A' + i/2)),
+			"datasource":   datasource,
+			"expr":         queries[i],
+			"legendFormat": queries[i+1],
+		})
+	}
+	b.nextID++
+	b.panels = append(b.panels, map[string]interface{}{
+		"id":          b.nextID,
+		"type":        "timeseries",
+		"title":       title,
+		"datasource":  datasource,
+		"gridPos":     map[string]interface{}{"x": b.x, "y": b.y, "w": 12, "h": 8},
+		"fieldConfig": map[string]interface{}{"defaults": map[string]interface{}{"unit": unit}, "overrides": []interface{}{}},
+		"targets":     targets,
+	})
+	if b.x == 0 {
+		b.x = 12
+	} else {
+		b.x, b.y = 0, b.y+8
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager. It does nothing
+// when none of the monitor CRDs is installed.
+func (r *MonitorDashboardReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.reader = mgr.GetAPIReader()
+	r.kinds = nil
+	for _, gvk := range []schema.GroupVersionKind{serviceMonitorGVK, podMonitorGVK} {
+		_, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+		if meta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.kinds = append(r.kinds, gvk)
+	}
+	if len(r.kinds) == 0 {
+		ctrl.Log.WithName("setup").Info("ServiceMonitor and PodMonitor CRDs are not installed, monitor dashboards are not generated")
+		return nil
+	}
+
+	bld := ctrl.NewControllerManagedBy(mgr).
+		Named("monitordashboard").
+		Watches(&corev1.Namespace{}, &handler.EnqueueRequestForObject{})
+	for _, gvk := range r.kinds {
+		monitor := &unstructured.Unstructured{}
+		monitor.SetGroupVersionKind(gvk)
+		bld = bld.Watches(monitor, handler.EnqueueRequestsFromMapFunc(monitorToNamespace))
+	}
+	newObject := func() client.Object { return &corev1.Namespace{} }
+	return bld.Complete(grafana.HandleErrors(mgr, grafana.SelectInstance(mgr, r, newObject), newObject))
+}
+
+// monitorToNamespace maps a monitor to its namespace.
+func monitorToNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: obj.GetNamespace()}}}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// monitor returns a monitor of kind in namespace team-a with the given spec.
+func monitor(kind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	m := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	m.SetAPIVersion("monitoring.coreos.com/v1")
+	m.SetKind(kind)
+	m.SetName(name)
+	m.SetNamespace("team-a")
+	return m
+}
+
+// panelQueries returns the title and the queries of each non-row panel.
+func panelQueries(panels []interface{}) map[string][]string {
+	queries := map[string][]string{}
+	for _, p := range panels {
+		panel := p.(map[string]interface{})
+		if panel["type"] == "row" {
+			continue
+		}
+		title := panel["title"].(string)
+		queries[title] = []string{}
+		for _, t := range panel["targets"].([]interface{}) {
+			queries[title] = append(queries[title], t.(map[string]interface{})["expr"].(string))
+		}
+	}
+	return queries
+}
+
+var _ = Describe("Monitor dashboards", func() {
+	DescribeTable("requestCounter prefers the well-known request counters",
+		func(names []string, want string) {
+			metrics := map[string]bool{}
+			for _, name := range names {
+				metrics[name] = true
+			}
+			Expect(requestCounter(metrics)).To(Equal(want))
+		},
+		Entry("none", []string{"up", "process_cpu_seconds_total"}, ""),
+		Entry("well-known", []string{"api_requests_total", "http_requests_total"}, "http_requests_total"),
+		Entry("gRPC", []string{"grpc_server_handled_total", "grpc_server_started_total"}, "grpc_server_handled_total"),
+		Entry("first by name", []string{"web_requests_total", "api_requests_total"}, "api_requests_total"),
+	)
+
+	DescribeTable("errorMatcher selects the failed requests",
+		func(labelNames []string, want string) {
+			Expect(errorMatcher(labelNames)).To(Equal(want))
+		},
+		Entry("no status label", []string{"__name__", "job", "method"}, ""),
+		Entry("gRPC code", []string{"grpc_code", "code"}, `grpc_code!="OK"`),
+		Entry("code", []string{"code", "status"}, `code=~"5.."`),
+		Entry("status", []string{"status"}, `status=~"5.."`),
+		Entry("status code", []string{"status_code"}, `status_code=~"5.."`),
+	)
+
+	DescribeTable("durationHistogram prefers the request duration buckets",
+		func(names []string, want string) {
+			metrics := map[string]bool{}
+			for _, name := range names {
+				metrics[name] = true
+			}
+			Expect(durationHistogram(metrics)).To(Equal(want))
+		},
+		Entry("none", []string{"http_request_duration_seconds_sum", "queue_size_bucket"}, ""),
+		Entry("request", []string{"db_query_duration_seconds_bucket", "http_request_duration_seconds_bucket"}, "http_request_duration_seconds_bucket"),
+		Entry("latency", []string{"rpc_latency_milliseconds_bucket"}, "rpc_latency_milliseconds_bucket"),
+		Entry("any duration", []string{"job_duration_seconds_bucket", "db_query_duration_seconds_bucket"}, "db_query_duration_seconds_bucket"),
+	)
+
+	DescribeTable("monitorJobs returns the job labels of the monitor targets",
+		func(m *unstructured.Unstructured, want []string) {
+			service := func(name string, labels map[string]string) *corev1.Service {
+				return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a", Labels: labels}}
+			}
+			pod := func(name string, labels map[string]string) *corev1.Pod {
+				return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a", Labels: labels}}
+			}
+			reader := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+				service("api", map[string]string{"app": "api", "component": "backend"}),
+				service("api-canary", map[string]string{"app": "api", "component": "backend"}),
+				service("web", map[string]string{"app": "web"}),
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api-elsewhere", Namespace: "team-b", Labels: map[string]string{"app": "api"}}},
+				pod("api-0", map[string]string{"app": "api", "component": "backend"}),
+				pod("api-1", map[string]string{"app": "api"}),
+			).Build()
+			r := &MonitorDashboardReconciler{reader: reader}
+			jobs, err := r.monitorJobs(context.Background(), m)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(jobs).To(Equal(want))
+		},
+		Entry("ServiceMonitor", monitor("ServiceMonitor", "api", map[string]interface{}{
+			"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "api"}},
+		}), []string{"api", "api-canary"}),
+		Entry("ServiceMonitor with expressions", monitor("ServiceMonitor", "all", map[string]interface{}{
+			"selector": map[string]interface{}{"matchExpressions": []interface{}{
+				map[string]interface{}{"key": "app", "operator": "In", "values": []interface{}{"api", "web"}},
+			}},
+		}), []string{"api", "api-canary", "web"}),
+		Entry("ServiceMonitor with a jobLabel", monitor("ServiceMonitor", "all", map[string]interface{}{
+			"jobLabel": "component",
+		}), []string{"backend", "web"}),
+		Entry("PodMonitor", monitor("PodMonitor", "api", map[string]interface{}{
+			"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "api"}},
+		}), []string{"team-a/api"}),
+		Entry("PodMonitor with a jobLabel", monitor("PodMonitor", "api", map[string]interface{}{
+			"jobLabel": "component",
+			"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "api"}},
+		}), []string{"backend"}),
+		Entry("no target", monitor("ServiceMonitor", "db", map[string]interface{}{
+			"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "db"}},
+		}), []string(nil)),
+	)
+
+	It("lays the panels out in half-width columns under their row", func() {
+		b := &dashboardBuilder{datasourceUID: "ds-a"}
+		b.row("Targets")
+		b.panel("Targets up", "short", "up", "{{job}}")
+		b.panel("Scrape duration", "s", "scrape_duration_seconds", "{{job}}")
+		b.panel("Request rate", "reqps", "rate(a[5m])", "a", "rate(b[5m])", "b")
+		b.row("Resources")
+
+		var layout [][]interface{}
+		for _, p := range b.panels {
+			panel := p.(map[string]interface{})
+			pos := panel["gridPos"].(map[string]interface{})
+			layout = append(layout, []interface{}{panel["id"], panel["title"], pos["x"], pos["y"], pos["w"]})
+		}
+		Expect(layout).To(Equal([][]interface{}{
+			{1, "Targets", 0, 0, 24},
+			{2, "Targets up", 0, 1, 12},
+			{3, "Scrape duration", 12, 1, 12},
+			{4, "Request rate", 0, 9, 12},
+			{5, "Resources", 0, 17, 24},
+		}))
+
+		targets := b.panels[3].(map[string]interface{})["targets"].([]interface{})
+		Expect(targets).To(Equal([]interface{}{
+			map[string]interface{}{"refId": "A", "datasource": map[string]interface{}{"type": "prometheus", "uid": "ds-a"}, "expr": "rate(a[5m])", "legendFormat": "a"},
+			map[string]interface{}{"refId": "B", "datasource": map[string]interface{}{"type": "prometheus", "uid": "ds-a"}, "expr": "rate(b[5m])", "legendFormat": "b"},
+		}))
+	})
+
+	proxy := "/api/datasources/proxy/uid/ds-a/api/v1/"
+	DescribeTable("generateMonitorDashboard queries the metrics exposed by the jobs",
+		func(metricNames, labelNames string, want map[string][]string) {
+			server := &grafanaServer{responses: map[string]string{
+				"GET " + proxy + "label/__name__/values": `{"status":"success","data":` + metricNames + `}`,
+				"GET " + proxy + "labels":                `{"status":"success","data":` + labelNames + `}`,
+			}}
+			ctx, stop := withGrafana(server)
+			defer stop()
+			prom, err := grafana.FromContext(ctx).NewPrometheusClient(2, "ds-a")
+			Expect(err).NotTo(HaveOccurred())
+
+			model, err := generateMonitorDashboard(ctx, prom, "team-a", monitor("ServiceMonitor", "api", nil), []string{"api", "api.v2"}, "ds-a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(model["title"]).To(Equal("team-a / api"))
+			Expect(model["tags"]).To(Equal([]interface{}{"servicemonitor"}))
+			Expect(panelQueries(model["panels"].([]interface{}))).To(Equal(want))
+		},
+		Entry("targets only", `["up"]`, `[]`, map[string][]string{
+			"Targets up":      {`sum by (job) (up{job=~"api|api\\.v2"})`},
+			"Scrape duration": {`max by (job) (scrape_duration_seconds{job=~"api|api\\.v2"})`},
+		}),
+		Entry("requests and latency", `["http_requests_total","http_request_duration_milliseconds_bucket"]`, `["code","job"]`, map[string][]string{
+			"Targets up":      {`sum by (job) (up{job=~"api|api\\.v2"})`},
+			"Scrape duration": {`max by (job) (scrape_duration_seconds{job=~"api|api\\.v2"})`},
+			"Request rate":    {`sum by (job) (rate(http_requests_total{job=~"api|api\\.v2"}[5m]))`},
+			"Error ratio": {`sum by (job) (rate(http_requests_total{job=~"api|api\\.v2",code=~"5.."}[5m])) / ` +
+				`sum by (job) (rate(http_requests_total{job=~"api|api\\.v2"}[5m]))`},
+			"Latency": {
+				`histogram_quantile(0.99, sum by (le) (rate(http_request_duration_milliseconds_bucket{job=~"api|api\\.v2"}[5m])))`,
+				`histogram_quantile(0.9, sum by (le) (rate(http_request_duration_milliseconds_bucket{job=~"api|api\\.v2"}[5m])))`,
+				`histogram_quantile(0.5, sum by (le) (rate(http_request_duration_milliseconds_bucket{job=~"api|api\\.v2"}[5m])))`,
+			},
+		}),
+		Entry("requests without status", `["grpc_server_handled_total"]`, `["job"]`, map[string][]string{
+			"Targets up":      {`sum by (job) (up{job=~"api|api\\.v2"})`},
+			"Scrape duration": {`max by (job) (scrape_duration_seconds{job=~"api|api\\.v2"})`},
+			"Request rate":    {`sum by (job) (rate(grpc_server_handled_total{job=~"api|api\\.v2"}[5m]))`},
+		}),
+		Entry("process metrics", `["process_cpu_seconds_total","process_resident_memory_bytes","process_open_fds","process_max_fds","go_goroutines"]`, `[]`, map[string][]string{
+			"Targets up":       {`sum by (job) (up{job=~"api|api\\.v2"})`},
+			"Scrape duration":  {`max by (job) (scrape_duration_seconds{job=~"api|api\\.v2"})`},
+			"CPU usage":        {`sum by (pod) (rate(process_cpu_seconds_total{job=~"api|api\\.v2"}[5m]))`},
+			"Memory usage":     {`sum by (pod) (process_resident_memory_bytes{job=~"api|api\\.v2"})`},
+			"File descriptors": {`max by (pod) (process_open_fds{job=~"api|api\\.v2"} / process_max_fds{job=~"api|api\\.v2"})`},
+			"Goroutines":       {`sum by (pod) (go_goroutines{job=~"api|api\\.v2"})`},
+		}),
+	)
+})
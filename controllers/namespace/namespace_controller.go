@@ -18,47 +18,58 @@ package controllers
 
 import (
 	"context"
-	"fmt"
 	"os"
-	"reflect"
-	"strings"
+	"time"
 
-	grafanav1alpha1 "github.com/grafana-operator/grafana-operator/v4/api/integreatly/v1alpha1"
-	"github.com/grafana-tools/sdk"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
 )
 
 const (
 	baseNs            = "snappcloud-monitoring"
 	baseSa            = "monitoring-datasource"
-	nsMonitoringLabel = "monitoring.snappcloud.io/grafana-datasource"
-	teamLabel         = "snappcloud.io/team"
+	nsMonitoringLabel = grafana.NamespaceMonitoringLabel
+	teamLabel         = grafana.TeamLabel
+
+	// tokenRequeueDelay is how long to wait for the token controller
+	tokenRequeueDelay = 5 * time.Second
 )
 
-// Get Grafana URL and PassWord as a env.
-var grafanaPassword = os.Getenv("GRAFANA_PASSWORD")
-var grafanaUsername = os.Getenv("GRAFANA_USERNAME")
-var grafanaURL = os.Getenv("GRAFANA_URL")
+// Get Prometheus URL as a env.
 var prometheusURL = os.Getenv("PROMETHEUS_URL")
 
 // NamespaceReconciler reconciles a Namespace object
 type NamespaceReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// Backend writes the generated datasources, it is selected with
+	// DATASOURCE_BACKEND when not set.
+	Backend Backend
+	// Recorder reports the drift repaired on the datasource objects.
+	Recorder record.EventRecorder
 }
 
-//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch;update;patch
 //+kubebuilder:rbac:groups=core,resources=namespaces/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=namespaces/finalizers,verbs=update
-//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch
-//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=metrics.k8s.io,resources=pods,verbs=get;create
 
 //+kubebuilder:rbac:groups=integreatly.org,resources=grafanadatasources,verbs=get;list;watch;create;update;patch;delete
 
@@ -88,6 +99,15 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, err
 	}
 
+	// Remove the Grafana objects once the namespace is deleted or leaves monitoring
+	if controllerutil.ContainsFinalizer(ns, datasourceFinalizer) && (!ns.DeletionTimestamp.IsZero() || !isMonitored(ns)) {
+		return ctrl.Result{}, r.finalizeNamespace(ctx, ns)
+	}
+	if !ns.DeletionTimestamp.IsZero() {
+		logger.Info("Namespace is being deleted. Ignoring", "namespace", ns.Name)
+		return ctrl.Result{}, nil
+	}
+
 	// Ignore namespaces which does not have special label
 	if _, ok := ns.Labels[nsMonitoringLabel]; !ok {
 		logger.Info("Namespace does not have monitoring label. Ignoring", "namespace", ns.Name)
@@ -103,164 +123,98 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 
 	logger.Info("Reconciling Namespace", "Namespace.Name", req.NamespacedName, "Team", team)
 
-	// Getting serviceAccount
-	logger.Info("Getting serviceAccount", "serviceAccount.Name", baseSa, "Namespace.Name", req.NamespacedName)
-	sa := &corev1.ServiceAccount{}
-	err = r.Get(ctx, types.NamespacedName{Name: baseSa, Namespace: req.Name}, sa)
+	// grafana-operator picks the Grafana of its datasource objects, which has
+	// to be the one the folder and dashboards are written to
+	if instance := grafana.InstanceOf(ns); !supportsInstance(instance) {
+		logger.Info("Datasource backend only supports the default Grafana instance, ignoring", "backend", datasourceBackend, "instance", instance)
+		r.Recorder.Eventf(ns, corev1.EventTypeWarning, "UnsupportedInstance",
+			"Datasource backend %s only supports the default Grafana instance, not %q", datasourceBackend, instance)
+		return ctrl.Result{}, nil
+	}
+
+	// Provisioning serviceAccount and its RBAC
+	sa, err := r.ensureServiceAccount(ctx, ns)
 	if err != nil {
-		logger.Error(err, "Unable to get ServiceAccount")
 		return ctrl.Result{}, err
 	}
 
 	// Getting serviceaccount token
-	secret := &corev1.Secret{}
-	var token string
-	for _, ref := range sa.Secrets {
-
-		logger.Info("Getting secret", "secret.Name", ref.Name, "Namespace.Name", req.Name)
-		// get secret
-		err = r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: req.Name}, secret)
-		if err != nil {
-			logger.Error(err, "Unable to get Secret")
-			return ctrl.Result{}, err
-		}
-
-		// Check if secret is a token for the serviceaccount
-		if secret.Type != corev1.SecretTypeServiceAccountToken {
-			continue
-		}
-		name := secret.Annotations[corev1.ServiceAccountNameKey]
-		uid := secret.Annotations[corev1.ServiceAccountUIDKey]
-		tokenData := secret.Data[corev1.ServiceAccountTokenKey]
-		//tmp
-		logger.Info("Token data", "token", string(tokenData))
-		logger.Info("Token meta", "name", name, "uid", uid, "ref.Name", ref.Name, "ref.UID", ref.UID)
-		if name == sa.Name && uid == string(sa.UID) && len(tokenData) > 0 {
-			// found token, the first token found is used
-			token = string(tokenData)
-			logger.Info("Found token", "token", token)
-			break
-		}
-
+	token, err := serviceAccountToken(ctx, r.Client, sa)
+	if err != nil {
+		logger.Error(err, "Unable to get ServiceAccount token Secret")
+		return ctrl.Result{}, err
 	}
-	// if no token found
+	// Token controller has not populated the token yet
 	if token == "" {
-		logger.Error(fmt.Errorf("did not found service account token for service account %q", sa.Name), "")
-		return ctrl.Result{}, err
+		logger.Info("Waiting for ServiceAccount token", "serviceAccount.Name", sa.Name)
+		return ctrl.Result{RequeueAfter: tokenRequeueDelay}, nil
 	}
-	gfDs, err := r.generateGfDataSource(ctx, req.Name, team, token, ns)
+
+	// Retrieving the Organization Info
+	retrievedOrg, err := getOrCreateOrg(ctx, team)
 	if err != nil {
-		logger.Error(err, "Error generating grafanaDatasource manifest")
 		return ctrl.Result{}, err
 	}
 
-	// Check if grafanaDatasource does not exist and create a new one
-	found := &grafanav1alpha1.GrafanaDataSource{}
-	err = r.Get(ctx, types.NamespacedName{Name: req.Name, Namespace: baseNs}, found)
-	if err != nil && errors.IsNotFound(err) {
-		logger.Info("Creating grafana datasource", "grafanaDatasource.Name", gfDs.Name)
-		err = r.Create(ctx, gfDs)
-		if err != nil {
-			logger.Error(err, "Unable to create GrafanaDataSource")
-			return ctrl.Result{}, err
-		}
-		// grafanaDatasource created successfully - return and requeue
-		return ctrl.Result{Requeue: true}, nil
-	} else if err != nil {
-		logger.Error(err, "Failed to get grafanaDatasource")
+	// Generating the datasource
+	logger.Info("Start creating Datasource", "Team name:", team, "Team ID:", retrievedOrg.ID, "Namespace", req.Name)
+	ds := &Datasource{
+		Name:      req.Name,
+		UID:       datasourceUID(req.Name),
+		OrgID:     int64(retrievedOrg.ID),
+		Token:     token,
+		Namespace: req.Name,
+	}
+	err = r.recordGrafanaObjects(ctx, ns, ds)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
-
-	// If GrafanaDatasource already exist, check if it is deeply equal with desrired state
-	if !reflect.DeepEqual(gfDs.Spec, found.Spec) {
-		logger.Info("Updating grafanaDatasource", "grafanaDatasource.Namespace", found.Namespace, "grafanaDatasource.Name", found.Name)
-		found.Spec = gfDs.Spec
-		err := r.Update(ctx, found)
+	err = r.Backend.EnsureDatasource(ctx, ds, ns)
+	if err != nil {
+		logger.Error(err, "Unable to reconcile datasource", "backend", datasourceBackend)
+		return ctrl.Result{}, err
+	}
+	recorded := true
+	if _, ok := r.Backend.(DatasourceDeleter); !ok {
+		recorded, err = r.recordDatasourceUID(ctx, ns, ds)
 		if err != nil {
-			logger.Error(err, "Failed to update grafanaDatasource", "grafanaDatasource.Namespace", found.Namespace, "grafanaDatasource.Name", found.Name)
 			return ctrl.Result{}, err
 		}
 	}
 
-	return ctrl.Result{}, nil
+	// Provisioning the namespace folder and its default dashboards
+	result, err := r.ensureDashboards(ctx, ns, team, ds)
+	if err == nil {
+		namespaceSyncs.record(ns.Name)
+	}
+	// The datasource may still be on its way through grafana-operator
+	if !recorded && result.IsZero() {
+		result.RequeueAfter = datasourceRequeueDelay
+	}
+	return result, err
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *NamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Namespace{}).
-		Owns(&grafanav1alpha1.GrafanaDataSource{}).
-		Complete(r)
-}
-
-func (r *NamespaceReconciler) generateGfDataSource(ctx context.Context, name, team, token string, nsOwner *corev1.Namespace) (*grafanav1alpha1.GrafanaDataSource, error) {
-	logger := log.FromContext(ctx)
-
-	// Connecting to the Grafana API
-	client, err := sdk.NewClient(grafanaURL, fmt.Sprintf("%s:%s", grafanaUsername, grafanaPassword), sdk.DefaultHTTPClient)
+	err := metrics.Registry.Register(&stateCollector{client: mgr.GetClient()})
 	if err != nil {
-		logger.Error(err, "Unable to create Grafana client")
-		return nil, err
+		return err
 	}
-
-	// Retrieving the Organization Info
-	retrievedOrg, err := client.GetOrgByOrgName(ctx, team)
-	if err != nil {
-		if strings.Contains(err.Error(), "Organization not found") {
-			logger.Info("Creating organization", "team name is", team)
-			// Create the organization
-
-			neworg := sdk.Org{Name: team}
-			_, err := client.CreateOrg(ctx, neworg)
-
-			if err != nil {
-				logger.Error(err, "Failed to create organization")
-				return nil, err
-			}
-			retrievedOrg = neworg
-			logger.Info("Organization created", "for team", team, "organization name is", retrievedOrg.Name)
-		} else {
-			logger.Error(err, "Unable to get organization")
-			return nil, err
+	if r.Backend == nil {
+		backend, err := NewBackend(datasourceBackend, r.Client, r.Scheme, r.Recorder)
+		if err != nil {
+			return err
 		}
+		r.Backend = backend
 	}
-	// Generating the datasource
-	logger.Info("Start creating Datasource", "Team name:", team, "Team ID:", retrievedOrg.ID, "Namespace", name)
-	grafanaDatasource := &grafanav1alpha1.GrafanaDataSource{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: baseNs,
-		},
-		Spec: grafanav1alpha1.GrafanaDataSourceSpec{
-			Name: name + ".yaml",
-			Datasources: []grafanav1alpha1.GrafanaDataSourceFields{{
-				Access:    "proxy",
-				Editable:  false,
-				IsDefault: false,
-				Name:      name,
-				OrgId:     int(retrievedOrg.ID),
-				Type:      "prometheus",
-				Url:       prometheusURL,
-				Version:   1,
-				JsonData: grafanav1alpha1.GrafanaDataSourceJsonData{
-					HTTPMethod:      "POST",
-					TlsSkipVerify:   true,
-					HTTPHeaderName1: "Authorization",
-					HTTPHeaderName2: "namespace",
-				},
-				SecureJsonData: grafanav1alpha1.GrafanaDataSourceSecureJsonData{
-					HTTPHeaderValue1: "Bearer " + token,
-					HTTPHeaderValue2: name,
-				},
-			}},
-		},
-	}
-
-	// Set target Namespace as the owner of GrafanaDatasource in another Namespace
-	err = ctrl.SetControllerReference(nsOwner, grafanaDatasource, r.Scheme)
-	if err != nil {
-		return nil, err
-	}
-
-	return grafanaDatasource, nil
+	bld := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Namespace{}).
+		// Secrets are not cached, only the metadata of the token Secrets is needed to watch them
+		Owns(&corev1.Secret{}, builder.OnlyMetadata).
+		Owns(&rbacv1.Role{}).
+		Owns(&rbacv1.RoleBinding{}).
+		Watches(&corev1.ServiceAccount{}, handler.EnqueueRequestsFromMapFunc(serviceAccountToNamespace)).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.templateToNamespaces))
+	newObject := func() client.Object { return &corev1.Namespace{} }
+	return r.Backend.Watch(bld).Complete(grafana.HandleErrors(mgr, grafana.SelectInstance(mgr, r, newObject), newObject))
 }
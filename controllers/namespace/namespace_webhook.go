@@ -0,0 +1,254 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/env"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+	"golang.org/x/exp/slices"
+)
+
+// log is for logging in this package.
+var namespacelog = logf.Log.WithName("namespace-resource")
+
+// namespaceMonitoringWebhookPath serves the monitoring webhook, the team
+// webhook is served on the path of the builder.
+const namespaceMonitoringWebhookPath = "/validate-monitoring--v1-namespace"
+
+// Get the teams a namespace may join as a env, comma separated. Any team is
+// allowed when it is empty.
+var allowedTeams = env.List("ALLOWED_TEAMS")
+
+// Get the permission needed to set the team label as a env: a verb on a
+// resource, in kubectl auth can-i form, checked with the team as the name so
+// requesters can be limited to some teams with resourceNames.
+var teamVerb = env.String("NAMESPACE_TEAM_VERB", "assign")
+var teamResource = env.String("NAMESPACE_TEAM_RESOURCE", "teams.grafana.snappcloud.io")
+
+// NamespaceValidator guards the team label of namespaces, which selects the
+// Grafana org their metrics are shown in.
+type NamespaceValidator struct {
+	Client client.Client
+}
+
+func (v *NamespaceValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(namespaceMonitoringWebhookPath,
+		admission.WithCustomValidator(mgr.GetScheme(), &corev1.Namespace{}, &namespaceMonitoringValidator{validator: v}))
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&corev1.Namespace{}).
+		WithValidator(v).
+		Complete()
+}
+
+// The team webhook only gets namespaces with a team label, before or after
+// the request, and fails closed. Namespaces with only the monitoring label
+// get the warnings through the monitoring webhook, which fails open and never
+// denies; see config/webhook/namespace_webhook_patch.yaml for the selectors.
+//+kubebuilder:webhook:path=/validate--v1-namespace,mutating=false,failurePolicy=fail,sideEffects=None,groups="",resources=namespaces,verbs=create;update,versions=v1,name=vnamespace.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-monitoring--v1-namespace,mutating=false,failurePolicy=ignore,sideEffects=None,groups="",resources=namespaces,verbs=create;update,versions=v1,name=vnamespace-monitoring.kb.io,admissionReviewVersions=v1
+
+var _ webhook.CustomValidator = &NamespaceValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *NamespaceValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace but got a %T", obj)
+	}
+	return v.validate(ctx, ns, &corev1.Namespace{})
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *NamespaceValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	ns, ok := newObj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace but got a %T", newObj)
+	}
+	old, ok := oldObj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace but got a %T", oldObj)
+	}
+	return v.validate(ctx, ns, old)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *NamespaceValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *NamespaceValidator) validate(ctx context.Context, ns, old *corev1.Namespace) (admission.Warnings, error) {
+	team, hasTeam := ns.Labels[teamLabel]
+	oldTeam, hadTeam := old.Labels[teamLabel]
+	warnings := v.monitoringWarnings(ctx, ns, old)
+	if instance := grafana.InstanceOf(ns); instance != grafana.InstanceOf(old) && !supportsInstance(instance) {
+		path := field.NewPath("metadata", "labels").Key(grafana.InstanceLabel)
+		if _, ok := ns.Labels[grafana.InstanceLabel]; !ok {
+			path = field.NewPath("metadata", "annotations").Key(grafana.InstanceLabel)
+		}
+		return warnings, apierrors.NewInvalid(corev1.SchemeGroupVersion.WithKind("Namespace").GroupKind(), ns.Name,
+			field.ErrorList{field.Invalid(path, instance, fmt.Sprintf("the %s datasource backend only supports the default Grafana instance", datasourceBackend))})
+	}
+	if team == oldTeam && hasTeam == hadTeam {
+		return warnings, nil
+	}
+	namespacelog.Info("validate team change", "name", ns.Name, "team", team, "oldTeam", oldTeam)
+
+	path := field.NewPath("metadata", "labels").Key(teamLabel)
+	if hasTeam && len(allowedTeams) > 0 && !slices.Contains(allowedTeams, team) {
+		return warnings, apierrors.NewInvalid(corev1.SchemeGroupVersion.WithKind("Namespace").GroupKind(), ns.Name,
+			field.ErrorList{field.NotSupported(path, team, allowedTeams)})
+	}
+
+	// Joining a team is checked against the new team, leaving it against the
+	// old one, and moving to another team against both
+	var checked []string
+	if hadTeam {
+		checked = append(checked, oldTeam)
+	}
+	if hasTeam {
+		checked = append(checked, team)
+	}
+	for _, name := range checked {
+		allowed, err := v.authorizeTeam(ctx, name)
+		if err != nil {
+			return warnings, apierrors.NewInternalError(err)
+		}
+		if !allowed {
+			req, _ := admission.RequestFromContext(ctx)
+			return warnings, apierrors.NewForbidden(corev1.Resource("namespaces"), ns.Name,
+				fmt.Errorf("%s may not %s, this needs %q on %q named %q", req.UserInfo.Username, teamChange(hadTeam, oldTeam, hasTeam, team), teamVerb, teamResource, name))
+		}
+	}
+	return warnings, nil
+}
+
+// namespaceMonitoringValidator only warns about the monitored namespaces the
+// operator cannot serve, it admits every request.
+type namespaceMonitoringValidator struct {
+	validator *NamespaceValidator
+}
+
+var _ webhook.CustomValidator = &namespaceMonitoringValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (m *namespaceMonitoringValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace but got a %T", obj)
+	}
+	return m.validator.monitoringWarnings(ctx, ns, &corev1.Namespace{}), nil
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (m *namespaceMonitoringValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	ns, ok := newObj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace but got a %T", newObj)
+	}
+	old, ok := oldObj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace but got a %T", oldObj)
+	}
+	return m.validator.monitoringWarnings(ctx, ns, old), nil
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (m *namespaceMonitoringValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// teamChange describes a change of the team label for error messages.
+func teamChange(hadTeam bool, oldTeam string, hasTeam bool, team string) string {
+	switch {
+	case !hasTeam:
+		return fmt.Sprintf("remove %s %q", teamLabel, oldTeam)
+	case hadTeam:
+		return fmt.Sprintf("move the namespace from %s %q to %q", teamLabel, oldTeam, team)
+	default:
+		return fmt.Sprintf("set %s to %q", teamLabel, team)
+	}
+}
+
+// authorizeTeam runs a SubjectAccessReview for the requester on the team.
+func (v *NamespaceValidator) authorizeTeam(ctx context.Context, team string) (bool, error) {
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	resource := schema.ParseGroupResource(teamResource)
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:     teamVerb,
+				Group:    resource.Group,
+				Resource: resource.Resource,
+				Name:     team,
+			},
+			User:   req.UserInfo.Username,
+			Groups: req.UserInfo.Groups,
+			UID:    req.UserInfo.UID,
+			Extra:  map[string]authorizationv1.ExtraValue{},
+		},
+	}
+	for key, value := range req.UserInfo.Extra {
+		sar.Spec.Extra[key] = authorizationv1.ExtraValue(value)
+	}
+	err = v.Client.Create(ctx, sar)
+	if err != nil {
+		return false, fmt.Errorf("reviewing access of %s: %w", req.UserInfo.Username, err)
+	}
+	return sar.Status.Allowed, nil
+}
+
+// monitoringWarnings warns about monitored namespaces the operator cannot
+// serve: without a team, or missing the datasource ServiceAccount although
+// they were monitored before this request.
+func (v *NamespaceValidator) monitoringWarnings(ctx context.Context, ns, old *corev1.Namespace) admission.Warnings {
+	if _, ok := ns.Labels[nsMonitoringLabel]; !ok {
+		return nil
+	}
+	if _, ok := ns.Labels[teamLabel]; !ok {
+		return admission.Warnings{fmt.Sprintf("namespace has %s but no %s label, it is not monitored until it has both", nsMonitoringLabel, teamLabel)}
+	}
+	if _, ok := old.Labels[nsMonitoringLabel]; !ok {
+		return nil
+	}
+	sa := &corev1.ServiceAccount{}
+	err := v.Client.Get(ctx, client.ObjectKey{Namespace: ns.Name, Name: baseSa}, sa)
+	if apierrors.IsNotFound(err) {
+		return admission.Warnings{fmt.Sprintf("namespace has %s but ServiceAccount %s is missing, its datasource cannot read metrics until the operator recreates it", nsMonitoringLabel, baseSa)}
+	}
+	if err != nil {
+		namespacelog.Error(err, "Unable to get datasource ServiceAccount", "namespace", ns.Name)
+	}
+	return nil
+}
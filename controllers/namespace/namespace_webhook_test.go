@@ -0,0 +1,224 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// namespaceWithLabels returns a namespace named team-a-prod with the given
+// labels, as key value pairs.
+func namespaceWithLabels(pairs ...string) *corev1.Namespace {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a-prod", Labels: map[string]string{}}}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		ns.Labels[pairs[i]] = pairs[i+1]
+	}
+	return ns
+}
+
+// reviewingClient answers the SubjectAccessReviews of the team webhook,
+// allowing the given teams, and records the reviewed teams.
+func reviewingClient(allowed map[string]bool, reviewed *[]string, objs ...client.Object) client.Client {
+	return fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).WithInterceptorFuncs(interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			sar, ok := obj.(*authorizationv1.SubjectAccessReview)
+			if !ok {
+				return c.Create(ctx, obj, opts...)
+			}
+			team := sar.Spec.ResourceAttributes.Name
+			*reviewed = append(*reviewed, team)
+			sar.Status.Allowed = allowed[team]
+			return nil
+		},
+	}).Build()
+}
+
+// teamCase is a namespace update and the teams it is reviewed for.
+type teamCase struct {
+	old          *corev1.Namespace
+	ns           *corev1.Namespace
+	allowed      map[string]bool
+	allowedTeams []string
+	wantReviewed []string
+	wantErr      func(error) bool
+}
+
+var _ = Describe("NamespaceValidator", func() {
+	request := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UserInfo: authenticationv1.UserInfo{Username: "jane"},
+	}}
+
+	DescribeTable("reviews the team changes",
+		func(tt teamCase) {
+			defer func(teams []string) { allowedTeams = teams }(allowedTeams)
+			allowedTeams = tt.allowedTeams
+
+			var reviewed []string
+			v := &NamespaceValidator{Client: reviewingClient(tt.allowed, &reviewed)}
+			ctx := admission.NewContextWithRequest(context.Background(), request)
+			_, err := v.ValidateUpdate(ctx, tt.old, tt.ns)
+			if tt.wantErr == nil {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(tt.wantErr(err)).To(BeTrue(), "unexpected error %v", err)
+			}
+			Expect(reviewed).To(Equal(tt.wantReviewed))
+		},
+		Entry("team unchanged", teamCase{
+			old: namespaceWithLabels(teamLabel, "a", "env", "prod"),
+			ns:  namespaceWithLabels(teamLabel, "a"),
+		}),
+		Entry("team set", teamCase{
+			old:          namespaceWithLabels(),
+			ns:           namespaceWithLabels(teamLabel, "a"),
+			allowed:      map[string]bool{"a": true},
+			wantReviewed: []string{"a"},
+		}),
+		Entry("team set without permission", teamCase{
+			old:          namespaceWithLabels(),
+			ns:           namespaceWithLabels(teamLabel, "a"),
+			wantReviewed: []string{"a"},
+			wantErr:      apierrors.IsForbidden,
+		}),
+		Entry("team removed", teamCase{
+			old:          namespaceWithLabels(teamLabel, "a"),
+			ns:           namespaceWithLabels(),
+			allowed:      map[string]bool{"a": true},
+			wantReviewed: []string{"a"},
+		}),
+		Entry("team moved", teamCase{
+			old:          namespaceWithLabels(teamLabel, "a"),
+			ns:           namespaceWithLabels(teamLabel, "b"),
+			allowed:      map[string]bool{"a": true, "b": true},
+			wantReviewed: []string{"a", "b"},
+		}),
+		Entry("team moved without permission on the old team", teamCase{
+			old:          namespaceWithLabels(teamLabel, "a"),
+			ns:           namespaceWithLabels(teamLabel, "b"),
+			allowed:      map[string]bool{"b": true},
+			wantReviewed: []string{"a"},
+			wantErr:      apierrors.IsForbidden,
+		}),
+		Entry("team not allowed", teamCase{
+			old:          namespaceWithLabels(),
+			ns:           namespaceWithLabels(teamLabel, "c"),
+			allowed:      map[string]bool{"c": true},
+			allowedTeams: []string{"a", "b"},
+			wantErr:      apierrors.IsInvalid,
+		}),
+	)
+
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a-prod", Name: baseSa}}
+
+	DescribeTable("warns about monitored namespaces it cannot provision",
+		func(old, ns *corev1.Namespace, objs []client.Object, wantWarnings int) {
+			var reviewed []string
+			v := &NamespaceValidator{Client: reviewingClient(nil, &reviewed, objs...)}
+			warnings, err := v.ValidateUpdate(context.Background(), old, ns)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(HaveLen(wantWarnings))
+		},
+		Entry("not monitored",
+			namespaceWithLabels(teamLabel, "a"), namespaceWithLabels(teamLabel, "a"), nil, 0),
+		Entry("monitored without team",
+			namespaceWithLabels(), namespaceWithLabels(nsMonitoringLabel, "true"), nil, 1),
+		Entry("newly monitored",
+			namespaceWithLabels(teamLabel, "a"), namespaceWithLabels(teamLabel, "a", nsMonitoringLabel, "true"), nil, 0),
+		Entry("monitored without ServiceAccount",
+			namespaceWithLabels(teamLabel, "a", nsMonitoringLabel, "true"), namespaceWithLabels(teamLabel, "a", nsMonitoringLabel, "true"), nil, 1),
+		Entry("monitored with ServiceAccount",
+			namespaceWithLabels(teamLabel, "a", nsMonitoringLabel, "true"), namespaceWithLabels(teamLabel, "a", nsMonitoringLabel, "true"), []client.Object{sa}, 0),
+	)
+
+	DescribeTable("refuses instances the backend cannot provision",
+		func(backend string, old, ns *corev1.Namespace, wantErr bool) {
+			defer func(backend string) { datasourceBackend = backend }(datasourceBackend)
+			datasourceBackend = backend
+
+			var reviewed []string
+			v := &NamespaceValidator{Client: reviewingClient(nil, &reviewed)}
+			_, err := v.ValidateUpdate(context.Background(), old, ns)
+			if wantErr {
+				Expect(apierrors.IsInvalid(err)).To(BeTrue(), "unexpected error %v", err)
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		},
+		Entry("default instance", BackendGrafanaOperatorV5,
+			namespaceWithLabels(), namespaceWithLabels(nsMonitoringLabel, "true"), false),
+		Entry("other instance with grafana-operator", BackendGrafanaOperatorV4,
+			namespaceWithLabels(), namespaceWithLabels(grafana.InstanceLabel, "secondary"), true),
+		Entry("other instance unchanged with grafana-operator", BackendGrafanaOperatorV5,
+			namespaceWithLabels(grafana.InstanceLabel, "secondary"), namespaceWithLabels(grafana.InstanceLabel, "secondary", "env", "prod"), false),
+		Entry("other instance with the Grafana API", BackendGrafanaAPI,
+			namespaceWithLabels(), namespaceWithLabels(grafana.InstanceLabel, "secondary"), false),
+	)
+})
+
+var _ = Describe("namespaceMonitoringValidator", func() {
+	DescribeTable("only warns, whatever the team change or instance",
+		func(old, ns *corev1.Namespace, wantWarnings int) {
+			defer func(teams []string) { allowedTeams = teams }(allowedTeams)
+			allowedTeams = []string{"a"}
+			defer func(backend string) { datasourceBackend = backend }(datasourceBackend)
+			datasourceBackend = BackendGrafanaOperatorV4
+
+			var reviewed []string
+			m := &namespaceMonitoringValidator{validator: &NamespaceValidator{Client: reviewingClient(nil, &reviewed)}}
+			warnings, err := m.ValidateUpdate(context.Background(), old, ns)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(HaveLen(wantWarnings))
+			Expect(reviewed).To(BeEmpty())
+
+			warnings, err = m.ValidateCreate(context.Background(), ns)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(HaveLen(wantWarnings))
+		},
+		Entry("monitored without team",
+			namespaceWithLabels(), namespaceWithLabels(nsMonitoringLabel, "true"), 1),
+		Entry("team set without permission",
+			namespaceWithLabels(), namespaceWithLabels(nsMonitoringLabel, "true", teamLabel, "c"), 0),
+		Entry("other instance with grafana-operator",
+			namespaceWithLabels(), namespaceWithLabels(nsMonitoringLabel, "true", grafana.InstanceLabel, "secondary"), 1),
+	)
+})
+
+var _ = DescribeTable("teamChange",
+	func(hadTeam bool, oldTeam string, hasTeam bool, team, want string) {
+		Expect(teamChange(hadTeam, oldTeam, hasTeam, team)).To(Equal(want))
+	},
+	Entry("set", false, "", true, "a", `set snappcloud.io/team to "a"`),
+	Entry("removed", true, "a", false, "", `remove snappcloud.io/team "a"`),
+	Entry("moved", true, "a", true, "b", `move the namespace from snappcloud.io/team "a" to "b"`),
+)
@@ -0,0 +1,169 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// metricsReaderRole is the Role and RoleBinding name granting baseSa read
+	// access to the metrics of its own namespace.
+	metricsReaderRole = baseSa + "-metrics-reader"
+)
+
+// metricsReaderRules are the permissions checked by the label-enforcing proxy in
+// front of Prometheus. It maps GET requests to "get" and POST requests to
+// "create" on pods.metrics.k8s.io in the requested namespace.
+var metricsReaderRules = []rbacv1.PolicyRule{{
+	APIGroups: []string{"metrics.k8s.io"},
+	Resources: []string{"pods"},
+	Verbs:     []string{"get", "create"},
+}}
+
+// ensureServiceAccount creates or repairs the datasource ServiceAccount of the
+// namespace, together with its token Secret and the metrics reader Role and
+// RoleBinding. All of them are owned by the namespace.
+func (r *NamespaceReconciler) ensureServiceAccount(ctx context.Context, ns *corev1.Namespace) (*corev1.ServiceAccount, error) {
+	logger := log.FromContext(ctx)
+
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: baseSa, Namespace: ns.Name}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, sa, func() error {
+		return ctrl.SetControllerReference(ns, sa, r.Scheme)
+	})
+	if err != nil {
+		logger.Error(err, "Unable to reconcile ServiceAccount", "serviceAccount.Name", baseSa)
+		return nil, err
+	}
+	logger.Info("ServiceAccount reconciled", "serviceAccount.Name", baseSa, "operation", op)
+
+	err = ensureTokenSecret(ctx, r.Client, r.Scheme, sa, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: metricsReaderRole, Namespace: ns.Name}}
+	op, err = controllerutil.CreateOrUpdate(ctx, r.Client, role, func() error {
+		role.Rules = metricsReaderRules
+		return ctrl.SetControllerReference(ns, role, r.Scheme)
+	})
+	if err != nil {
+		logger.Error(err, "Unable to reconcile Role", "role.Name", metricsReaderRole)
+		return nil, err
+	}
+	logger.Info("Role reconciled", "role.Name", metricsReaderRole, "operation", op)
+
+	binding := &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: metricsReaderRole, Namespace: ns.Name}}
+	op, err = controllerutil.CreateOrUpdate(ctx, r.Client, binding, func() error {
+		// roleRef is immutable, an existing binding pointing elsewhere has to be recreated by hand
+		binding.RoleRef = rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     metricsReaderRole,
+		}
+		binding.Subjects = []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      baseSa,
+			Namespace: ns.Name,
+		}}
+		// The aggregated team datasource reads the namespace with the team ServiceAccount
+		if team := ns.Labels[teamLabel]; teamDatasourceEnabled && team != "" {
+			binding.Subjects = append(binding.Subjects, rbacv1.Subject{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      teamServiceAccountName(team),
+				Namespace: baseNs,
+			})
+		}
+		return ctrl.SetControllerReference(ns, binding, r.Scheme)
+	})
+	if err != nil {
+		logger.Error(err, "Unable to reconcile RoleBinding", "roleBinding.Name", metricsReaderRole)
+		return nil, err
+	}
+	logger.Info("RoleBinding reconciled", "roleBinding.Name", metricsReaderRole, "operation", op)
+
+	return sa, nil
+}
+
+// ensureTokenSecret requests a long-lived token for sa, owned by owner.
+func ensureTokenSecret(ctx context.Context, c client.Client, scheme *runtime.Scheme, sa *corev1.ServiceAccount, owner client.Object) error {
+	logger := log.FromContext(ctx)
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: tokenSecretName(sa.Name), Namespace: sa.Namespace}}
+	op, err := controllerutil.CreateOrUpdate(ctx, c, secret, func() error {
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[corev1.ServiceAccountNameKey] = sa.Name
+		// The type is immutable, it is only set when creating the Secret
+		if secret.ResourceVersion == "" {
+			secret.Type = corev1.SecretTypeServiceAccountToken
+		} else if secret.Type != corev1.SecretTypeServiceAccountToken {
+			return fmt.Errorf("secret %s/%s has type %s instead of %s, delete it to have it recreated",
+				secret.Namespace, secret.Name, secret.Type, corev1.SecretTypeServiceAccountToken)
+		}
+		return ctrl.SetControllerReference(owner, secret, scheme)
+	})
+	if err != nil {
+		logger.Error(err, "Unable to reconcile ServiceAccount token Secret", "secret.Name", secret.Name)
+		return err
+	}
+	logger.Info("ServiceAccount token Secret reconciled", "secret.Name", secret.Name, "operation", op)
+	return nil
+}
+
+// serviceAccountToken returns the token of sa, or an empty string while the
+// token controller has not populated the token Secret yet. The expiry of the
+// token is recorded for the metrics, Secrets are not cached.
+func serviceAccountToken(ctx context.Context, c client.Client, sa *corev1.ServiceAccount) (string, error) {
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: tokenSecretName(sa.Name), Namespace: sa.Namespace}, secret)
+	if err != nil {
+		return "", err
+	}
+	if secret.Annotations[corev1.ServiceAccountUIDKey] != string(sa.UID) {
+		return "", nil
+	}
+	tokenExpiries.record(secret)
+	return string(secret.Data[corev1.ServiceAccountTokenKey]), nil
+}
+
+// tokenSecretName is the name of the long-lived token Secret of a ServiceAccount.
+// Token Secrets are not generated automatically since Kubernetes 1.24.
+func tokenSecretName(serviceAccount string) string {
+	return serviceAccount + "-token"
+}
+
+// serviceAccountToNamespace maps the datasource ServiceAccount, including one
+// created by hand, to the namespace it lives in.
+func serviceAccountToNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetName() != baseSa {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: obj.GetNamespace()}}}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"math"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// tokenSecret returns the token Secret of the datasource ServiceAccount of
+// team-a, populated for the ServiceAccount with UID uid.
+func tokenSecret(uid, token string, labels map[string]string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        tokenSecretName(baseSa),
+			Namespace:   "team-a",
+			Labels:      labels,
+			Annotations: map[string]string{corev1.ServiceAccountNameKey: baseSa, corev1.ServiceAccountUIDKey: uid},
+		},
+		Type: corev1.SecretTypeServiceAccountToken,
+		Data: map[string][]byte{corev1.ServiceAccountTokenKey: []byte(token)},
+	}
+}
+
+var _ = Describe("ServiceAccount token Secret", func() {
+	var (
+		ctx   = context.Background()
+		owner *corev1.Namespace
+		sa    *corev1.ServiceAccount
+		key   = client.ObjectKey{Name: tokenSecretName(baseSa), Namespace: "team-a"}
+	)
+
+	BeforeEach(func() {
+		owner = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", UID: "ns-uid"}}
+		sa = &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: baseSa, Namespace: "team-a", UID: "sa-uid"}}
+	})
+
+	It("is created with the token type, the ServiceAccount annotation and its owner", func() {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+		Expect(ensureTokenSecret(ctx, c, scheme.Scheme, sa, owner)).To(Succeed())
+
+		secret := &corev1.Secret{}
+		Expect(c.Get(ctx, key, secret)).To(Succeed())
+		Expect(secret.Type).To(Equal(corev1.SecretTypeServiceAccountToken))
+		Expect(secret.Annotations).To(HaveKeyWithValue(corev1.ServiceAccountNameKey, baseSa))
+		Expect(metav1.IsControlledBy(secret, owner)).To(BeTrue())
+	})
+
+	It("gets its annotation back without touching the type", func() {
+		existing := tokenSecret("sa-uid", "token", nil)
+		existing.Annotations = map[string]string{"other": "kept"}
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(existing).Build()
+		Expect(ensureTokenSecret(ctx, c, scheme.Scheme, sa, owner)).To(Succeed())
+
+		secret := &corev1.Secret{}
+		Expect(c.Get(ctx, key, secret)).To(Succeed())
+		Expect(secret.Type).To(Equal(corev1.SecretTypeServiceAccountToken))
+		Expect(secret.Annotations).To(HaveKeyWithValue(corev1.ServiceAccountNameKey, baseSa))
+		Expect(secret.Annotations).To(HaveKeyWithValue("other", "kept"))
+	})
+
+	It("is reported and left alone when it has another type", func() {
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+			Type:       corev1.SecretTypeOpaque,
+		}
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(existing).Build()
+		Expect(ensureTokenSecret(ctx, c, scheme.Scheme, sa, owner)).To(MatchError(ContainSubstring("delete it to have it recreated")))
+
+		secret := &corev1.Secret{}
+		Expect(c.Get(ctx, key, secret)).To(Succeed())
+		Expect(secret.Type).To(Equal(corev1.SecretTypeOpaque))
+		Expect(secret.Annotations).NotTo(HaveKey(corev1.ServiceAccountNameKey))
+	})
+})
+
+var _ = Describe("serviceAccountToken", func() {
+	var (
+		ctx = context.Background()
+		sa  = &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: baseSa, Namespace: "team-a", UID: "sa-uid"}}
+	)
+
+	AfterEach(func() {
+		tokenExpiries.forget("team-a", baseSa)
+	})
+
+	type tokenCase struct {
+		secret     *corev1.Secret
+		want       string
+		wantExpiry float64
+		recorded   bool
+	}
+
+	DescribeTable("returns the token of the ServiceAccount and records its expiry",
+		func(tc tokenCase) {
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(tc.secret).Build()
+			token, err := serviceAccountToken(ctx, c, sa)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(token).To(Equal(tc.want))
+
+			expiry, ok := tokenExpiries.get("team-a", baseSa)
+			Expect(ok).To(Equal(tc.recorded))
+			Expect(expiry).To(Equal(tc.wantExpiry))
+		},
+		Entry("bound token", tokenCase{
+			secret:     tokenSecret("sa-uid", jwt(`{"exp":1861920000}`), nil),
+			want:       jwt(`{"exp":1861920000}`),
+			wantExpiry: 1861920000,
+			recorded:   true,
+		}),
+		Entry("legacy token", tokenCase{
+			secret:     tokenSecret("sa-uid", "token", nil),
+			want:       "token",
+			wantExpiry: math.Inf(1),
+			recorded:   true,
+		}),
+		Entry("invalidated legacy token", tokenCase{
+			secret:     tokenSecret("sa-uid", "token", map[string]string{legacyTokenInvalidSinceLabel: "2029-01-01"}),
+			want:       "token",
+			wantExpiry: 1861920000,
+			recorded:   true,
+		}),
+		Entry("not populated yet", tokenCase{
+			secret: tokenSecret("sa-uid", "", nil),
+		}),
+		Entry("populated for a previous ServiceAccount", tokenCase{
+			secret: tokenSecret("old-uid", "token", nil),
+		}),
+	)
+
+	It("fails when the Secret is missing", func() {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+		_, err := serviceAccountToken(ctx, c, sa)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("forgets the expiry of an emptied or removed token", func() {
+		tokenExpiries.record(tokenSecret("sa-uid", "token", nil))
+		tokenExpiries.record(tokenSecret("sa-uid", "", nil))
+		_, ok := tokenExpiries.get("team-a", baseSa)
+		Expect(ok).To(BeFalse())
+
+		tokenExpiries.record(tokenSecret("sa-uid", "token", nil))
+		tokenExpiries.forget("team-a", baseSa)
+		_, ok = tokenExpiries.get("team-a", baseSa)
+		Expect(ok).To(BeFalse())
+	})
+})
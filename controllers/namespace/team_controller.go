@@ -0,0 +1,332 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	// namespaceHeaderSeparator joins the namespaces of a team in the namespace
+	// header, which is the list format the label-enforcing proxy accepts.
+	namespaceHeaderSeparator = ","
+	// teamResyncPeriod bounds how long drift of a team datasource can last,
+	// the objects it is made of do not trigger the team controller.
+	teamResyncPeriod = 10 * time.Minute
+)
+
+// Enable the aggregated team datasources as a env.
+var teamDatasourceEnabled, _ = strconv.ParseBool(os.Getenv("TEAM_DATASOURCE_ENABLED"))
+
+// TeamReconciler reconciles the aggregated datasource of a team, which covers
+// every monitored namespace carrying its team label. Requests are keyed by
+// the team name.
+type TeamReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Backend writes the generated datasources, it is selected with
+	// DATASOURCE_BACKEND when not set.
+	Backend Backend
+	// Recorder reports the drift repaired on the datasource objects.
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=delete
+
+// Reconcile keeps the namespace list, the credential and the datasource of a
+// team up to date, and removes them once the team has no namespace left.
+func (r *TeamReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	team := req.Name
+	logger := log.FromContext(ctx).WithValues("team", team)
+
+	namespaces, instance, err := r.teamNamespaces(ctx, team)
+	if err != nil {
+		logger.Error(err, "Unable to list team namespaces")
+		return ctrl.Result{}, err
+	}
+	if len(namespaces) == 0 {
+		return ctrl.Result{}, r.removeTeamDatasource(ctx, team)
+	}
+	ctx, err = grafana.Instances.ContextFor(ctx, instanceSelector(instance))
+	if err != nil {
+		logger.Error(err, "Unable to select Grafana instance")
+		return ctrl.Result{}, err
+	}
+
+	logger.Info("Reconciling team datasource", "namespaces", namespaces)
+
+	// The team ServiceAccount is bound to the metrics reader Role of every team
+	// namespace by the namespace controller, its token is valid for all of them.
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: teamServiceAccountName(team), Namespace: baseNs}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, sa, func() error {
+		if sa.Labels == nil {
+			sa.Labels = map[string]string{}
+		}
+		sa.Labels[teamLabel] = team
+		// Record the instance, the datasource is removed from it
+		if instance != "" {
+			if sa.Annotations == nil {
+				sa.Annotations = map[string]string{}
+			}
+			sa.Annotations[grafana.InstanceLabel] = instance
+		} else {
+			delete(sa.Annotations, grafana.InstanceLabel)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error(err, "Unable to reconcile team ServiceAccount", "serviceAccount.Name", sa.Name)
+		return ctrl.Result{}, err
+	}
+	logger.Info("Team ServiceAccount reconciled", "serviceAccount.Name", sa.Name, "operation", op)
+
+	err = ensureTokenSecret(ctx, r.Client, r.Scheme, sa, sa)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	token, err := serviceAccountToken(ctx, r.Client, sa)
+	if err != nil {
+		logger.Error(err, "Unable to get ServiceAccount token Secret")
+		return ctrl.Result{}, err
+	}
+	// Token controller has not populated the token yet
+	if token == "" {
+		logger.Info("Waiting for ServiceAccount token", "serviceAccount.Name", sa.Name)
+		return ctrl.Result{RequeueAfter: tokenRequeueDelay}, nil
+	}
+
+	// Namespace datasources are named after their namespace, the namespace wins
+	name := teamDatasourceName(team)
+	err = r.Get(ctx, types.NamespacedName{Name: name}, &corev1.Namespace{})
+	if err == nil {
+		logger.Info("Not reconciling team datasource, a namespace has its name", "namespace", name)
+		r.Recorder.Eventf(sa, corev1.EventTypeWarning, "DatasourceNameConflict",
+			"Namespace %s has the name of the datasource of team %s, which is not written while the namespace exists", name, team)
+		return ctrl.Result{RequeueAfter: teamResyncPeriod}, nil
+	}
+	if !errors.IsNotFound(err) {
+		logger.Error(err, "Unable to check for a namespace named like the team datasource")
+		return ctrl.Result{}, err
+	}
+
+	retrievedOrg, err := getOrCreateOrg(ctx, team)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	ds := &Datasource{
+		Name:      name,
+		UID:       datasourceUID(name),
+		OrgID:     int64(retrievedOrg.ID),
+		Token:     token,
+		Namespace: strings.Join(namespaces, namespaceHeaderSeparator),
+	}
+	if _, ok := r.Backend.(DatasourceDeleter); ok {
+		// Record where the datasource lives, it is removed with the ServiceAccount
+		patch := client.MergeFrom(sa.DeepCopy())
+		if sa.Annotations == nil {
+			sa.Annotations = map[string]string{}
+		}
+		sa.Annotations[datasourceUIDAnnotation] = ds.UID
+		sa.Annotations[datasourceOrgAnnotation] = strconv.FormatInt(ds.OrgID, 10)
+		err = r.Patch(ctx, sa, patch)
+		if err != nil {
+			logger.Error(err, "Unable to record datasource on team ServiceAccount")
+			return ctrl.Result{}, err
+		}
+	}
+	// The team ServiceAccount owns the objects of the datasource
+	err = r.Backend.EnsureDatasource(ctx, ds, sa)
+	if err != nil {
+		logger.Error(err, "Unable to reconcile team datasource", "backend", datasourceBackend)
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: teamResyncPeriod}, nil
+}
+
+// teamNamespaces returns the sorted names of the monitored namespaces of team
+// and their Grafana instance. A team datasource lives in a single instance,
+// the one of the first namespace; namespaces selecting another are left out.
+func (r *TeamReconciler) teamNamespaces(ctx context.Context, team string) ([]string, string, error) {
+	list := &corev1.NamespaceList{}
+	err := r.List(ctx, list, client.MatchingLabels{teamLabel: team}, client.HasLabels{nsMonitoringLabel})
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	var namespaces []string
+	var instance string
+	for i, ns := range list.Items {
+		if !ns.DeletionTimestamp.IsZero() {
+			continue
+		}
+		nsInstance := grafana.InstanceOf(&list.Items[i])
+		if len(namespaces) == 0 {
+			instance = nsInstance
+		} else if nsInstance != instance {
+			log.FromContext(ctx).Info("Leaving namespace out of team datasource, it selects another Grafana instance",
+				"namespace", ns.Name, "instance", nsInstance, "teamInstance", instance)
+			continue
+		}
+		namespaces = append(namespaces, ns.Name)
+	}
+	return namespaces, instance, nil
+}
+
+// instanceSelector is an object selecting instance, see grafana.InstanceOf.
+func instanceSelector(instance string) metav1.Object {
+	obj := &metav1.ObjectMeta{}
+	if instance != "" {
+		obj.Annotations = map[string]string{grafana.InstanceLabel: instance}
+	}
+	return obj
+}
+
+// removeTeamDatasource deletes the team ServiceAccount, which garbage collects
+// the objects it owns. Datasources living in Grafana only are deleted first.
+func (r *TeamReconciler) removeTeamDatasource(ctx context.Context, team string) error {
+	logger := log.FromContext(ctx).WithValues("team", team)
+
+	sa := &corev1.ServiceAccount{}
+	err := r.Get(ctx, types.NamespacedName{Name: teamServiceAccountName(team), Namespace: baseNs}, sa)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "Unable to get team ServiceAccount")
+		return err
+	}
+
+	if deleter, ok := r.Backend.(DatasourceDeleter); ok {
+		if orgID, uid, ok := recordedDatasource(sa.Annotations); ok {
+			ctx, err := grafana.Instances.ContextFor(ctx, sa)
+			if err != nil {
+				logger.Error(err, "Unable to select Grafana instance")
+				return err
+			}
+			err = deleter.DeleteDatasource(ctx, orgID, uid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	logger.Info("Removing team datasource, team has no namespace left", "serviceAccount.Name", sa.Name)
+	err = r.Delete(ctx, sa, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Unable to delete team ServiceAccount")
+		return err
+	}
+	tokenExpiries.forget(baseNs, sa.Name)
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager. It does nothing
+// unless TEAM_DATASOURCE_ENABLED is set.
+func (r *TeamReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if !teamDatasourceEnabled {
+		return nil
+	}
+	if r.Backend == nil {
+		backend, err := NewBackend(datasourceBackend, r.Client, r.Scheme, r.Recorder)
+		if err != nil {
+			return err
+		}
+		r.Backend = backend
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("team").
+		Watches(&corev1.Namespace{}, namespaceToTeams()).
+		Watches(&corev1.ServiceAccount{}, handler.EnqueueRequestsFromMapFunc(teamServiceAccountToTeam)).
+		Complete(grafana.HandleErrors(mgr, r, nil))
+}
+
+// namespaceToTeams enqueues the team of a namespace. When the labels of a
+// namespace change both the team it leaves and the team it joins are enqueued.
+func namespaceToTeams() handler.EventHandler {
+	enqueue := func(q workqueue.RateLimitingInterface, obj client.Object) {
+		if team, ok := obj.GetLabels()[teamLabel]; ok {
+			q.Add(reconcile.Request{NamespacedName: types.NamespacedName{Name: team}})
+		}
+	}
+	return handler.Funcs{
+		CreateFunc: func(ctx context.Context, e event.CreateEvent, q workqueue.RateLimitingInterface) {
+			enqueue(q, e.Object)
+		},
+		UpdateFunc: func(ctx context.Context, e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+			if reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels()) &&
+				e.ObjectOld.GetDeletionTimestamp().Equal(e.ObjectNew.GetDeletionTimestamp()) {
+				return
+			}
+			enqueue(q, e.ObjectOld)
+			enqueue(q, e.ObjectNew)
+		},
+		DeleteFunc: func(ctx context.Context, e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+			enqueue(q, e.Object)
+		},
+	}
+}
+
+// teamServiceAccountToTeam maps a team ServiceAccount in baseNs to its team.
+func teamServiceAccountToTeam(ctx context.Context, obj client.Object) []reconcile.Request {
+	team, ok := obj.GetLabels()[teamLabel]
+	if obj.GetNamespace() != baseNs || !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: team}}}
+}
+
+// teamServiceAccountName is the ServiceAccount in baseNs whose token is used by
+// the aggregated datasource of team.
+func teamServiceAccountName(team string) string {
+	return "team-" + sanitizeName(team) + "-datasource"
+}
+
+// teamDatasourceName is the name of the aggregated datasource of team. A
+// namespace may have the same name, the team datasource is then not written.
+func teamDatasourceName(team string) string {
+	return sanitizeName(team) + "-all-namespaces"
+}
+
+// sanitizeName turns a label value into a valid object name.
+func sanitizeName(s string) string {
+	return strings.ReplaceAll(strings.ToLower(s), "_", "-")
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+// recordingBackend records the datasources it is asked to write.
+type recordingBackend struct {
+	datasources []*Datasource
+}
+
+func (b *recordingBackend) EnsureDatasource(ctx context.Context, ds *Datasource, owner client.Object) error {
+	b.datasources = append(b.datasources, ds)
+	return nil
+}
+
+func (b *recordingBackend) Watch(bld *builder.Builder) *builder.Builder {
+	return bld
+}
+
+// teamNamespace returns a monitored namespace of team selecting instance.
+func teamNamespace(name, team, instance string) *corev1.Namespace {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{nsMonitoringLabel: "", teamLabel: team},
+	}}
+	if instance != "" {
+		ns.Labels[grafana.InstanceLabel] = instance
+	}
+	return ns
+}
+
+// deleting marks ns as being deleted.
+func deleting(ns *corev1.Namespace) *corev1.Namespace {
+	now := metav1.NewTime(time.Now())
+	ns.DeletionTimestamp = &now
+	ns.Finalizers = []string{datasourceFinalizer}
+	return ns
+}
+
+// teamServiceAccount returns the team ServiceAccount and its populated token
+// Secret.
+func teamServiceAccount(team string) []client.Object {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: teamServiceAccountName(team), Namespace: baseNs, UID: "sa-uid"}}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        tokenSecretName(sa.Name),
+			Namespace:   baseNs,
+			Annotations: map[string]string{corev1.ServiceAccountNameKey: sa.Name, corev1.ServiceAccountUIDKey: "sa-uid"},
+		},
+		Type: corev1.SecretTypeServiceAccountToken,
+		Data: map[string][]byte{corev1.ServiceAccountTokenKey: []byte("token")},
+	}
+	return []client.Object{sa, secret}
+}
+
+var _ = Describe("TeamReconciler", func() {
+	DescribeTable("teamNamespaces covers the namespaces of the team in the instance of the first one",
+		func(namespaces []*corev1.Namespace, want []string, wantInstance string) {
+			objs := []client.Object{teamNamespace("other-team", "team-b", "")}
+			for _, ns := range namespaces {
+				objs = append(objs, ns)
+			}
+			r := &TeamReconciler{Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build()}
+			got, instance, err := r.teamNamespaces(context.Background(), "team-a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(want))
+			Expect(instance).To(Equal(wantInstance))
+		},
+		Entry("none", nil, []string(nil), ""),
+		Entry("sorted by name", []*corev1.Namespace{
+			teamNamespace("b", "team-a", ""),
+			teamNamespace("a", "team-a", ""),
+		}, []string{"a", "b"}, ""),
+		Entry("without the unmonitored ones", []*corev1.Namespace{
+			teamNamespace("a", "team-a", ""),
+			{ObjectMeta: metav1.ObjectMeta{Name: "b", Labels: map[string]string{teamLabel: "team-a"}}},
+		}, []string{"a"}, ""),
+		Entry("without the ones being deleted", []*corev1.Namespace{
+			deleting(teamNamespace("a", "team-a", "staging")),
+			teamNamespace("b", "team-a", ""),
+		}, []string{"b"}, ""),
+		Entry("in the instance of the first one", []*corev1.Namespace{
+			teamNamespace("a", "team-a", "staging"),
+			teamNamespace("b", "team-a", ""),
+			teamNamespace("c", "team-a", "staging"),
+		}, []string{"a", "c"}, "staging"),
+	)
+
+	It("writes the team datasource covering the team namespaces", func() {
+		server := &grafanaServer{responses: map[string]string{
+			"GET /api/orgs/name/team-a": `{"id":3,"name":"team-a"}`,
+		}}
+		ctx, stop := withGrafana(server)
+		defer stop()
+
+		objs := append(teamServiceAccount("team-a"), teamNamespace("b", "team-a", testInstance), teamNamespace("a", "team-a", testInstance))
+		backend := &recordingBackend{}
+		r := &TeamReconciler{
+			Client:   fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build(),
+			Scheme:   scheme.Scheme,
+			Backend:  backend,
+			Recorder: record.NewFakeRecorder(10),
+		}
+		result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "team-a"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: teamResyncPeriod}))
+		Expect(backend.datasources).To(Equal([]*Datasource{{
+			Name:      "team-a-all-namespaces",
+			UID:       datasourceUID("team-a-all-namespaces"),
+			OrgID:     3,
+			Token:     "token",
+			Namespace: "a,b",
+		}}))
+	})
+
+	It("skips the team datasource while a namespace has its name", func() {
+		objs := append(teamServiceAccount("Team_A"),
+			teamNamespace("a", "Team_A", ""),
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: teamDatasourceName("Team_A")}})
+		backend := &recordingBackend{}
+		recorder := record.NewFakeRecorder(10)
+		r := &TeamReconciler{
+			Client:   fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build(),
+			Scheme:   scheme.Scheme,
+			Backend:  backend,
+			Recorder: recorder,
+		}
+		result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "Team_A"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: teamResyncPeriod}))
+		Expect(backend.datasources).To(BeEmpty())
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning DatasourceNameConflict Namespace team-a-all-namespaces ")))
+	})
+})
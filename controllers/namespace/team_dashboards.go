@@ -0,0 +1,239 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/grafana-tools/sdk"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
+)
+
+const (
+	// teamDashboardLabel marks the ConfigMaps of a team namespace holding
+	// dashboards, every key ending in .json is a dashboard.
+	teamDashboardLabel = grafana.DashboardLabel
+	// importedDashboardTag marks the dashboards imported from ConfigMaps.
+	importedDashboardTag = "snappcloud-imported-dashboard"
+	// teamDashboardResyncPeriod bounds how long changes made in Grafana last.
+	teamDashboardResyncPeriod = teamResyncPeriod
+)
+
+// TeamDashboardReconciler imports the dashboards kept in ConfigMaps of a
+// monitored namespace into the namespace folder of the team org. Requests are
+// keyed by namespace.
+type TeamDashboardReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Recorder reports the dashboards which are not valid JSON on their ConfigMap.
+	Recorder record.EventRecorder
+}
+
+// Reconcile writes the dashboards of the ConfigMaps of the namespace and
+// deletes the imported dashboards whose ConfigMap or key is gone.
+func (r *TeamDashboardReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	ns := &corev1.Namespace{}
+	err := r.Get(ctx, req.NamespacedName, ns)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get Namespace")
+		return ctrl.Result{}, err
+	}
+	// The folder and its dashboards are removed by the namespace controller
+	if !isMonitored(ns) || !ns.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+	orgID, ok := recordedOrg(ns.Annotations)
+	if !ok {
+		logger.Info("Waiting for namespace to be provisioned in Grafana", "namespace", ns.Name)
+		return ctrl.Result{}, nil
+	}
+
+	list := &corev1.ConfigMapList{}
+	err = r.List(ctx, list, client.InNamespace(ns.Name), client.HasLabels{teamDashboardLabel})
+	if err != nil {
+		logger.Error(err, "Failed to list dashboard ConfigMaps")
+		return ctrl.Result{}, err
+	}
+
+	sdkClient, err := newGrafanaClient(ctx, uint(orgID))
+	if err != nil {
+		logger.Error(err, "Unable to create Grafana client")
+		return ctrl.Result{}, err
+	}
+	folder, ok, err := namespaceFolder(ctx, r.Client, sdkClient, ns, len(list.Items) > 0)
+	if err != nil {
+		logger.Error(err, "Unable to reconcile namespace folder", "orgID", orgID)
+		return ctrl.Result{}, err
+	}
+	if !ok {
+		return ctrl.Result{RequeueAfter: teamDashboardResyncPeriod}, nil
+	}
+
+	desired := map[string]bool{}
+	if len(list.Items) > 0 {
+		dsUID, err := grafanaDatasourceUID(ctx, sdkClient, ns.Name)
+		if err != nil {
+			logger.Error(err, "Unable to list Grafana datasources", "orgID", orgID)
+			return ctrl.Result{}, err
+		}
+		if dsUID == "" {
+			logger.Info("Waiting for datasource to be created in Grafana", "datasource.Name", ns.Name)
+			return ctrl.Result{RequeueAfter: datasourceRequeueDelay}, nil
+		}
+
+		for i := range list.Items {
+			cm := &list.Items[i]
+			keys := make([]string, 0, len(cm.Data))
+			for key := range cm.Data {
+				if strings.HasSuffix(key, ".json") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				uid := teamDashboardUID(ns.Name, cm.Name, key)
+				desired[uid] = true
+
+				model := map[string]interface{}{}
+				err = json.Unmarshal([]byte(cm.Data[key]), &model)
+				if err != nil {
+					// Nothing to retry until the ConfigMap is fixed
+					logger.Error(err, "Dashboard is not valid JSON, skipping it", "configmap", cm.Name, "key", key)
+					r.Recorder.Eventf(cm, corev1.EventTypeWarning, "InvalidDashboard", "Dashboard %s is not valid JSON: %v", key, err)
+					continue
+				}
+				importDashboard(model, ns.Name, dsUID)
+				_, err = writeDashboard(ctx, sdkClient, folder, uid, importedDashboardTag, model, false)
+				if err != nil {
+					logger.Error(err, "Unable to write dashboard", "configmap", cm.Name, "key", key, "dashboard.UID", uid)
+					return ctrl.Result{}, err
+				}
+			}
+		}
+	}
+
+	found, err := sdkClient.Search(ctx, sdk.SearchType(sdk.SearchTypeDashboard), sdk.SearchFolderID(folder.ID), sdk.SearchTag(importedDashboardTag))
+	if err != nil {
+		logger.Error(err, "Unable to search dashboards", "folder.UID", folder.UID)
+		return ctrl.Result{}, err
+	}
+	for _, board := range found {
+		if desired[board.UID] {
+			continue
+		}
+		logger.Info("Removing dashboard without ConfigMap", "dashboard.UID", board.UID, "dashboard.Title", board.Title)
+		_, err = sdkClient.DeleteDashboardByUID(ctx, board.UID)
+		if err != nil {
+			logger.Error(err, "Unable to delete dashboard", "dashboard.UID", board.UID)
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: teamDashboardResyncPeriod}, nil
+}
+
+// teamDashboardUID derives a stable dashboard UID from the ConfigMap key, the
+// UID of the dashboard JSON is not used since namespaces of a team share the
+// org.
+func teamDashboardUID(namespace, configMap, key string) string {
+	hash := sha256.Sum256([]byte(namespace + "/" + configMap + "/" + key))
+	return "ud-" + hex.EncodeToString(hash[:])[:24]
+}
+
+// importDashboard prepares a dashboard for the namespace folder: the export
+// sections are dropped and every datasource reference but the builtin ones of
+// Grafana, including the ${DS_...} inputs of exported dashboards, is pointed
+// to the namespace datasource, so a dashboard cannot read the data of other
+// namespaces.
+func importDashboard(model map[string]interface{}, dsName, dsUID string) {
+	delete(model, "__inputs")
+	delete(model, "__requires")
+	delete(model, "__elements")
+	rewriteDatasources(model, dsName, dsUID)
+}
+
+// rewriteDatasources walks the dashboard model and replaces the datasource
+// references. Datasource template variables are limited to the namespace
+// datasource as well.
+func rewriteDatasources(value interface{}, dsName, dsUID string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// Datasource template variables only offer the namespace datasource
+		if _, ok := v["query"]; ok && v["type"] == "datasource" {
+			v["query"] = "prometheus"
+			v["regex"] = "/^" + regexp.QuoteMeta(dsName) + "$/"
+			delete(v, "current")
+			delete(v, "options")
+		}
+		// Panels without a datasource use the default datasource of the org
+		if _, ok := v["targets"]; ok {
+			if _, ok := v["datasource"]; !ok {
+				v["datasource"] = nil
+			}
+		}
+		for key, child := range v {
+			if key == "datasource" && !grafana.IsBuiltinDatasource(child) {
+				v[key] = map[string]interface{}{"type": "prometheus", "uid": dsUID}
+				continue
+			}
+			rewriteDatasources(child, dsName, dsUID)
+		}
+	case []interface{}:
+		for _, child := range v {
+			rewriteDatasources(child, dsName, dsUID)
+		}
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TeamDashboardReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	newObject := func() client.Object { return &corev1.Namespace{} }
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("teamdashboard").
+		Watches(&corev1.Namespace{}, &handler.EnqueueRequestForObject{}).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(dashboardConfigMapToNamespace)).
+		Complete(grafana.HandleErrors(mgr, grafana.SelectInstance(mgr, r, newObject), newObject))
+}
+
+// dashboardConfigMapToNamespace maps a dashboard ConfigMap to its namespace.
+func dashboardConfigMapToNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	if _, ok := obj.GetLabels()[teamDashboardLabel]; !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: obj.GetNamespace()}}}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// namespaceDatasource is the reference importDashboard points queries to.
+var namespaceDatasource = map[string]interface{}{"type": "prometheus", "uid": "ds-a"}
+
+// decoded returns the dashboard model of raw.
+func decoded(raw string) map[string]interface{} {
+	model := map[string]interface{}{}
+	Expect(json.Unmarshal([]byte(raw), &model)).To(Succeed())
+	return model
+}
+
+var _ = Describe("Team dashboards", func() {
+	DescribeTable("importDashboard points every datasource but the builtin ones to the namespace datasource",
+		func(ref interface{}, want interface{}) {
+			model := map[string]interface{}{
+				"title":  "Checkout",
+				"panels": []interface{}{map[string]interface{}{"type": "timeseries", "datasource": ref, "targets": []interface{}{}}},
+			}
+			importDashboard(model, "team-a", "ds-a")
+			panel := model["panels"].([]interface{})[0].(map[string]interface{})
+			Expect(panel["datasource"]).To(Equal(want))
+		},
+		Entry("default datasource", nil, namespaceDatasource),
+		Entry("name", "prometheus-team-b", namespaceDatasource),
+		Entry("exported input", "${DS_PROMETHEUS}", namespaceDatasource),
+		Entry("Prometheus UID", map[string]interface{}{"type": "prometheus", "uid": "team-b"}, namespaceDatasource),
+		Entry("other type", map[string]interface{}{"type": "loki", "uid": "logs"}, namespaceDatasource),
+		Entry("no type", map[string]interface{}{"uid": "team-b"}, namespaceDatasource),
+		Entry("builtin name", "-- Grafana --", "-- Grafana --"),
+		Entry("builtin UID", map[string]interface{}{"type": "datasource", "uid": "-- Dashboard --"},
+			map[string]interface{}{"type": "datasource", "uid": "-- Dashboard --"}),
+	)
+
+	It("importDashboard rewrites the targets, rows, variables and annotations", func() {
+		model := decoded(`{
+			"__inputs": [{"name": "DS_PROMETHEUS", "type": "datasource"}],
+			"__requires": [{"type": "datasource", "id": "prometheus"}],
+			"panels": [
+				{"type": "row", "panels": [
+					{"type": "stat", "targets": [{"expr": "up", "datasource": {"type": "loki", "uid": "logs"}}]}
+				]},
+				{"type": "timeseries", "datasource": {"type": "datasource", "uid": "-- Mixed --"}, "targets": [
+					{"expr": "up", "datasource": "team-b"},
+					{"datasource": {"type": "__expr__", "uid": "__expr__"}, "expression": "$A > 1"}
+				]}
+			],
+			"templating": {"list": [
+				{"name": "ds", "type": "datasource", "query": "loki", "current": {"text": "team-b"}, "options": []},
+				{"name": "pod", "type": "query", "datasource": {"type": "prometheus", "uid": "${ds}"}}
+			]},
+			"annotations": {"list": [
+				{"name": "Annotations & Alerts", "datasource": {"type": "grafana", "uid": "-- Grafana --"}},
+				{"name": "Deploys", "datasource": {"type": "elasticsearch", "uid": "deploys"}}
+			]}
+		}`)
+		importDashboard(model, "team-a", "ds-a")
+
+		Expect(model).To(Equal(decoded(`{
+			"panels": [
+				{"type": "row", "panels": [
+					{"type": "stat", "datasource": {"type": "prometheus", "uid": "ds-a"},
+					 "targets": [{"expr": "up", "datasource": {"type": "prometheus", "uid": "ds-a"}}]}
+				]},
+				{"type": "timeseries", "datasource": {"type": "datasource", "uid": "-- Mixed --"}, "targets": [
+					{"expr": "up", "datasource": {"type": "prometheus", "uid": "ds-a"}},
+					{"datasource": {"type": "__expr__", "uid": "__expr__"}, "expression": "$A > 1"}
+				]}
+			],
+			"templating": {"list": [
+				{"name": "ds", "type": "datasource", "query": "prometheus", "regex": "/^team-a$/"},
+				{"name": "pod", "type": "query", "datasource": {"type": "prometheus", "uid": "ds-a"}}
+			]},
+			"annotations": {"list": [
+				{"name": "Annotations & Alerts", "datasource": {"type": "grafana", "uid": "-- Grafana --"}},
+				{"name": "Deploys", "datasource": {"type": "prometheus", "uid": "ds-a"}}
+			]}
+		}`)))
+	})
+
+	It("teamDashboardUID is stable and tells apart namespaces, ConfigMaps and keys", func() {
+		uid := teamDashboardUID("team-a", "dashboards", "overview.json")
+		Expect(uid).To(HavePrefix("ud-"))
+		Expect(len(uid)).To(BeNumerically("<=", 40))
+		Expect(teamDashboardUID("team-a", "dashboards", "overview.json")).To(Equal(uid))
+		Expect(teamDashboardUID("team-b", "dashboards", "overview.json")).NotTo(Equal(uid))
+		Expect(teamDashboardUID("team-a", "other", "overview.json")).NotTo(Equal(uid))
+		Expect(teamDashboardUID("team-a", "dashboards", "pods.json")).NotTo(Equal(uid))
+	})
+})
@@ -0,0 +1,253 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// ContactPoint is a contact point of the alerting provisioning API.
+type ContactPoint struct {
+	UID                   string                 `json:"uid,omitempty"`
+	Name                  string                 `json:"name"`
+	Type                  string                 `json:"type"`
+	Settings              map[string]interface{} `json:"settings"`
+	DisableResolveMessage bool                   `json:"disableResolveMessage"`
+}
+
+// Route is a node of the notification policy tree. Object matchers are
+// [label, operator, value] triples.
+type Route struct {
+	Receiver            string      `json:"receiver,omitempty"`
+	GroupBy             []string    `json:"group_by,omitempty"`
+	ObjectMatchers      [][3]string `json:"object_matchers,omitempty"`
+	MuteTimeIntervals   []string    `json:"mute_time_intervals,omitempty"`
+	ActiveTimeIntervals []string    `json:"active_time_intervals,omitempty"`
+	Continue            bool        `json:"continue,omitempty"`
+	GroupWait           string      `json:"group_wait,omitempty"`
+	GroupInterval       string      `json:"group_interval,omitempty"`
+	RepeatInterval      string      `json:"repeat_interval,omitempty"`
+	Routes              []Route     `json:"routes,omitempty"`
+	// Extra keeps the fields of Grafana this type does not know, so they
+	// survive reading and writing back the tree.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// routeFields are the JSON fields of Route.
+var routeFields = []string{"receiver", "group_by", "object_matchers", "mute_time_intervals", "active_time_intervals",
+	"continue", "group_wait", "group_interval", "repeat_interval", "routes"}
+
+func (r *Route) UnmarshalJSON(data []byte) error {
+	type plain Route
+	if err := json.Unmarshal(data, (*plain)(r)); err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, field := range routeFields {
+		delete(fields, field)
+	}
+	r.Extra = nil
+	if len(fields) > 0 {
+		r.Extra = fields
+	}
+	return nil
+}
+
+func (r Route) MarshalJSON() ([]byte, error) {
+	type plain Route
+	raw, err := json.Marshal(plain(r))
+	if err != nil || len(r.Extra) == 0 {
+		return raw, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	for field, value := range r.Extra {
+		if _, ok := fields[field]; !ok {
+			fields[field] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// AlertingClient calls the alerting provisioning API of an organization,
+// which the sdk does not cover.
+type AlertingClient struct {
+	restClient
+}
+
+// NewAlertingClient connects to the alerting provisioning API of orgID.
+func NewAlertingClient(creds Credentials, orgID uint) (*AlertingClient, error) {
+	rest, err := newRESTClient(creds, orgID)
+	if err != nil {
+		return nil, err
+	}
+	return &AlertingClient{rest}, nil
+}
+
+// GetContactPoints returns the contact points of the org.
+func (c *AlertingClient) GetContactPoints(ctx context.Context) ([]ContactPoint, error) {
+	var contactPoints []ContactPoint
+	err := c.do(ctx, http.MethodGet, "api/v1/provisioning/contact-points", nil, &contactPoints)
+	return contactPoints, err
+}
+
+// CreateContactPoint creates cp with the UID it carries.
+func (c *AlertingClient) CreateContactPoint(ctx context.Context, cp ContactPoint) error {
+	return c.do(ctx, http.MethodPost, "api/v1/provisioning/contact-points", cp, nil)
+}
+
+// UpdateContactPoint replaces the contact point with the UID of cp.
+func (c *AlertingClient) UpdateContactPoint(ctx context.Context, cp ContactPoint) error {
+	return c.do(ctx, http.MethodPut, "api/v1/provisioning/contact-points/"+cp.UID, cp, nil)
+}
+
+// DeleteContactPoint deletes a contact point. It is a no-op when the contact
+// point does not exist.
+func (c *AlertingClient) DeleteContactPoint(ctx context.Context, uid string) error {
+	err := c.do(ctx, http.MethodDelete, "api/v1/provisioning/contact-points/"+uid, nil, nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// GetPolicyTree returns the notification policy tree of the org.
+func (c *AlertingClient) GetPolicyTree(ctx context.Context) (Route, error) {
+	var tree Route
+	err := c.do(ctx, http.MethodGet, "api/v1/provisioning/policies", nil, &tree)
+	return tree, err
+}
+
+// SetPolicyTree replaces the notification policy tree of the org.
+func (c *AlertingClient) SetPolicyTree(ctx context.Context, tree Route) error {
+	return c.do(ctx, http.MethodPut, "api/v1/provisioning/policies", tree, nil)
+}
+
+// ResetPolicyTree restores the default notification policy tree of the org.
+func (c *AlertingClient) ResetPolicyTree(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "api/v1/provisioning/policies", nil, nil)
+}
+
+// AlertRule is a Grafana-managed alert rule of the provisioning API.
+type AlertRule struct {
+	UID          string            `json:"uid,omitempty"`
+	OrgID        int64             `json:"orgID"`
+	FolderUID    string            `json:"folderUID"`
+	RuleGroup    string            `json:"ruleGroup"`
+	Title        string            `json:"title"`
+	Condition    string            `json:"condition"`
+	Data         []AlertQuery      `json:"data"`
+	NoDataState  string            `json:"noDataState"`
+	ExecErrState string            `json:"execErrState"`
+	For          string            `json:"for"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// AlertQuery is a query or an expression of an alert rule.
+type AlertQuery struct {
+	RefID             string                 `json:"refId"`
+	DatasourceUID     string                 `json:"datasourceUid"`
+	RelativeTimeRange RelativeTimeRange      `json:"relativeTimeRange"`
+	Model             map[string]interface{} `json:"model"`
+}
+
+// RelativeTimeRange is the time range of a query in seconds before now.
+type RelativeTimeRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// RuleGroup is a group of alert rules evaluated together. The interval is in
+// seconds.
+type RuleGroup struct {
+	Title     string      `json:"title"`
+	FolderUID string      `json:"folderUid"`
+	Interval  int64       `json:"interval"`
+	Rules     []AlertRule `json:"rules"`
+}
+
+// GetAlertRules returns the alert rules of the org.
+func (c *AlertingClient) GetAlertRules(ctx context.Context) ([]AlertRule, error) {
+	var rules []AlertRule
+	err := c.do(ctx, http.MethodGet, "api/v1/provisioning/alert-rules", nil, &rules)
+	return rules, err
+}
+
+// DeleteAlertRule deletes an alert rule. It is a no-op when the rule does not
+// exist.
+func (c *AlertingClient) DeleteAlertRule(ctx context.Context, uid string) error {
+	err := c.do(ctx, http.MethodDelete, "api/v1/provisioning/alert-rules/"+uid, nil, nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// GetRuleGroup returns a rule group of a folder.
+func (c *AlertingClient) GetRuleGroup(ctx context.Context, folderUID, title string) (RuleGroup, error) {
+	var group RuleGroup
+	err := c.do(ctx, http.MethodGet, ruleGroupPath(folderUID, title), nil, &group)
+	return group, err
+}
+
+// SetRuleGroup creates or replaces a rule group, rules missing from the group
+// are deleted. It needs Grafana 10 or later.
+func (c *AlertingClient) SetRuleGroup(ctx context.Context, group RuleGroup) error {
+	return c.do(ctx, http.MethodPut, ruleGroupPath(group.FolderUID, group.Title), group, nil)
+}
+
+// DeleteFolderRules deletes the alert rules of a folder which carry the
+// annotation, and reports whether the folder holds other rules. Grafana
+// refuses to delete a folder holding alert rules.
+func (c *AlertingClient) DeleteFolderRules(ctx context.Context, folderUID, annotation string) (bool, error) {
+	rules, err := c.GetAlertRules(ctx)
+	// Grafana versions without the endpoint have no provisioned rules either
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	others := false
+	for _, rule := range rules {
+		if rule.FolderUID != folderUID {
+			continue
+		}
+		if rule.Annotations[annotation] == "" {
+			others = true
+			continue
+		}
+		err = c.DeleteAlertRule(ctx, rule.UID)
+		if err != nil {
+			return false, err
+		}
+	}
+	return others, nil
+}
+
+func ruleGroupPath(folderUID, title string) string {
+	return "api/v1/provisioning/folder/" + url.PathEscape(folderUID) + "/rule-groups/" + url.PathEscape(title)
+}
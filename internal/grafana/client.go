@@ -0,0 +1,100 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package grafana contains the Grafana API helpers shared by the controllers.
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/grafana-tools/sdk"
+)
+
+// Client is the part of the Grafana API the operator uses, implemented by
+// grafana.Client. Clients of a Connection share its timeouts, retries, rate
+// limit and circuit breaker.
+type Client interface {
+	GetActualUser(ctx context.Context) (sdk.User, error)
+	GetAllUsers(ctx context.Context) ([]sdk.User, error)
+
+	GetOrgById(ctx context.Context, oid uint) (sdk.Org, error)
+	GetOrgByOrgName(ctx context.Context, name string) (sdk.Org, error)
+	CreateOrg(ctx context.Context, org sdk.Org) (sdk.StatusMessage, error)
+	GetOrgUsers(ctx context.Context, oid uint) ([]sdk.OrgUser, error)
+	AddOrgUser(ctx context.Context, user sdk.UserRole, oid uint) (sdk.StatusMessage, error)
+	UpdateOrgUser(ctx context.Context, user sdk.UserRole, oid, uid uint) (sdk.StatusMessage, error)
+
+	SearchTeams(ctx context.Context, params ...sdk.SearchTeamParams) (sdk.PageTeams, error)
+	GetTeamMembers(ctx context.Context, teamID uint) ([]sdk.TeamMember, error)
+
+	GetAllDatasources(ctx context.Context) ([]sdk.Datasource, error)
+	CreateDatasource(ctx context.Context, ds sdk.Datasource) (sdk.StatusMessage, error)
+	UpdateDatasource(ctx context.Context, ds sdk.Datasource) (sdk.StatusMessage, error)
+	DeleteDatasource(ctx context.Context, id uint) (sdk.StatusMessage, error)
+
+	GetFolderByUID(ctx context.Context, uid string) (sdk.Folder, error)
+	CreateFolder(ctx context.Context, f sdk.Folder) (sdk.Folder, error)
+	DeleteFolderByUID(ctx context.Context, uid string) (bool, error)
+	GetFolderPermissions(ctx context.Context, folderUID string) ([]sdk.FolderPermission, error)
+	UpdateFolderPermissions(ctx context.Context, folderUID string, up ...sdk.FolderPermission) (sdk.StatusMessage, error)
+
+	Search(ctx context.Context, params ...sdk.SearchParam) ([]sdk.FoundBoard, error)
+	GetRawDashboardByUID(ctx context.Context, uid string) ([]byte, sdk.BoardProperties, error)
+	SetRawDashboardWithParam(ctx context.Context, request sdk.RawBoardRequest) (sdk.StatusMessage, error)
+	DeleteDashboardByUID(ctx context.Context, uid string) (sdk.StatusMessage, error)
+}
+
+var _ Client = &sdk.Client{}
+
+// orgTransport scopes every request to a Grafana organization using the
+// X-Grafana-Org-Id header instead of switching the user context.
+type orgTransport struct {
+	orgID uint
+	base  http.RoundTripper
+}
+
+func (t *orgTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Grafana-Org-Id", strconv.FormatUint(uint64(t.orgID), 10))
+	return t.base.RoundTrip(req)
+}
+
+// NewClient connects to the Grafana API of orgID with the credentials
+// authFor selects. Requests are scoped to orgID unless it is zero or the
+// credential is a token of that org.
+func NewClient(creds Credentials, orgID uint) (Client, error) {
+	auth, err := creds.authFor(orgID)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = &statusTransport{base: creds.transport()}
+	if orgID != 0 && auth.scoped {
+		transport = &orgTransport{orgID: orgID, base: transport}
+	}
+	httpClient := &http.Client{Transport: transport}
+	key := auth.token
+	if key == "" {
+		key = fmt.Sprintf("%s:%s", auth.username, auth.password)
+	}
+	client, err := sdk.NewClient(creds.URL, key, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
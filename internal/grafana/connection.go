@@ -0,0 +1,179 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoCredentials is returned while no Grafana credentials are loaded.
+var ErrNoCredentials = errors.New("no valid Grafana credentials loaded")
+
+// ErrNoOrgCredential is returned when the loaded credentials have none able
+// to act in an org, such as org tokens of other orgs only.
+var ErrNoOrgCredential = errors.New("no Grafana credential for the org")
+
+// Credentials locate the Grafana API and authenticate to it, with service
+// account tokens or basic auth.
+type Credentials struct {
+	URL string
+	// Username and Password authenticate with basic auth, as a Grafana
+	// Admin for the server wide calls such as creating orgs.
+	Username string
+	Password string
+	// Token is a service account token, preferred for the calls which are not
+	// scoped to an org.
+	Token string
+	// OrgTokens are service account tokens by the ID of their org, a service
+	// account only acts in its own org.
+	OrgTokens map[uint]string
+	// Transport sends the requests, http.DefaultTransport when nil. It holds
+	// the TLS settings of the instance.
+	Transport http.RoundTripper
+}
+
+func (c Credentials) transport() http.RoundTripper {
+	if c.Transport == nil {
+		return http.DefaultTransport
+	}
+	return c.Transport
+}
+
+// authentication is the credential of the requests to an org.
+type authentication struct {
+	username string
+	password string
+	token    string
+	// scoped is set when the requests select the org with X-Grafana-Org-Id,
+	// tokens of an org act in it without the header.
+	scoped bool
+}
+
+// authFor selects the credential for orgID: the token of the org, the token
+// for calls outside orgs, basic auth, and the token when nothing else is set.
+// Tokens of other orgs cannot act in orgID, an error is returned when no
+// credential can.
+func (c Credentials) authFor(orgID uint) (authentication, error) {
+	if token, ok := c.OrgTokens[orgID]; ok && orgID != 0 {
+		return authentication{token: token}, nil
+	}
+	if orgID == 0 && c.Token != "" {
+		return authentication{token: c.Token}, nil
+	}
+	if c.Username != "" {
+		return authentication{username: c.Username, password: c.Password, scoped: true}, nil
+	}
+	if c.Token != "" {
+		return authentication{token: c.Token, scoped: true}, nil
+	}
+	if orgID == 0 {
+		return authentication{}, fmt.Errorf("%w: calls outside team orgs need the grafana-token key or basic auth", ErrNoOrgCredential)
+	}
+	return authentication{}, fmt.Errorf("%w: org %d needs the grafana-token-org-%d key, the grafana-token key or basic auth", ErrNoOrgCredential, orgID, orgID)
+}
+
+// Connection holds the Grafana credentials of the operator. They are swapped
+// atomically when they are rotated, clients created afterwards use the new
+// ones.
+type Connection struct {
+	// name is the GrafanaInstance of the connection, empty for Shared.
+	name        string
+	credentials atomic.Pointer[Credentials]
+
+	guardOnce sync.Once
+	guard     *guard
+}
+
+// Shared is the connection of the Grafana of the operator configuration, the
+// default instance unless a GrafanaInstance is marked default.
+var Shared = &Connection{}
+
+// SharedName names Shared in the metrics.
+const SharedName = "shared"
+
+// Name returns the GrafanaInstance of the connection, SharedName for Shared.
+func (c *Connection) Name() string {
+	if c.name == "" {
+		return SharedName
+	}
+	return c.name
+}
+
+// Set replaces the credentials, nil unloads them.
+func (c *Connection) Set(creds *Credentials) {
+	c.credentials.Store(creds)
+}
+
+// guarded returns the loaded credentials with the transport bounded by the
+// guard of the connection, for the clients.
+func (c *Connection) guarded() (Credentials, error) {
+	creds, err := c.Credentials()
+	if err != nil {
+		return creds, err
+	}
+	c.guardOnce.Do(func() { c.guard = newGuard(c.Name()) })
+	creds.Transport = c.guard.wrap(creds.transport())
+	return creds, nil
+}
+
+// Credentials returns the loaded credentials.
+func (c *Connection) Credentials() (Credentials, error) {
+	creds := c.credentials.Load()
+	if creds == nil {
+		return Credentials{}, ErrNoCredentials
+	}
+	return *creds, nil
+}
+
+// NewClient connects to the Grafana API, requests are scoped to orgID unless
+// it is zero.
+func (c *Connection) NewClient(orgID uint) (Client, error) {
+	creds, err := c.guarded()
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(creds, orgID)
+}
+
+// NewAlertingClient connects to the alerting provisioning API of orgID.
+func (c *Connection) NewAlertingClient(orgID uint) (*AlertingClient, error) {
+	creds, err := c.guarded()
+	if err != nil {
+		return nil, err
+	}
+	return NewAlertingClient(creds, orgID)
+}
+
+// NewPrometheusClient connects to the Prometheus datasource with the given
+// UID in orgID.
+func (c *Connection) NewPrometheusClient(orgID uint, datasourceUID string) (*PrometheusClient, error) {
+	creds, err := c.guarded()
+	if err != nil {
+		return nil, err
+	}
+	return NewPrometheusClient(creds, orgID, datasourceUID)
+}
+
+// Ready is a healthz.Checker failing while no credentials are loaded.
+func (c *Connection) Ready(_ *http.Request) error {
+	_, err := c.Credentials()
+	return err
+}
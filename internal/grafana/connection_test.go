@@ -0,0 +1,73 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credentials", func() {
+	basic := Credentials{Username: "admin", Password: "secret"}
+	token := Credentials{Token: "glsa_server"}
+	orgTokens := Credentials{OrgTokens: map[uint]string{2: "glsa_org2"}}
+	all := Credentials{Username: "admin", Password: "secret", Token: "glsa_server", OrgTokens: map[uint]string{2: "glsa_org2"}}
+
+	DescribeTable("authFor picks the credential of an org",
+		func(creds Credentials, orgID uint, want authentication) {
+			Expect(creds.authFor(orgID)).To(Equal(want))
+		},
+		Entry("basic auth outside orgs", basic, uint(0), authentication{username: "admin", password: "secret", scoped: true}),
+		Entry("basic auth in an org", basic, uint(2), authentication{username: "admin", password: "secret", scoped: true}),
+		Entry("token outside orgs", token, uint(0), authentication{token: "glsa_server"}),
+		Entry("token in an org", token, uint(2), authentication{token: "glsa_server", scoped: true}),
+		Entry("org token in its org", orgTokens, uint(2), authentication{token: "glsa_org2"}),
+		Entry("org token preferred in its org", all, uint(2), authentication{token: "glsa_org2"}),
+		Entry("token preferred outside orgs", all, uint(0), authentication{token: "glsa_server"}),
+		Entry("basic auth preferred in other orgs", all, uint(3), authentication{username: "admin", password: "secret", scoped: true}),
+	)
+
+	DescribeTable("authFor refuses orgs no credential can act in",
+		func(creds Credentials, orgID uint) {
+			_, err := creds.authFor(orgID)
+			Expect(err).To(MatchError(ErrNoOrgCredential))
+		},
+		Entry("org token in another org", orgTokens, uint(3)),
+		Entry("org token outside orgs", orgTokens, uint(0)),
+		Entry("nothing", Credentials{}, uint(0)),
+	)
+})
+
+var _ = Describe("Connection", func() {
+	It("serves the credentials last set", func() {
+		conn := &Connection{}
+		_, err := conn.Credentials()
+		Expect(err).To(MatchError(ErrNoCredentials))
+		Expect(conn.Ready(nil)).NotTo(Succeed())
+
+		conn.Set(&Credentials{URL: "http://grafana", Token: "glsa"})
+		creds, err := conn.Credentials()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds.Token).To(Equal("glsa"))
+		Expect(conn.Ready(nil)).To(Succeed())
+
+		conn.Set(nil)
+		_, err = conn.NewClient(1)
+		Expect(err).To(MatchError(ErrNoCredentials))
+	})
+})
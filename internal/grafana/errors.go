@@ -0,0 +1,233 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// maxErrorBody bounds how much of an error response is kept in an Error.
+const maxErrorBody = 4096
+
+// Error is a response of the Grafana API with an error status code. Every
+// call of the clients of this package returns one for a 4xx or 5xx response,
+// wrapped in a *url.Error for the sdk calls; use the Is functions below.
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("HTTP error %d: returns %s", e.StatusCode, e.Body)
+}
+
+// statusTransport turns the error responses of Grafana into an *Error, the
+// sdk ignores the status code of some calls.
+type statusTransport struct {
+	base http.RoundTripper
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode < 400 {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return nil, &Error{StatusCode: resp.StatusCode, Body: string(body)}
+}
+
+// statusCode returns the status code of the Grafana error response of err, 0
+// when err is not one.
+func statusCode(err error) int {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// IsNotFound reports whether err is a 404 of Grafana.
+func IsNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 of Grafana, or a 412 which Grafana
+// returns for a dashboard changed since it was read.
+func IsConflict(err error) bool {
+	code := statusCode(err)
+	return code == http.StatusConflict || code == http.StatusPreconditionFailed
+}
+
+// IsForbidden reports whether err is a 403 of Grafana, the operator lacks a
+// Grafana permission.
+func IsForbidden(err error) bool {
+	return statusCode(err) == http.StatusForbidden
+}
+
+// IsUnauthorized reports whether err is a 401 of Grafana.
+func IsUnauthorized(err error) bool {
+	return statusCode(err) == http.StatusUnauthorized
+}
+
+// IsTransient reports whether err may go away by itself: a 429 or 5xx of
+// Grafana, a network error or timeout, an open circuit breaker or missing
+// credentials.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if code := statusCode(err); code != 0 {
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) || IsUnavailable(err) || errors.Is(err, ErrNoCredentials) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// isPermanent reports whether err is an error response retrying the same
+// request cannot fix: a 400 for a request Grafana does not accept, or a 401
+// for credentials it does not accept.
+func isPermanent(err error) bool {
+	code := statusCode(err)
+	return code == http.StatusBadRequest || code == http.StatusUnauthorized
+}
+
+// Reason returns the condition reason of a Grafana error, empty when err does
+// not come from Grafana.
+func Reason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case IsUnavailable(err):
+		return "GrafanaUnavailable"
+	case IsNotFound(err):
+		return "GrafanaNotFound"
+	case IsConflict(err):
+		return "GrafanaConflict"
+	case IsForbidden(err):
+		return "GrafanaForbidden"
+	case errors.Is(err, ErrNoOrgCredential):
+		return "GrafanaNoCredential"
+	case IsUnauthorized(err):
+		return "GrafanaUnauthorized"
+	case IsTransient(err):
+		return "GrafanaTransient"
+	case statusCode(err) != 0:
+		return "GrafanaError"
+	}
+	return ""
+}
+
+const (
+	// forbiddenRequeueDelay is how often a reconcile failing on a missing
+	// Grafana permission is retried, permissions are granted by hand.
+	forbiddenRequeueDelay = 10 * time.Minute
+	// errorRequeueDelay is how often a reconcile failing on another error
+	// response is retried, such as a 404 of an object removed by hand or a 409
+	// of a concurrent change.
+	errorRequeueDelay = 5 * time.Minute
+)
+
+// errorReconciler requeues the reconciles failing on Grafana according to
+// the error, and reports the errors retrying does not fix.
+type errorReconciler struct {
+	reconcile.Reconciler
+	client    client.Client
+	recorder  record.EventRecorder
+	newObject func() client.Object
+}
+
+// HandleErrors wraps r so only transient Grafana errors fail the reconcile
+// with the error backoff:
+//   - an open circuit breaker is retried once it lets calls through again;
+//   - a 403 is logged with the permission Grafana names, reported as a
+//     GrafanaForbidden Warning event and retried every 10 minutes;
+//   - a 400 or a 401 is reported as a GrafanaError Warning event and not
+//     retried until the object changes or its resync is due;
+//   - other error responses, such as a 404 or a 409, are reported as a
+//     GrafanaError Warning event and retried every 5 minutes, sooner when the
+//     resync of the object is.
+//
+// Events are recorded on the object of the request when newObject is set.
+// Errors which do not come from Grafana are returned as they are.
+func HandleErrors(mgr manager.Manager, r reconcile.Reconciler, newObject func() client.Object) reconcile.Reconciler {
+	return &errorReconciler{
+		Reconciler: r,
+		client:     mgr.GetClient(),
+		recorder:   mgr.GetEventRecorderFor("grafana-complementary-operator"),
+		newObject:  newObject,
+	}
+}
+
+func (e *errorReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	result, err := e.Reconciler.Reconcile(ctx, req)
+	switch {
+	case err == nil || IsTransient(err) && !IsUnavailable(err):
+		return result, err
+	case IsUnavailable(err):
+		log.FromContext(ctx).Info("Grafana is unhealthy, retrying later", "after", breakerCooldown)
+		return ctrl.Result{RequeueAfter: breakerCooldown}, nil
+	case IsForbidden(err):
+		log.FromContext(ctx).Info("Grafana refused the operator a permission, retrying later", "error", err.Error())
+		e.event(ctx, req, "GrafanaForbidden", "Grafana refused the operator a permission, retrying in %s: %v", forbiddenRequeueDelay, err)
+		return ctrl.Result{RequeueAfter: forbiddenRequeueDelay}, nil
+	case errors.Is(err, ErrNoOrgCredential):
+		log.FromContext(ctx).Info("No Grafana credential can act in the org, retrying later", "error", err.Error())
+		e.event(ctx, req, "GrafanaNoCredential", "No Grafana credential can act in the org, retrying in %s: %v", forbiddenRequeueDelay, err)
+		return ctrl.Result{RequeueAfter: forbiddenRequeueDelay}, nil
+	case isPermanent(err):
+		e.event(ctx, req, "GrafanaError", "Grafana rejected a request, not retrying until the object changes: %v", err)
+		if result.RequeueAfter > 0 {
+			return ctrl.Result{RequeueAfter: result.RequeueAfter}, nil
+		}
+		return ctrl.Result{}, reconcile.TerminalError(err)
+	case statusCode(err) != 0:
+		log.FromContext(ctx).Info("Grafana rejected a request, retrying later", "error", err.Error())
+		e.event(ctx, req, "GrafanaError", "Grafana rejected a request, retrying in %s: %v", errorRequeueDelay, err)
+		if result.RequeueAfter > 0 && result.RequeueAfter < errorRequeueDelay {
+			return ctrl.Result{RequeueAfter: result.RequeueAfter}, nil
+		}
+		return ctrl.Result{RequeueAfter: errorRequeueDelay}, nil
+	}
+	return result, err
+}
+
+// event records a Warning event on the object of req, when there is one.
+func (e *errorReconciler) event(ctx context.Context, req ctrl.Request, reason, messageFmt string, args ...interface{}) {
+	if e.newObject == nil {
+		return
+	}
+	obj := e.newObject()
+	if e.client.Get(ctx, req.NamespacedName, obj) == nil {
+		e.recorder.Eventf(obj, corev1.EventTypeWarning, reason, messageFmt, args...)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// sdkError wraps a Grafana error response as the sdk calls return it.
+func sdkError(code int) error {
+	return &url.Error{Op: "Get", URL: "http://grafana/api/orgs", Err: &Error{StatusCode: code}}
+}
+
+var _ = Describe("Grafana errors", func() {
+	DescribeTable("statusCode",
+		func(err error, want int) {
+			Expect(statusCode(err)).To(Equal(want))
+		},
+		Entry("nil", nil, 0),
+		Entry("other error", errors.New("boom"), 0),
+		Entry("error response", &Error{StatusCode: 404}, 404),
+		Entry("sdk error", sdkError(409), 409),
+		Entry("wrapped", fmt.Errorf("creating org: %w", &Error{StatusCode: 403}), 403),
+	)
+
+	DescribeTable("classification",
+		func(err error, transient, permanent bool, reason string) {
+			Expect(IsTransient(err)).To(Equal(transient))
+			Expect(isPermanent(err)).To(Equal(permanent))
+			Expect(Reason(err)).To(Equal(reason))
+		},
+		Entry("nil", nil, false, false, ""),
+		Entry("not from Grafana", errors.New("boom"), false, false, ""),
+		Entry("400", sdkError(400), false, true, "GrafanaError"),
+		Entry("401", sdkError(401), false, true, "GrafanaUnauthorized"),
+		Entry("403", sdkError(403), false, false, "GrafanaForbidden"),
+		Entry("404", sdkError(404), false, false, "GrafanaNotFound"),
+		Entry("409", sdkError(409), false, false, "GrafanaConflict"),
+		Entry("412", &Error{StatusCode: 412}, false, false, "GrafanaConflict"),
+		Entry("422", &Error{StatusCode: 422}, false, false, "GrafanaError"),
+		Entry("429", sdkError(429), true, false, "GrafanaTransient"),
+		Entry("502", sdkError(502), true, false, "GrafanaTransient"),
+		Entry("network error", &url.Error{Op: "Get", URL: "http://grafana", Err: errors.New("connection refused")}, true, false, "GrafanaTransient"),
+		Entry("timeout", fmt.Errorf("listing users: %w", context.DeadlineExceeded), true, false, "GrafanaTransient"),
+		Entry("breaker open", &url.Error{Op: "Get", URL: "http://grafana", Err: ErrUnavailable}, true, false, "GrafanaUnavailable"),
+		Entry("no credentials", ErrNoCredentials, true, false, "GrafanaTransient"),
+		Entry("no org credential", fmt.Errorf("%w: org 2", ErrNoOrgCredential), false, false, "GrafanaNoCredential"),
+	)
+})
+
+// handleCase is a reconcile outcome and how HandleErrors reports it.
+type handleCase struct {
+	result       ctrl.Result
+	err          error
+	want         ctrl.Result
+	wantErr      bool
+	wantTerminal bool
+	// wantEvent is the reason of the Warning event recorded, if any
+	wantEvent string
+}
+
+var _ = Describe("HandleErrors", func() {
+	const resync = time.Minute
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a-prod"}}
+
+	DescribeTable("requeues by error class",
+		func(tt handleCase) {
+			recorder := record.NewFakeRecorder(1)
+			e := &errorReconciler{
+				Reconciler: reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+					return tt.result, tt.err
+				}),
+				client:    fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(ns).Build(),
+				recorder:  recorder,
+				newObject: func() client.Object { return &corev1.Namespace{} },
+			}
+			got, err := e.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ns)})
+			if tt.wantErr {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(errors.Is(err, reconcile.TerminalError(nil))).To(Equal(tt.wantTerminal))
+			Expect(got).To(Equal(tt.want))
+			if tt.wantEvent == "" {
+				Expect(recorder.Events).To(BeEmpty())
+			} else {
+				Expect(recorder.Events).To(Receive(HavePrefix("Warning " + tt.wantEvent + " ")))
+			}
+		},
+		Entry("success", handleCase{result: ctrl.Result{RequeueAfter: resync}, want: ctrl.Result{RequeueAfter: resync}}),
+		Entry("not from Grafana", handleCase{err: errors.New("boom"), wantErr: true}),
+		Entry("transient", handleCase{err: sdkError(502), wantErr: true}),
+		Entry("breaker open", handleCase{err: ErrUnavailable, want: ctrl.Result{RequeueAfter: breakerCooldown}}),
+		Entry("forbidden", handleCase{err: sdkError(403), want: ctrl.Result{RequeueAfter: forbiddenRequeueDelay}, wantEvent: "GrafanaForbidden"}),
+		Entry("no org credential", handleCase{err: ErrNoOrgCredential, want: ctrl.Result{RequeueAfter: forbiddenRequeueDelay}, wantEvent: "GrafanaNoCredential"}),
+		Entry("bad request", handleCase{err: sdkError(400), wantErr: true, wantTerminal: true, wantEvent: "GrafanaError"}),
+		Entry("unauthorized", handleCase{err: sdkError(401), wantErr: true, wantTerminal: true, wantEvent: "GrafanaError"}),
+		Entry("bad request with resync", handleCase{result: ctrl.Result{RequeueAfter: resync}, err: sdkError(400), want: ctrl.Result{RequeueAfter: resync}, wantEvent: "GrafanaError"}),
+		Entry("not found", handleCase{err: sdkError(404), want: ctrl.Result{RequeueAfter: errorRequeueDelay}, wantEvent: "GrafanaError"}),
+		Entry("conflict with sooner resync", handleCase{result: ctrl.Result{RequeueAfter: resync}, err: sdkError(409), want: ctrl.Result{RequeueAfter: resync}, wantEvent: "GrafanaError"}),
+		Entry("conflict with later resync", handleCase{result: ctrl.Result{RequeueAfter: time.Hour}, err: sdkError(409), want: ctrl.Result{RequeueAfter: errorRequeueDelay}, wantEvent: "GrafanaError"}),
+	)
+})
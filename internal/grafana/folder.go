@@ -0,0 +1,160 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grafana-tools/sdk"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// NamespaceFinalizer keeps a namespace until the operator removed what it
+// wrote to Grafana for it: its datasource and the content of its folder.
+const NamespaceFinalizer = "monitoring.snappcloud.io/grafana-datasource"
+
+// GuardNamespace adds NamespaceFinalizer to ns. The controllers writing to
+// the namespace folder call it first, so the namespace controller gets to
+// remove the content once the namespace goes.
+func GuardNamespace(ctx context.Context, c client.Client, ns *corev1.Namespace) error {
+	if controllerutil.ContainsFinalizer(ns, NamespaceFinalizer) {
+		return nil
+	}
+	patch := client.MergeFrom(ns.DeepCopy())
+	controllerutil.AddFinalizer(ns, NamespaceFinalizer)
+	return c.Patch(ctx, ns, patch)
+}
+
+// NamespaceFolderUID returns the UID of the folder holding the Grafana objects
+// of a namespace in its team org. Grafana limits UIDs to 40 characters.
+func NamespaceFolderUID(namespace string) string {
+	hash := sha256.Sum256([]byte(namespace))
+	return "ns-" + hex.EncodeToString(hash[:])[:24]
+}
+
+// EnsureNamespaceFolder returns the folder of namespace in the org of the
+// client, creating it when it does not exist yet.
+func EnsureNamespaceFolder(ctx context.Context, client Client, namespace string) (sdk.Folder, error) {
+	uid := NamespaceFolderUID(namespace)
+	folder, err := client.GetFolderByUID(ctx, uid)
+	if err == nil {
+		return folder, nil
+	}
+	if !IsNotFound(err) {
+		return sdk.Folder{}, err
+	}
+	return client.CreateFolder(ctx, sdk.Folder{UID: uid, Title: namespace})
+}
+
+// GetNamespaceFolder returns the folder of namespace in the org of the
+// client, and whether it exists.
+func GetNamespaceFolder(ctx context.Context, client Client, namespace string) (sdk.Folder, bool, error) {
+	folder, err := client.GetFolderByUID(ctx, NamespaceFolderUID(namespace))
+	if IsNotFound(err) {
+		return sdk.Folder{}, false, nil
+	}
+	if err != nil {
+		return sdk.Folder{}, false, err
+	}
+	return folder, true, nil
+}
+
+// DeleteNamespaceFolder removes the dashboards carrying one of tags from the
+// folder of namespace, then the folder itself unless it still holds other
+// dashboards or keep is set. It reports whether the folder was kept, and is a
+// no-op when the folder does not exist.
+func DeleteNamespaceFolder(ctx context.Context, client Client, namespace string, tags []string, keep bool) (bool, error) {
+	folder, ok, err := GetNamespaceFolder(ctx, client, namespace)
+	if err != nil || !ok {
+		return false, err
+	}
+	boards, err := client.Search(ctx, sdk.SearchType(sdk.SearchTypeDashboard), sdk.SearchFolderID(folder.ID))
+	if err != nil {
+		return false, err
+	}
+	for _, board := range boards {
+		if !hasAnyTag(board.Tags, tags) {
+			keep = true
+			continue
+		}
+		_, err = client.DeleteDashboardByUID(ctx, board.UID)
+		if err != nil && !IsNotFound(err) {
+			return false, err
+		}
+	}
+	if keep {
+		return true, nil
+	}
+	_, err = client.DeleteFolderByUID(ctx, folder.UID)
+	if err != nil && !IsNotFound(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+func hasAnyTag(tags, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if tag == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DefaultFolderPermissions is the access Grafana gives to a new folder.
+var DefaultFolderPermissions = []sdk.FolderPermission{
+	{Role: "Editor", Permission: sdk.PermissionEdit},
+	{Role: "Viewer", Permission: sdk.PermissionView},
+}
+
+// SetFolderPermissions replaces the permissions of the folder with perms. The
+// folder is left untouched when it already has exactly these permissions.
+// It reports whether the permissions were changed.
+func SetFolderPermissions(ctx context.Context, client Client, folderUID string, perms []sdk.FolderPermission) (bool, error) {
+	current, err := client.GetFolderPermissions(ctx, folderUID)
+	if err != nil {
+		return false, err
+	}
+	if permissionSet(current) == permissionSet(perms) {
+		return false, nil
+	}
+	_, err = client.UpdateFolderPermissions(ctx, folderUID, perms...)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// permissionSet returns a comparable form of the user, team and role
+// permissions, ignoring their order.
+func permissionSet(perms []sdk.FolderPermission) string {
+	items := make([]string, 0, len(perms))
+	for _, p := range perms {
+		items = append(items, fmt.Sprintf("user=%d,team=%d,role=%s:%d", p.UserId, p.TeamId, p.Role, p.Permission))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ";")
+}
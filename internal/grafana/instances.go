@@ -0,0 +1,207 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// InstanceLabel selects the GrafanaInstance of a namespace or GrafanaUser, as
+// a label or an annotation. Without it the default instance is used.
+const InstanceLabel = "grafana.snappcloud.io/instance"
+
+// Registry holds a connection per GrafanaInstance. The default instance is
+// the one marked default, or Shared, the Grafana of the operator
+// configuration, when none is.
+type Registry struct {
+	mu          sync.RWMutex
+	connections map[string]*Connection
+	defaultName string
+}
+
+// Instances is the registry used by every controller and webhook.
+var Instances = &Registry{connections: map[string]*Connection{}}
+
+// Connection returns the connection of the named instance, it is created
+// empty when the instance is not loaded yet.
+func (r *Registry) Connection(name string) *Connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn, ok := r.connections[name]
+	if !ok {
+		conn = &Connection{name: name}
+		r.connections[name] = conn
+	}
+	return conn
+}
+
+// Remove forgets the named instance.
+func (r *Registry) Remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.connections, name)
+	if r.defaultName == name {
+		r.defaultName = ""
+	}
+}
+
+// SetDefault makes the named instance the default one, or unsets the default
+// when it is the named instance and isDefault is false.
+func (r *Registry) SetDefault(name string, isDefault bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if isDefault {
+		r.defaultName = name
+	} else if r.defaultName == name {
+		r.defaultName = ""
+	}
+}
+
+// Get returns the connection of the named instance, the default one for an
+// empty name.
+func (r *Registry) Get(name string) (*Connection, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if name == "" {
+		name = r.defaultName
+	}
+	if name == "" {
+		return Shared, nil
+	}
+	conn, ok := r.connections[name]
+	if !ok {
+		return nil, fmt.Errorf("GrafanaInstance %q not found", name)
+	}
+	return conn, nil
+}
+
+// IsDefault reports whether name selects the default instance.
+func (r *Registry) IsDefault(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return name == "" || name == r.defaultName
+}
+
+// Names returns the names of the loaded instances, sorted.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.connections))
+	for name := range r.connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// InstanceOf returns the instance selected by the first of objs selecting
+// one, by label or annotation, empty for the default instance.
+func InstanceOf(objs ...metav1.Object) string {
+	for _, obj := range objs {
+		if name, ok := obj.GetLabels()[InstanceLabel]; ok {
+			return name
+		}
+		if name, ok := obj.GetAnnotations()[InstanceLabel]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+type connectionKey struct{}
+
+// ContextFor returns ctx carrying the connection of the instance selected by
+// objs, see InstanceOf.
+func (r *Registry) ContextFor(ctx context.Context, objs ...metav1.Object) (context.Context, error) {
+	conn, err := r.Get(InstanceOf(objs...))
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, connectionKey{}, conn), nil
+}
+
+// FromContext returns the connection carried by ctx, Shared when it carries
+// none.
+func FromContext(ctx context.Context) *Connection {
+	if conn, ok := ctx.Value(connectionKey{}).(*Connection); ok {
+		return conn
+	}
+	return Shared
+}
+
+// instanceReconciler runs the reconciles with the connection of the instance
+// of the object of the request.
+type instanceReconciler struct {
+	reconcile.Reconciler
+	client    client.Client
+	registry  *Registry
+	newObject func() client.Object
+}
+
+// SelectInstance wraps r so its reconciles carry the connection of the
+// instance selected by the object of the request, or else by its namespace,
+// see FromContext. The namespace alone selects it once the object is
+// deleted. An unknown instance fails the reconcile.
+func SelectInstance(mgr manager.Manager, r reconcile.Reconciler, newObject func() client.Object) reconcile.Reconciler {
+	return &instanceReconciler{
+		Reconciler: r,
+		client:     mgr.GetClient(),
+		registry:   Instances,
+		newObject:  newObject,
+	}
+}
+
+func (i *instanceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	obj := i.newObject()
+	err := i.client.Get(ctx, req.NamespacedName, obj)
+	if err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	var objs []metav1.Object
+	if err == nil {
+		objs = append(objs, obj)
+	}
+	// A deleted object may still have cleanup to do in the Grafana of its namespace
+	if req.Namespace != "" {
+		ns := &corev1.Namespace{}
+		err = i.client.Get(ctx, client.ObjectKey{Name: req.Namespace}, ns)
+		if err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		if err == nil {
+			objs = append(objs, ns)
+		}
+	}
+	ctx, err = i.registry.ContextFor(ctx, objs...)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Unable to select Grafana instance")
+		return ctrl.Result{}, err
+	}
+	return i.Reconciler.Reconcile(ctx, req)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("InstanceOf", func() {
+	labeled := &metav1.ObjectMeta{Labels: map[string]string{InstanceLabel: "labeled"}}
+	annotated := &metav1.ObjectMeta{Annotations: map[string]string{InstanceLabel: "annotated"}}
+	both := &metav1.ObjectMeta{
+		Labels:      map[string]string{InstanceLabel: "label"},
+		Annotations: map[string]string{InstanceLabel: "annotation"},
+	}
+
+	DescribeTable("selects the instance of the first object naming one",
+		func(objs []metav1.Object, want string) {
+			Expect(InstanceOf(objs...)).To(Equal(want))
+		},
+		Entry("none", nil, ""),
+		Entry("unselected", []metav1.Object{&metav1.ObjectMeta{}}, ""),
+		Entry("label", []metav1.Object{labeled}, "labeled"),
+		Entry("annotation", []metav1.Object{annotated}, "annotated"),
+		Entry("label over annotation", []metav1.Object{both}, "label"),
+		Entry("first selecting", []metav1.Object{&metav1.ObjectMeta{}, annotated, labeled}, "annotated"),
+	)
+})
+
+var _ = Describe("Registry", func() {
+	var (
+		r         *Registry
+		primary   *Connection
+		secondary *Connection
+	)
+
+	BeforeEach(func() {
+		r = &Registry{connections: map[string]*Connection{}}
+		primary = r.Connection("primary")
+		secondary = r.Connection("secondary")
+	})
+
+	It("serves the shared connection by default", func() {
+		Expect(r.Get("")).To(BeIdenticalTo(Shared))
+		Expect(r.IsDefault("")).To(BeTrue())
+		Expect(r.Get("secondary")).To(BeIdenticalTo(secondary))
+		Expect(r.IsDefault("secondary")).To(BeFalse())
+		_, err := r.Get("missing")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("serves the instance marked default instead", func() {
+		r.SetDefault("primary", true)
+		Expect(r.Get("")).To(BeIdenticalTo(primary))
+		Expect(r.IsDefault("")).To(BeTrue())
+		Expect(r.IsDefault("primary")).To(BeTrue())
+		Expect(r.Get("secondary")).To(BeIdenticalTo(secondary))
+		Expect(r.IsDefault("secondary")).To(BeFalse())
+
+		r.Remove("primary")
+		Expect(r.Get("")).To(BeIdenticalTo(Shared))
+	})
+})
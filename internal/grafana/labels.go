@@ -0,0 +1,55 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+// Labels and annotations shared by the controllers and the webhooks.
+const (
+	// NamespaceMonitoringLabel marks the namespaces whose metrics are shown in
+	// the Grafana org of their team.
+	NamespaceMonitoringLabel = "monitoring.snappcloud.io/grafana-datasource"
+	// TeamLabel names the team, and so the Grafana org, of a namespace.
+	TeamLabel = "snappcloud.io/team"
+	// DatasourceUIDAnnotation reports the UID of the namespace datasource in
+	// Grafana, for every backend.
+	DatasourceUIDAnnotation = "monitoring.snappcloud.io/grafana-datasource-uid"
+	// DashboardLabel marks the ConfigMaps of a team namespace holding
+	// dashboards, every key ending in .json is a dashboard.
+	DashboardLabel = "grafana.snappcloud.io/dashboard"
+)
+
+// builtinDatasources are the datasource UIDs and names of Grafana itself,
+// which do not read the metrics of a namespace.
+var builtinDatasources = map[string]bool{
+	"grafana":         true,
+	"-- Grafana --":   true,
+	"-- Mixed --":     true,
+	"-- Dashboard --": true,
+	"__expr__":        true,
+}
+
+// IsBuiltinDatasource reports whether a dashboard datasource reference, a
+// name or an object with a UID, points to a datasource of Grafana itself.
+func IsBuiltinDatasource(ref interface{}) bool {
+	switch r := ref.(type) {
+	case string:
+		return builtinDatasources[r]
+	case map[string]interface{}:
+		uid, _ := r["uid"].(string)
+		return builtinDatasources[uid]
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("IsBuiltinDatasource tells apart the datasources of Grafana itself",
+	func(ref interface{}, want bool) {
+		Expect(IsBuiltinDatasource(ref)).To(Equal(want))
+	},
+	Entry("builtin name", "-- Grafana --", true),
+	Entry("builtin UID", map[string]interface{}{"type": "datasource", "uid": "-- Mixed --"}, true),
+	Entry("expression", map[string]interface{}{"type": "__expr__", "uid": "__expr__"}, true),
+	Entry("datasource name", "Prometheus", false),
+	Entry("datasource UID", map[string]interface{}{"type": "loki", "uid": "logs"}, false),
+	Entry("type only", map[string]interface{}{"type": "datasource"}, false),
+	Entry("default datasource", nil, false),
+)
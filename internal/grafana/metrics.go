@@ -0,0 +1,83 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grafana_complementary_grafana_requests_total",
+		Help: "Number of requests sent to the Grafana API, by instance, method, endpoint and status code.",
+	}, []string{"instance", "method", "endpoint", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grafana_complementary_grafana_request_duration_seconds",
+		Help:    "Latency of the requests sent to the Grafana API, by instance, method and endpoint.",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"instance", "method", "endpoint"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(requestsTotal, requestDuration, &tokenCollector{connections: map[*Connection]*tokenExpiries{}})
+}
+
+// observe records an attempt of req, err is set when no response came back.
+func observe(instance string, req *http.Request, resp *http.Response, err error, start time.Time) {
+	endpoint := endpointOf(req.URL.Path)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	requestsTotal.WithLabelValues(instance, req.Method, endpoint, code).Inc()
+	requestDuration.WithLabelValues(instance, req.Method, endpoint).Observe(time.Since(start).Seconds())
+}
+
+// staticSegments are the segments of the Grafana API paths the operator
+// calls which are not IDs, UIDs or names.
+var staticSegments = map[string]bool{
+	"api": true, "user": true, "users": true, "orgs": true, "org": true, "name": true, "teams": true,
+	"search": true, "members": true, "datasources": true, "uid": true, "proxy": true, "folders": true,
+	"permissions": true, "dashboards": true, "db": true, "v1": true, "v2": true, "provisioning": true,
+	"alert-rules": true, "contact-points": true, "policies": true, "folder": true, "labels": true,
+	"label": true, "values": true, "query": true, "health": true, "serviceaccounts": true, "tokens": true,
+}
+
+// endpointOf turns a request path into a low cardinality endpoint, the IDs,
+// UIDs and names are replaced by ":param".
+func endpointOf(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	// Grafana may be served below a sub path
+	for i, segment := range segments {
+		if segment == "api" {
+			segments = segments[i:]
+			break
+		}
+	}
+	for i, segment := range segments {
+		if !staticSegments[segment] {
+			segments[i] = ":param"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,35 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("endpointOf",
+	func(path, want string) {
+		Expect(endpointOf(path)).To(Equal(want))
+	},
+	Entry("static", "/api/user", "/api/user"),
+	Entry("ID", "/api/orgs/3/users", "/api/orgs/:param/users"),
+	Entry("name", "/api/orgs/name/team-a", "/api/orgs/name/:param"),
+	Entry("trailing slash", "/api/folders/abc/permissions/", "/api/folders/:param/permissions"),
+	Entry("sub path", "/grafana/api/folders/abc/permissions", "/api/folders/:param/permissions"),
+	Entry("service account tokens", "/api/serviceaccounts/5/tokens", "/api/serviceaccounts/:param/tokens"),
+	Entry("outside the API", "/login", "/:param"),
+)
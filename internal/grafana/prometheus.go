@@ -0,0 +1,68 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// PrometheusClient queries a Prometheus datasource through the datasource
+// proxy of Grafana, with the credentials of the datasource.
+type PrometheusClient struct {
+	restClient
+	datasourceUID string
+}
+
+// NewPrometheusClient connects to the Prometheus datasource with the given
+// UID in orgID.
+func NewPrometheusClient(creds Credentials, orgID uint, datasourceUID string) (*PrometheusClient, error) {
+	rest, err := newRESTClient(creds, orgID)
+	if err != nil {
+		return nil, err
+	}
+	return &PrometheusClient{restClient: rest, datasourceUID: datasourceUID}, nil
+}
+
+// MetricNames returns the names of the metrics of the series matching the
+// selector.
+func (c *PrometheusClient) MetricNames(ctx context.Context, selector string) ([]string, error) {
+	return c.labelValues(ctx, "__name__", selector)
+}
+
+// LabelNames returns the label names of the series matching the selector.
+func (c *PrometheusClient) LabelNames(ctx context.Context, selector string) ([]string, error) {
+	var resp struct {
+		Data []string `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, c.apiPath("labels", selector), nil, &resp)
+	return resp.Data, err
+}
+
+func (c *PrometheusClient) labelValues(ctx context.Context, label, selector string) ([]string, error) {
+	var resp struct {
+		Data []string `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, c.apiPath("label/"+label+"/values", selector), nil, &resp)
+	return resp.Data, err
+}
+
+func (c *PrometheusClient) apiPath(endpoint, selector string) string {
+	query := url.Values{"match[]": []string{selector}}
+	return "api/datasources/proxy/uid/" + url.PathEscape(c.datasourceUID) + "/api/v1/" + endpoint + "?" + query.Encode()
+}
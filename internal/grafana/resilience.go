@@ -0,0 +1,237 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
+
+	"github.com/snapp-cab/grafana-complementary-operator/internal/env"
+)
+
+// Get how the calls to Grafana are bounded as a env: the timeout of each
+// attempt, how many times a failed call is retried, the request rate and
+// burst per Grafana instance, and how many consecutive failures open the
+// circuit breaker for how long, 0 disables it.
+var callTimeout = env.Duration("GRAFANA_CALL_TIMEOUT", 10*time.Second)
+var maxRetries = env.Int("GRAFANA_MAX_RETRIES", 3)
+var rateLimit = env.Float("GRAFANA_RATE_LIMIT", 20)
+var rateBurst = env.Int("GRAFANA_RATE_BURST", 40)
+var breakerThreshold = env.Int("GRAFANA_BREAKER_THRESHOLD", 5)
+var breakerCooldown = env.Duration("GRAFANA_BREAKER_COOLDOWN", 30*time.Second)
+
+const (
+	// retryBaseDelay is the delay before the first retry, it doubles with
+	// each retry up to retryMaxDelay.
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// ErrUnavailable is returned without calling Grafana while the circuit
+// breaker of its instance is open.
+var ErrUnavailable = errors.New("Grafana is unavailable, circuit breaker open")
+
+// IsUnavailable reports whether err comes from an open circuit breaker.
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
+
+// guard bounds the calls to a Grafana instance: each attempt times out, 5xx
+// and 429 responses are retried with exponential backoff, requests are rate
+// limited, and the circuit breaker fails calls fast once Grafana keeps
+// failing. It is shared by the clients of a Connection.
+type guard struct {
+	// instance labels the metrics of the calls.
+	instance string
+	limiter  flowcontrol.RateLimiter
+	breaker  *breaker
+}
+
+func newGuard(instance string) *guard {
+	burst := rateBurst
+	if burst < 1 {
+		burst = 1
+	}
+	return &guard{
+		instance: instance,
+		limiter:  flowcontrol.NewTokenBucketRateLimiter(float32(rateLimit), burst),
+		breaker:  &breaker{threshold: breakerThreshold, cooldown: breakerCooldown},
+	}
+}
+
+// wrap returns base with the limits of the guard.
+func (g *guard) wrap(base http.RoundTripper) http.RoundTripper {
+	return &guardedTransport{guard: g, base: base}
+}
+
+type guardedTransport struct {
+	*guard
+	base http.RoundTripper
+}
+
+func (t *guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A body which cannot be replayed is sent once
+	retries := maxRetries
+	if req.Body != nil && req.GetBody == nil {
+		retries = 0
+	}
+	for attempt := 0; ; attempt++ {
+		if !t.breaker.allow() {
+			return nil, ErrUnavailable
+		}
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		resp, err := t.attempt(req, attempt)
+		if req.Context().Err() != nil {
+			// The caller gave up, which says nothing about Grafana
+			t.breaker.release()
+		} else {
+			t.breaker.record(err == nil && resp.StatusCode < 500)
+		}
+		if attempt >= retries || !retryable(req, resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			// Drain the body so the connection is reused
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+// attempt sends req once, bounded by callTimeout.
+func (t *guardedTransport) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), callTimeout)
+	req = req.Clone(ctx)
+	if attempt > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		req.Body = body
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	observe(t.instance, req, resp, err, start)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The timeout covers reading the body too
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// retryable reports whether a failed attempt is worth retrying. Requests which
+// may have been applied, POSTs failing with a 5xx or a network error, are not
+// retried, Grafana could create an object twice.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if req.Method == http.MethodPost || req.Method == http.MethodPatch {
+		return false
+	}
+	return err != nil || resp.StatusCode >= 500
+}
+
+// backoff is the delay before retry attempt+1, with jitter.
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << attempt
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// cancelBody releases the timeout of an attempt once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// breaker opens after threshold consecutive failures and fails calls for
+// cooldown. It then lets a single call through, which closes it on success
+// and opens it again on failure.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a call may be sent.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 || b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record counts the outcome of a call.
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends a call without counting it.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("retryable", func() {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	DescribeTable("retries idempotent calls and throttled ones",
+		func(ctx context.Context, method string, status int, err error, want bool) {
+			req, reqErr := http.NewRequestWithContext(ctx, method, "http://grafana/api/orgs", nil)
+			Expect(reqErr).NotTo(HaveOccurred())
+			var resp *http.Response
+			if err == nil {
+				resp = &http.Response{StatusCode: status}
+			}
+			Expect(retryable(req, resp, err)).To(Equal(want))
+		},
+		Entry("GET 5xx", context.Background(), http.MethodGet, http.StatusBadGateway, nil, true),
+		Entry("GET network error", context.Background(), http.MethodGet, 0, errors.New("connection reset"), true),
+		Entry("GET 4xx", context.Background(), http.MethodGet, http.StatusNotFound, nil, false),
+		Entry("PUT 5xx", context.Background(), http.MethodPut, http.StatusServiceUnavailable, nil, true),
+		Entry("DELETE network error", context.Background(), http.MethodDelete, 0, errors.New("connection reset"), true),
+		Entry("POST 5xx", context.Background(), http.MethodPost, http.StatusInternalServerError, nil, false),
+		Entry("POST network error", context.Background(), http.MethodPost, 0, errors.New("connection reset"), false),
+		Entry("PATCH 5xx", context.Background(), http.MethodPatch, http.StatusInternalServerError, nil, false),
+		Entry("POST 429", context.Background(), http.MethodPost, http.StatusTooManyRequests, nil, true),
+		Entry("GET 429", context.Background(), http.MethodGet, http.StatusTooManyRequests, nil, true),
+		Entry("caller gave up", canceled, http.MethodGet, http.StatusBadGateway, nil, false),
+	)
+})
+
+// breakerStep is a call through the breaker.
+type breakerStep struct {
+	// wait lets the cooldown elapse before the call
+	wait      bool
+	wantAllow bool
+	// success is the outcome recorded for an allowed call
+	success bool
+}
+
+var _ = Describe("breaker", func() {
+	DescribeTable("opens after threshold failures and probes after the cooldown",
+		func(threshold int, steps []breakerStep) {
+			b := &breaker{threshold: threshold, cooldown: time.Hour}
+			for i, s := range steps {
+				if s.wait {
+					b.openedAt = b.openedAt.Add(-b.cooldown)
+				}
+				allowed := b.allow()
+				Expect(allowed).To(Equal(s.wantAllow), "step %d", i)
+				if allowed {
+					b.record(s.success)
+				}
+			}
+		},
+		Entry("closed below the threshold", 2,
+			[]breakerStep{{wantAllow: true}, {wantAllow: true, success: true}, {wantAllow: true}, {wantAllow: true}}),
+		Entry("opens at the threshold", 2,
+			[]breakerStep{{wantAllow: true}, {wantAllow: true}, {wantAllow: false}}),
+		Entry("successful probe closes", 1,
+			[]breakerStep{{wantAllow: true}, {wantAllow: false}, {wait: true, wantAllow: true, success: true}, {wantAllow: true}}),
+		Entry("failed probe opens again", 1,
+			[]breakerStep{{wantAllow: true}, {wait: true, wantAllow: true}, {wantAllow: false}}),
+		Entry("disabled", 0,
+			[]breakerStep{{wantAllow: true}, {wantAllow: true}, {wantAllow: true}}),
+	)
+
+	It("lets a single probe through until it is released", func() {
+		b := &breaker{threshold: 1, cooldown: time.Hour}
+		b.allow()
+		b.record(false)
+		b.openedAt = b.openedAt.Add(-b.cooldown)
+		Expect(b.allow()).To(BeTrue())
+		Expect(b.allow()).To(BeFalse())
+		b.release()
+		Expect(b.allow()).To(BeTrue())
+	})
+})
+
+var _ = Describe("backoff", func() {
+	It("stays positive and below the maximum delay", func() {
+		for attempt := 0; attempt < 70; attempt++ {
+			Expect(backoff(attempt)).To(And(BeNumerically(">", 0), BeNumerically("<=", retryMaxDelay)), "attempt %d", attempt)
+		}
+	})
+})
@@ -0,0 +1,93 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// restClient sends JSON requests to the Grafana HTTP API of an organization,
+// for the endpoints the sdk does not cover. Error responses are returned as
+// an *Error.
+type restClient struct {
+	url    string
+	auth   authentication
+	orgID  uint
+	client *http.Client
+}
+
+func newRESTClient(creds Credentials, orgID uint) (restClient, error) {
+	auth, err := creds.authFor(orgID)
+	if err != nil {
+		return restClient{}, err
+	}
+	return restClient{
+		url:    strings.TrimRight(creds.URL, "/"),
+		auth:   auth,
+		orgID:  orgID,
+		client: &http.Client{Transport: &statusTransport{base: creds.transport()}},
+	}, nil
+}
+
+// do sends body as JSON and decodes the response into out when it is set.
+func (c *restClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url+"/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if c.auth.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.auth.token)
+	} else {
+		req.SetBasicAuth(c.auth.username, c.auth.password)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if c.auth.scoped {
+		req.Header.Set("X-Grafana-Org-Id", strconv.FormatUint(uint64(c.orgID), 10))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &Error{StatusCode: resp.StatusCode, Body: string(raw)}
+	}
+	if out == nil || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
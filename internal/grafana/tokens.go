@@ -0,0 +1,183 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// tokenRefreshInterval is how often the expiry of the tokens of the
+	// operator is read from Grafana, the scrapes in between report the last
+	// one read.
+	tokenRefreshInterval = 15 * time.Minute
+	// tokenRefreshTimeout bounds the requests reading the expiry of the
+	// tokens of an instance.
+	tokenRefreshTimeout = 30 * time.Second
+	// serverOrg labels the token used outside orgs.
+	serverOrg = "server"
+)
+
+var tokenExpiryDesc = prometheus.NewDesc("grafana_complementary_grafana_token_expiry_timestamp_seconds",
+	"Expiry of the Grafana service account tokens of the operator, by instance and org; +Inf for tokens which do not expire.",
+	[]string{"instance", "org"}, nil)
+
+// serviceAccountToken is a token of a Grafana service account.
+type serviceAccountToken struct {
+	Expiration *time.Time `json:"expiration"`
+	HasExpired bool       `json:"hasExpired"`
+	IsRevoked  bool       `json:"isRevoked"`
+}
+
+// tokenExpiry returns the earliest expiry of the active tokens of the
+// service account authenticating with the token of creds for orgID, +Inf
+// when none of them expires. Grafana does not tell which of the tokens was
+// used, the earliest one is the first the operator may lose.
+func tokenExpiry(ctx context.Context, creds Credentials, orgID uint) (float64, error) {
+	rest, err := newRESTClient(creds, orgID)
+	if err != nil {
+		return 0, err
+	}
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	err = rest.do(ctx, http.MethodGet, "api/user", nil, &user)
+	if err != nil {
+		return 0, err
+	}
+	var tokens []serviceAccountToken
+	err = rest.do(ctx, http.MethodGet, fmt.Sprintf("api/serviceaccounts/%d/tokens", user.ID), nil, &tokens)
+	if err != nil {
+		return 0, err
+	}
+	expiry := math.Inf(1)
+	for _, token := range tokens {
+		if token.HasExpired || token.IsRevoked || token.Expiration == nil {
+			continue
+		}
+		expiry = math.Min(expiry, float64(token.Expiration.Unix()))
+	}
+	return expiry, nil
+}
+
+// tokenExpiries are the expiries of the tokens of a connection by org label,
+// as read from Grafana for its credentials.
+type tokenExpiries struct {
+	credentials *Credentials
+	fetched     time.Time
+	refreshing  bool
+	expiries    map[string]float64
+}
+
+// tokenCollector reports the expiry of the Grafana tokens of the operator.
+// Scrapes report the expiries last read and start a refresh of the stale
+// ones, so a slow Grafana does not slow them down.
+type tokenCollector struct {
+	mu          sync.Mutex
+	connections map[*Connection]*tokenExpiries
+}
+
+func (c *tokenCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tokenExpiryDesc
+}
+
+func (c *tokenCollector) Collect(ch chan<- prometheus.Metric) {
+	conns := []*Connection{Shared}
+	for _, name := range Instances.Names() {
+		if conn, err := Instances.Get(name); err == nil {
+			conns = append(conns, conn)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := map[*Connection]bool{}
+	for _, conn := range conns {
+		seen[conn] = true
+		creds := conn.credentials.Load()
+		if creds == nil {
+			delete(c.connections, conn)
+			continue
+		}
+		state := c.connections[conn]
+		if state == nil || state.credentials != creds {
+			state = &tokenExpiries{credentials: creds}
+			c.connections[conn] = state
+		}
+		if !state.refreshing && time.Since(state.fetched) > tokenRefreshInterval {
+			state.refreshing = true
+			go c.refresh(conn, state)
+		}
+		for org, expiry := range state.expiries {
+			ch <- prometheus.MustNewConstMetric(tokenExpiryDesc, prometheus.GaugeValue, expiry, conn.Name(), org)
+		}
+	}
+	for conn := range c.connections {
+		if !seen[conn] {
+			delete(c.connections, conn)
+		}
+	}
+}
+
+// refresh reads the expiry of each token of the credentials of state.
+// Tokens whose expiry cannot be read, such as without the serviceaccounts:read
+// permission, are left out.
+func (c *tokenCollector) refresh(conn *Connection, state *tokenExpiries) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+	defer cancel()
+	logger := log.Log.WithName("metrics").WithValues("instance", conn.Name())
+
+	expiries := map[string]float64{}
+	creds, err := conn.guarded()
+	if err == nil {
+		single := Credentials{URL: creds.URL, Transport: creds.Transport}
+		if creds.Token != "" {
+			single.Token = creds.Token
+			expiry, err := tokenExpiry(ctx, single, 0)
+			if err != nil {
+				logger.Info("Unable to read the expiry of the Grafana token", "error", err.Error())
+			} else {
+				expiries[serverOrg] = expiry
+			}
+		}
+		for orgID, token := range creds.OrgTokens {
+			single.Token = ""
+			single.OrgTokens = map[uint]string{orgID: token}
+			expiry, err := tokenExpiry(ctx, single, orgID)
+			if err != nil {
+				logger.Info("Unable to read the expiry of the Grafana token", "org", orgID, "error", err.Error())
+				continue
+			}
+			expiries[strconv.FormatUint(uint64(orgID), 10)] = expiry
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state.refreshing = false
+	state.fetched = time.Now()
+	state.expiries = expiries
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tokenExpiry", func() {
+	DescribeTable("reads the earliest expiry of the active tokens",
+		func(tokens string, status int, want float64) {
+			var auth string
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/user", func(w http.ResponseWriter, r *http.Request) {
+				auth = r.Header.Get("Authorization")
+				_, _ = w.Write([]byte(`{"id":5}`))
+			})
+			mux.HandleFunc("/api/serviceaccounts/5/tokens", func(w http.ResponseWriter, r *http.Request) {
+				if status != 0 {
+					w.WriteHeader(status)
+					return
+				}
+				_, _ = w.Write([]byte(tokens))
+			})
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			got, err := tokenExpiry(context.Background(), Credentials{URL: ts.URL, OrgTokens: map[uint]string{2: "glsa_org2"}}, 2)
+			Expect(auth).To(Equal("Bearer glsa_org2"))
+			if status != 0 {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(want))
+		},
+		Entry("no tokens", `[]`, 0, math.Inf(1)),
+		Entry("without expiry", `[{"expiration":null}]`, 0, math.Inf(1)),
+		Entry("earliest active",
+			`[{"expiration":"2030-01-01T00:00:00Z"},{"expiration":"2029-01-01T00:00:00Z"},`+
+				`{"expiration":"2020-01-01T00:00:00Z","hasExpired":true},{"expiration":"2025-01-01T00:00:00Z","isRevoked":true}]`,
+			0, float64(1861920000)),
+		Entry("forbidden", "", http.StatusForbidden, float64(0)),
+	)
+})
+
+var _ = Describe("Connection name", func() {
+	It("names the shared connection", func() {
+		Expect((&Connection{}).Name()).To(Equal(SharedName))
+		r := &Registry{connections: map[string]*Connection{}}
+		Expect(r.Connection("secondary").Name()).To(Equal("secondary"))
+	})
+})
@@ -0,0 +1,202 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana-tools/sdk"
+	"golang.org/x/sync/singleflight"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// missRefreshInterval bounds how often a lookup of an unknown user refreshes
+// the directory, users show up in Grafana on their first login.
+const missRefreshInterval = 15 * time.Second
+
+// UserDirectory caches the users of the Grafana instances. It is refreshed
+// in the background and on lookups of unknown users, so admission requests do
+// not list every Grafana user. Concurrent refreshes of an instance share one
+// listing, made without holding the cache lock.
+type UserDirectory struct {
+	registry *Registry
+	ttl      time.Duration
+	timeout  time.Duration
+	group    singleflight.Group
+
+	mu     sync.Mutex
+	caches map[string]*userCache
+}
+
+// userCache holds the users of one instance.
+type userCache struct {
+	mu      sync.RWMutex
+	users   []sdk.User
+	fetched time.Time
+}
+
+// NewUserDirectory caches the users of the instances of registry for ttl.
+// Each listing of the users is bounded by timeout.
+func NewUserDirectory(registry *Registry, ttl, timeout time.Duration) *UserDirectory {
+	return &UserDirectory{registry: registry, ttl: ttl, timeout: timeout, caches: map[string]*userCache{}}
+}
+
+// Start refreshes the directory of every instance looked up so far every ttl
+// until ctx is done. It implements manager.Runnable.
+func (d *UserDirectory) Start(ctx context.Context) error {
+	logger := logf.Log.WithName("grafana-users")
+	ticker := time.NewTicker(d.ttl)
+	defer ticker.Stop()
+	for {
+		for _, instance := range d.instances() {
+			conn, err := d.registry.Get(instance)
+			if err != nil {
+				d.forget(instance)
+				continue
+			}
+			if err := d.refresh(ctx, instance, conn); err != nil {
+				logger.Error(err, "Unable to refresh Grafana users", "instance", instance)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every
+// replica serves admission requests.
+func (d *UserDirectory) NeedLeaderElection() bool {
+	return false
+}
+
+// instances returns the instances looked up so far, the default one always.
+func (d *UserDirectory) instances() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	instances := []string{""}
+	for instance := range d.caches {
+		if instance != "" {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// cache returns the cache of instance, empty for the default one.
+func (d *UserDirectory) cache(instance string) *userCache {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.caches[instance]
+	if !ok {
+		c = &userCache{}
+		d.caches[instance] = c
+	}
+	return c
+}
+
+// forget drops the cache of an instance which is gone.
+func (d *UserDirectory) forget(instance string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.caches, instance)
+}
+
+// Missing returns the entries matching no user of the Grafana of instance,
+// the default one when empty, by email or login, case-insensitively. Users
+// found in a stale directory are trusted, an error is returned when the
+// directory is empty or unknown entries could not be checked against a fresh
+// listing.
+func (d *UserDirectory) Missing(ctx context.Context, instance string, entries []string) ([]string, error) {
+	conn, err := d.registry.Get(instance)
+	if err != nil {
+		return entries, err
+	}
+	c := d.cache(instance)
+
+	if time.Since(c.lastFetched()) > d.ttl {
+		err = d.refresh(ctx, instance, conn)
+	}
+	missing := c.missing(entries)
+	if len(missing) > 0 && err == nil && time.Since(c.lastFetched()) > missRefreshInterval {
+		err = d.refresh(ctx, instance, conn)
+		missing = c.missing(entries)
+	}
+	if len(missing) > 0 && err != nil {
+		return missing, err
+	}
+	return missing, nil
+}
+
+func (c *userCache) lastFetched() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.fetched
+}
+
+func (c *userCache) missing(entries []string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	known := make(map[string]bool, 2*len(c.users))
+	for _, user := range c.users {
+		known[strings.ToLower(user.Email)] = true
+		known[strings.ToLower(user.Login)] = true
+	}
+	var missing []string
+	for _, entry := range entries {
+		if !known[strings.ToLower(entry)] {
+			missing = append(missing, entry)
+		}
+	}
+	return missing
+}
+
+// refresh lists the users of instance and stores them. Callers refreshing the
+// same instance at once wait for a single listing, bounded by the directory
+// timeout rather than by the context of the caller which started it; each
+// caller stops waiting when its own ctx is done.
+func (d *UserDirectory) refresh(ctx context.Context, instance string, conn *Connection) error {
+	result := d.group.DoChan(instance, func() (interface{}, error) {
+		client, err := conn.NewClient(0)
+		if err != nil {
+			return nil, err
+		}
+		listCtx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		defer cancel()
+		users, err := client.GetAllUsers(listCtx)
+		if err != nil {
+			return nil, err
+		}
+		c := d.cache(instance)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.users = users
+		c.fetched = time.Now()
+		return nil, nil
+	})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res := <-result:
+		return res.Err
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/grafana-tools/sdk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// usersServer serves the users of a Grafana, or the status when it is set.
+type usersServer struct {
+	mu       sync.Mutex
+	users    []sdk.User
+	status   int
+	listings int
+}
+
+func (s *usersServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path != "/api/users" {
+		http.NotFound(w, r)
+		return
+	}
+	s.listings++
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(s.users)
+}
+
+func (s *usersServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listings
+}
+
+func (s *usersServer) set(status int, users ...sdk.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	s.users = users
+}
+
+// lookupStep is a lookup of entries in the directory.
+type lookupStep struct {
+	// age moves the last listing back in time before the lookup
+	age         time.Duration
+	status      int
+	users       []sdk.User
+	entries     []string
+	want        []string
+	wantErr     bool
+	wantListing bool
+}
+
+var _ = Describe("UserDirectory", func() {
+	jane := sdk.User{Login: "jane", Email: "Jane@snapp.cab"}
+	bob := sdk.User{Login: "bob", Email: "bob@snapp.cab"}
+
+	DescribeTable("Missing",
+		func(steps []lookupStep) {
+			server := &usersServer{}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			registry := &Registry{connections: map[string]*Connection{}}
+			registry.Connection("test").Set(&Credentials{URL: ts.URL, Username: "admin", Password: "secret"})
+			d := NewUserDirectory(registry, 10*time.Minute, 5*time.Second)
+
+			for i, s := range steps {
+				server.set(s.status, s.users...)
+				c := d.cache("test")
+				c.mu.Lock()
+				c.fetched = c.fetched.Add(-s.age)
+				c.mu.Unlock()
+				listings := server.count()
+
+				got, err := d.Missing(context.Background(), "test", s.entries)
+				if s.wantErr {
+					Expect(err).To(HaveOccurred(), "step %d", i)
+				} else {
+					Expect(err).NotTo(HaveOccurred(), "step %d", i)
+				}
+				Expect(got).To(Equal(s.want), "step %d", i)
+				Expect(server.count() > listings).To(Equal(s.wantListing), "step %d: listed users", i)
+			}
+		},
+		Entry("matches email and login case-insensitively", []lookupStep{
+			{users: []sdk.User{jane}, entries: []string{"jane@snapp.cab", "JANE", "bob"}, want: []string{"bob"}, wantListing: true},
+		}),
+		Entry("caches the users", []lookupStep{
+			{users: []sdk.User{jane}, entries: []string{"jane"}, wantListing: true},
+			{users: []sdk.User{jane}, entries: []string{"jane"}},
+		}),
+		Entry("refreshes for unknown users at most every interval", []lookupStep{
+			{users: []sdk.User{jane}, entries: []string{"bob"}, want: []string{"bob"}, wantListing: true},
+			{users: []sdk.User{jane, bob}, entries: []string{"bob"}, want: []string{"bob"}},
+			{age: missRefreshInterval, users: []sdk.User{jane, bob}, entries: []string{"bob"}, wantListing: true},
+		}),
+		Entry("refreshes an expired directory", []lookupStep{
+			{users: []sdk.User{jane}, entries: []string{"jane"}, wantListing: true},
+			{age: time.Hour, users: []sdk.User{bob}, entries: []string{"jane"}, want: []string{"jane"}, wantListing: true},
+		}),
+		Entry("fails when unreachable without users", []lookupStep{
+			{status: http.StatusForbidden, entries: []string{"jane"}, want: []string{"jane"}, wantErr: true, wantListing: true},
+		}),
+		Entry("trusts stale users when unreachable", []lookupStep{
+			{users: []sdk.User{jane}, entries: []string{"jane"}, wantListing: true},
+			{age: time.Hour, status: http.StatusForbidden, entries: []string{"jane"}, wantListing: true},
+			{age: time.Hour, status: http.StatusForbidden, entries: []string{"bob"}, want: []string{"bob"}, wantErr: true, wantListing: true},
+		}),
+	)
+
+	It("reports every entry missing for an unknown instance", func() {
+		d := NewUserDirectory(&Registry{connections: map[string]*Connection{}}, time.Minute, time.Second)
+		got, err := d.Missing(context.Background(), "missing", []string{"jane"})
+		Expect(err).To(HaveOccurred())
+		Expect(got).To(Equal([]string{"jane"}))
+	})
+})
@@ -25,16 +25,24 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	grafanav1alpha1 "github.com/grafana-operator/grafana-operator/v4/api/integreatly/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	grafanauserv1alpha1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1alpha1"
+	grafanauserv1beta1 "github.com/snapp-cab/grafana-complementary-operator/apis/grafana/v1beta1"
+	alertingcontrollers "github.com/snapp-cab/grafana-complementary-operator/controllers/alerting"
+	credentialscontrollers "github.com/snapp-cab/grafana-complementary-operator/controllers/credentials"
 	grafanausercontrollers "github.com/snapp-cab/grafana-complementary-operator/controllers/grafanauser"
 	namesapcecontrollers "github.com/snapp-cab/grafana-complementary-operator/controllers/namespace"
+	"github.com/snapp-cab/grafana-complementary-operator/internal/grafana"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -48,6 +56,7 @@ func init() {
 
 	utilruntime.Must(grafanav1alpha1.AddToScheme(scheme))
 	utilruntime.Must(grafanauserv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(grafanauserv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -70,22 +79,63 @@ func main() {
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
+		Metrics:                metricsserver.Options{BindAddress: metricsAddr},
+		WebhookServer:          webhook.NewServer(webhook.Options{Port: 9443}),
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "5a5bab80.snappcloud.io",
+		// Secrets are read from the API server, the controllers only watch their metadata
+		Client: client.Options{Cache: &client.CacheOptions{DisableFor: []client.Object{&corev1.Secret{}}}},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	if err = (&credentialscontrollers.CredentialsReconciler{
+		Client:     mgr.GetClient(),
+		Connection: grafana.Shared,
+		Recorder:   mgr.GetEventRecorderFor("grafana-complementary-operator"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GrafanaCredentials")
+		os.Exit(1)
+	}
+	if err = (&credentialscontrollers.GrafanaInstanceReconciler{
+		Client:   mgr.GetClient(),
+		Registry: grafana.Instances,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GrafanaInstance")
+		os.Exit(1)
+	}
 	if err = (&namesapcecontrollers.NamespaceReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("grafana-complementary-operator"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Namespace")
+		os.Exit(1)
+	}
+	if err = (&namesapcecontrollers.TeamReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("grafana-complementary-operator"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Team")
+		os.Exit(1)
+	}
+	if err = (&namesapcecontrollers.MonitorDashboardReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Namespace")
+		setupLog.Error(err, "unable to create controller", "controller", "MonitorDashboard")
+		os.Exit(1)
+	}
+	if err = (&namesapcecontrollers.TeamDashboardReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("grafana-complementary-operator"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "TeamDashboard")
 		os.Exit(1)
 	}
 	if err = (&grafanausercontrollers.GrafanaUserReconciler{
@@ -95,10 +145,44 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "GrafanaUser")
 		os.Exit(1)
 	}
+	if err = (&alertingcontrollers.GrafanaAlertingConfigReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GrafanaAlertingConfig")
+		os.Exit(1)
+	}
+	if err = (&alertingcontrollers.PrometheusRuleReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PrometheusRule")
+		os.Exit(1)
+	}
 	if err = (&grafanauserv1alpha1.GrafanaUser{}).SetupWebhookWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create webhook", "webhook", "GrafanaUser")
 		os.Exit(1)
 	}
+	if err = (&grafanauserv1beta1.GrafanaUser{}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "GrafanaUser")
+		os.Exit(1)
+	}
+	if err = (&grafanauserv1alpha1.DashboardValidator{
+		Client: mgr.GetClient(),
+	}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "Dashboard")
+		os.Exit(1)
+	}
+	if err = (&namesapcecontrollers.NamespaceValidator{
+		Client: mgr.GetClient(),
+	}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "Namespace")
+		os.Exit(1)
+	}
+	if err = (&namesapcecontrollers.DatasourceGuard{}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "GrafanaDataSource")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -109,6 +193,10 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("grafana-credentials", grafana.Shared.Ready); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {